@@ -0,0 +1,253 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ClientError records an error sent to a client, for support diagnostics.
+// Only the server's own error text is kept, never client payloads.
+type ClientError struct {
+	Code    string    `json:"code"`
+	Message string    `json:"message"`
+	At      time.Time `json:"at"`
+}
+
+// ClientInfo is the admin view of a connected client
+type ClientInfo struct {
+	ID          string       `json:"id"`
+	RoomID      string       `json:"roomId,omitempty"`
+	Rooms       []string     `json:"rooms,omitempty"`
+	ConnectedAt time.Time    `json:"connectedAt"`
+	Compressed  bool         `json:"compressed,omitempty"`
+	Version     string       `json:"version,omitempty"`
+	LastError   *ClientError `json:"lastError,omitempty"`
+}
+
+// checkAdminToken validates the bearer token against ADMIN_TOKEN. Admin
+// endpoints are disabled entirely when ADMIN_TOKEN is unset.
+func checkAdminToken(w http.ResponseWriter, r *http.Request) bool {
+	expected := os.Getenv("ADMIN_TOKEN")
+	if expected == "" {
+		http.NotFound(w, r)
+		return false
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// adminClientsHandler lists connected clients across all shards
+func adminClientsHandler(hubs ...*Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		setSecurityHeaders(w)
+		if !checkAdminToken(w, r) {
+			return
+		}
+
+		clients := []ClientInfo{}
+		for _, hub := range hubs {
+			hub.mu.RLock()
+			for _, client := range hub.clients {
+				var rooms []string
+				for id := range client.Rooms {
+					rooms = append(rooms, id)
+				}
+				slices.Sort(rooms)
+
+				clients = append(clients, ClientInfo{
+					ID:          client.ID,
+					RoomID:      client.RoomID,
+					Rooms:       rooms,
+					ConnectedAt: client.ConnectedAt,
+					Compressed:  client.Compressed,
+					Version:     client.Version,
+					LastError:   client.lastError.Load(),
+				})
+			}
+			hub.mu.RUnlock()
+		}
+		slices.SortFunc(clients, func(a, b ClientInfo) int {
+			return strings.Compare(a.ID, b.ID)
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(clients)
+	}
+}
+
+// RoomInfo is the ops view of a live room
+type RoomInfo struct {
+	RoomID      string    `json:"roomId"`
+	ClientCount int       `json:"clientCount"`
+	CreatedAt   time.Time `json:"createdAt"`
+	AgeSeconds  int64     `json:"ageSeconds"`
+}
+
+// roomsHandler lists every live room across all shards, public or not.
+// Like the admin endpoints it needs ADMIN_TOKEN, so it is off by default.
+func roomsHandler(hubs ...*Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		setSecurityHeaders(w)
+		if !checkAdminToken(w, r) {
+			return
+		}
+
+		now := time.Now()
+		rooms := []RoomInfo{}
+		for _, hub := range hubs {
+			hub.mu.RLock()
+			for _, room := range hub.rooms {
+				room.mu.RLock()
+				rooms = append(rooms, RoomInfo{
+					RoomID:      room.ID,
+					ClientCount: len(room.Clients),
+					CreatedAt:   room.CreatedAt,
+					AgeSeconds:  int64(now.Sub(room.CreatedAt).Seconds()),
+				})
+				room.mu.RUnlock()
+			}
+			hub.mu.RUnlock()
+		}
+		slices.SortFunc(rooms, func(a, b RoomInfo) int {
+			return strings.Compare(a.RoomID, b.RoomID)
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rooms)
+	}
+}
+
+// adminEventsHandler streams lifecycle events from every shard to an admin
+// WebSocket until it disconnects
+func adminEventsHandler(events *eventBus) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !checkAdminToken(w, r) {
+			return
+		}
+
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			slog.Error("Admin WebSocket upgrade failed",
+				slog.String("error", err.Error()))
+			return
+		}
+		defer conn.Close()
+
+		sub := events.subscribe()
+		defer events.unsubscribe(sub)
+
+		// The admin client sends nothing; reading only detects it leaving
+		gone := make(chan struct{})
+		go func() {
+			defer close(gone)
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+
+		for {
+			select {
+			case ev := <-sub:
+				conn.SetWriteDeadline(time.Now().Add(writeWait))
+				if err := conn.WriteJSON(ev); err != nil {
+					return
+				}
+			case <-gone:
+				return
+			}
+		}
+	}
+}
+
+// TranscriptResponse is the body of a room transcript export
+type TranscriptResponse struct {
+	RoomID  string            `json:"roomId"`
+	Dropped int               `json:"dropped"` // Older entries no longer kept
+	Entries []TranscriptEntry `json:"entries"`
+}
+
+// adminRoomHandler serves per-room admin endpoints under /admin/rooms/.
+// GET /admin/rooms/<id>/transcript exports the room's signaling
+// transcript, recorded only for rooms created with one requested.
+func adminRoomHandler(shards *ShardedHub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		setSecurityHeaders(w)
+		if !checkAdminToken(w, r) {
+			return
+		}
+
+		roomID, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/admin/rooms/"), "/transcript")
+		if !ok || roomID == "" || strings.Contains(roomID, "/") {
+			http.NotFound(w, r)
+			return
+		}
+
+		hub := shards.shardFor(roomID)
+		hub.mu.RLock()
+		room, ok := hub.rooms[roomID]
+		hub.mu.RUnlock()
+		if !ok {
+			http.Error(w, errRoomNotFound.Error(), http.StatusNotFound)
+			return
+		}
+
+		room.mu.RLock()
+		t := room.transcript
+		var resp TranscriptResponse
+		if t != nil {
+			resp = TranscriptResponse{RoomID: roomID, Dropped: t.dropped, Entries: t.snapshot()}
+		}
+		room.mu.RUnlock()
+		if t == nil {
+			http.Error(w, "no transcript recorded for room", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// adminMigrateHandler moves a room to another shard:
+// POST /admin/rooms/migrate?room=<id>&shard=<index>
+func adminMigrateHandler(shards *ShardedHub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		setSecurityHeaders(w)
+		if !checkAdminToken(w, r) {
+			return
+		}
+
+		roomID := r.URL.Query().Get("room")
+		to, err := strconv.Atoi(r.URL.Query().Get("shard"))
+		if roomID == "" || err != nil {
+			http.Error(w, "room and shard are required", http.StatusBadRequest)
+			return
+		}
+
+		switch err := shards.MigrateRoom(roomID, to); err {
+		case nil:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]any{"roomId": roomID, "shard": to})
+		case errRoomNotFound:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errRoomShared:
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestAdminClients_LastError(t *testing.T) {
+	t.Setenv("ADMIN_TOKEN", "admin-secret")
+
+	hub := NewHub()
+	client := &Client{ID: "test-client", Hub: hub, Send: make(chan []byte, 256)}
+	hub.clients[client.ID] = client
+
+	// Resetting without being in a room is an error
+	hub.ResetRoom(client, "")
+
+	req := httptest.NewRequest("GET", "/admin/clients", nil)
+	req.Header.Set("Authorization", "Bearer admin-secret")
+	rec := httptest.NewRecorder()
+	adminClientsHandler(hub).ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", rec.Code)
+	}
+
+	var clients []ClientInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &clients); err != nil {
+		t.Fatalf("Failed to parse JSON: %v", err)
+	}
+	if len(clients) != 1 {
+		t.Fatalf("Expected 1 client, got %d", len(clients))
+	}
+	if clients[0].LastError == nil {
+		t.Fatal("Expected last error to be reported")
+	}
+	if clients[0].LastError.Message != "Not in a room" {
+		t.Errorf("Last error = %q, want 'Not in a room'", clients[0].LastError.Message)
+	}
+	if clients[0].LastError.At.IsZero() {
+		t.Error("Last error timestamp not set")
+	}
+}
+
+func TestRoomsHandler(t *testing.T) {
+	t.Setenv("ADMIN_TOKEN", "admin-secret")
+
+	hub := NewHub()
+	hub.maxRoomClients = 0
+	for i, roomID := range []string{"room-a", "room-a", "room-b"} {
+		client := &Client{ID: fmt.Sprintf("client-%d", i), Hub: hub, Send: make(chan []byte, 256)}
+		hub.clients[client.ID] = client
+		hub.JoinRoom(client, roomID)
+	}
+
+	rec := httptest.NewRecorder()
+	roomsHandler(hub).ServeHTTP(rec, httptest.NewRequest("GET", "/rooms", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without a token, got %d", rec.Code)
+	}
+
+	req := httptest.NewRequest("GET", "/rooms", nil)
+	req.Header.Set("Authorization", "Bearer admin-secret")
+	rec = httptest.NewRecorder()
+	roomsHandler(hub).ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", rec.Code)
+	}
+	if rec.Header().Get("X-Content-Type-Options") != "nosniff" {
+		t.Error("Security headers not set")
+	}
+
+	var rooms []map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &rooms); err != nil {
+		t.Fatalf("Failed to parse JSON: %v", err)
+	}
+	if len(rooms) != 2 {
+		t.Fatalf("Expected 2 rooms, got %d", len(rooms))
+	}
+	for _, key := range []string{"roomId", "clientCount", "createdAt", "ageSeconds"} {
+		if _, ok := rooms[0][key]; !ok {
+			t.Errorf("Room entry missing %q: %v", key, rooms[0])
+		}
+	}
+	if rooms[0]["roomId"] != "room-a" || rooms[0]["clientCount"] != 2.0 {
+		t.Errorf("First room = %v, want room-a with 2 clients", rooms[0])
+	}
+	if rooms[1]["roomId"] != "room-b" || rooms[1]["clientCount"] != 1.0 {
+		t.Errorf("Second room = %v, want room-b with 1 client", rooms[1])
+	}
+}
+
+func TestAdminClients_Auth(t *testing.T) {
+	hub := NewHub()
+
+	tests := []struct {
+		name     string
+		token    string
+		header   string
+		expected int
+	}{
+		{name: "disabled without ADMIN_TOKEN", token: "", header: "Bearer anything", expected: http.StatusNotFound},
+		{name: "wrong token", token: "admin-secret", header: "Bearer guess", expected: http.StatusUnauthorized},
+		{name: "missing token", token: "admin-secret", header: "", expected: http.StatusUnauthorized},
+		{name: "correct token", token: "admin-secret", header: "Bearer admin-secret", expected: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("ADMIN_TOKEN", tt.token)
+
+			req := httptest.NewRequest("GET", "/admin/clients", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			rec := httptest.NewRecorder()
+			adminClientsHandler(hub).ServeHTTP(rec, req)
+
+			if rec.Code != tt.expected {
+				t.Errorf("Expected status %d, got %d", tt.expected, rec.Code)
+			}
+		})
+	}
+}
+
+func TestAdminEvents_StreamsJoin(t *testing.T) {
+	t.Setenv("ADMIN_TOKEN", "admin-secret")
+
+	hub := NewHub()
+	server := httptest.NewServer(adminEventsHandler(hub.events))
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+	header := http.Header{"Authorization": {"Bearer admin-secret"}}
+	ws, _, err := websocket.DefaultDialer.Dial(wsURL, header)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+
+	// Wait for the subscription before generating events
+	for i := 0; i < 100 && subscriberCount(hub.events) == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+
+	client := &Client{ID: "test-client", Hub: hub, Send: make(chan []byte, 256)}
+	hub.clients[client.ID] = client
+	hub.JoinRoom(client, "room-123")
+
+	var ev LifecycleEvent
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	if err := ws.ReadJSON(&ev); err != nil {
+		t.Fatalf("Failed to read event: %v", err)
+	}
+	if ev.Type != EventJoin || ev.ClientID != "test-client" || ev.RoomID != "room-123" {
+		t.Errorf("Unexpected event %+v", ev)
+	}
+
+	// Disconnecting the admin removes its subscription
+	ws.Close()
+	for i := 0; i < 100 && subscriberCount(hub.events) > 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if n := subscriberCount(hub.events); n != 0 {
+		t.Errorf("Expected no subscribers after disconnect, got %d", n)
+	}
+}
+
+func TestAdminEvents_RequiresToken(t *testing.T) {
+	t.Setenv("ADMIN_TOKEN", "admin-secret")
+
+	req := httptest.NewRequest("GET", "/admin/events", nil)
+	rec := httptest.NewRecorder()
+	adminEventsHandler(newEventBus()).ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401, got %d", rec.Code)
+	}
+}
+
+func subscriberCount(b *eventBus) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subs)
+}
+
+func TestAdminRoomTranscript(t *testing.T) {
+	t.Setenv("ADMIN_TOKEN", "admin-secret")
+
+	shards := NewShardedHub(1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	shards.Run(ctx)
+
+	alice, aliceConn := connectMem(t, shards.Entry())
+	bob, bobConn := connectMem(t, shards.Entry())
+	aliceConn.send(t, SignalingMessage{
+		Type:    MsgTypeHandshakeInit,
+		RoomID:  "debug-room",
+		Payload: json.RawMessage(`{"transcript":true}`),
+	})
+	aliceConn.expect(t, MsgTypeJoined)
+	bobConn.send(t, SignalingMessage{Type: MsgTypeHandshakeInit, RoomID: "debug-room"})
+	bobConn.expect(t, MsgTypeJoined)
+
+	aliceConn.send(t, SignalingMessage{Type: MsgTypeOffer, Payload: json.RawMessage(`{"sdp":"offer"}`)})
+	bobConn.expect(t, MsgTypeOffer)
+	bobConn.send(t, SignalingMessage{Type: MsgTypeAnswer, To: alice.ID, Payload: json.RawMessage(`{"sdp":"answer!"}`)})
+	aliceConn.expect(t, MsgTypeAnswer)
+	aliceConn.send(t, SignalingMessage{Type: MsgTypeICECandidate, Payload: json.RawMessage(`{}`)})
+	bobConn.expect(t, MsgTypeICECandidate)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Authorization", "Bearer admin-secret")
+		rec := httptest.NewRecorder()
+		adminRoomHandler(shards).ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get("/admin/rooms/debug-room/transcript")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body)
+	}
+	var resp TranscriptResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to parse JSON: %v", err)
+	}
+	want := []TranscriptEntry{
+		{Type: MsgTypeOffer, From: alice.ID, Size: len(`{"sdp":"offer"}`)},
+		{Type: MsgTypeAnswer, From: bob.ID, To: alice.ID, Size: len(`{"sdp":"answer!"}`)},
+		{Type: MsgTypeICECandidate, From: alice.ID, Size: 2},
+	}
+	if len(resp.Entries) != len(want) {
+		t.Fatalf("Expected %d entries, got %+v", len(want), resp.Entries)
+	}
+	for i, e := range resp.Entries {
+		w := want[i]
+		if e.Type != w.Type || e.From != w.From || e.To != w.To || e.Size != w.Size {
+			t.Errorf("Entry %d = %+v, want %+v", i, e, w)
+		}
+		if e.Payload != nil {
+			t.Errorf("Entry %d kept its payload without TRANSCRIPT_PAYLOADS", i)
+		}
+		if i > 0 && e.At.Before(resp.Entries[i-1].At) {
+			t.Errorf("Entry %d is out of order", i)
+		}
+	}
+
+	// Rooms created without a transcript, and unknown rooms, have none
+	_, otherConn := connectMem(t, shards.Entry())
+	otherConn.send(t, SignalingMessage{Type: MsgTypeHandshakeInit, RoomID: "plain-room"})
+	otherConn.expect(t, MsgTypeJoined)
+	for _, path := range []string{"/admin/rooms/plain-room/transcript", "/admin/rooms/missing/transcript", "/admin/rooms/debug-room"} {
+		if rec := get(path); rec.Code != http.StatusNotFound {
+			t.Errorf("%s: expected status 404, got %d", path, rec.Code)
+		}
+	}
+}
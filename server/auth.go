@@ -0,0 +1,42 @@
+package main
+
+import "net/http"
+
+// AuthFunc authenticates a /ws request before it is upgraded, so
+// deployments can plug in JWT, API-key or other auth without forking. A
+// non-nil error refuses the connection with 401; a non-empty identity
+// becomes the client's ID in place of a random one. A later connection with
+// the same identity is refused while the earlier one is live, unless it also
+// presents the earlier one's resume token to take over its session.
+type AuthFunc func(r *http.Request) (identity string, err error)
+
+// allowAnonymous is the default AuthFunc: every request is accepted and the
+// client gets a random ID
+func allowAnonymous(*http.Request) (string, error) {
+	return "", nil
+}
+
+// authenticate is the AuthFunc serveWs consults
+var authenticate AuthFunc = allowAnonymous
+
+// maxClientIDLen bounds client-chosen IDs, which appear in every message
+// relayed to their peers
+const maxClientIDLen = 64
+
+// validClientID reports whether id, passed as ?clientId= on /ws, is usable
+// as a client ID: letters, digits, '-' and '_' only. Client IDs are shown to
+// room peers, so a client-chosen ID is only as private as the room; deployments
+// that need sessions bound to a user should derive the ID in an AuthFunc.
+func validClientID(id string) bool {
+	if id == "" || len(id) > maxClientIDLen {
+		return false
+	}
+	for _, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
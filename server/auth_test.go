@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestServeWs_AuthFunc(t *testing.T) {
+	prev := authenticate
+	authenticate = func(r *http.Request) (string, error) {
+		key := r.Header.Get("X-API-Key")
+		if key == "" {
+			return "", errors.New("missing API key")
+		}
+		return "user-" + key, nil
+	}
+	defer func() { authenticate = prev }()
+
+	hub := NewHub()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go hub.Run(ctx)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveWs(hub, w, r)
+	}))
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err == nil {
+		t.Fatal("Expected an unauthenticated connection to be refused")
+	}
+	if resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected 401, got %v", resp)
+	}
+
+	ws, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"X-API-Key": {"alice"}})
+	if err != nil {
+		t.Fatalf("Failed to connect with API key: %v", err)
+	}
+	defer ws.Close()
+
+	var msg SignalingMessage
+	if err := ws.ReadJSON(&msg); err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	if msg.Type != MsgTypeConnected || msg.ClientID != "user-alice" {
+		t.Errorf("Expected connected as user-alice, got %v as %q", msg.Type, msg.ClientID)
+	}
+}
+
+func TestServeWs_ReconnectChurn(t *testing.T) {
+	prevAuth, prevLimiter := authenticate, reconnectLimiter
+	authenticate = func(r *http.Request) (string, error) {
+		return r.Header.Get("X-User"), nil
+	}
+	reconnectLimiter = NewRateLimiter(3, time.Minute)
+	defer func() {
+		reconnectLimiter.Stop()
+		authenticate, reconnectLimiter = prevAuth, prevLimiter
+	}()
+
+	hub := NewHub()
+	connect := func(user string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/ws", nil)
+		req.Header.Set("X-User", user)
+		rec := httptest.NewRecorder()
+		serveWs(hub, rec, req)
+		return rec
+	}
+
+	for i := 0; i < 3; i++ {
+		if rec := connect("alice"); rec.Code == http.StatusTooManyRequests {
+			t.Fatalf("Attempt %d throttled too early", i+1)
+		}
+	}
+	rec := connect("alice")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected 429 once over the limit, got %d", rec.Code)
+	}
+	var failure UpgradeFailure
+	json.NewDecoder(rec.Body).Decode(&failure)
+	if failure.Reason != UpgradeReasonReconnectChurn {
+		t.Errorf("Expected reason %q, got %q", UpgradeReasonReconnectChurn, failure.Reason)
+	}
+
+	if rec := connect("bob"); rec.Code == http.StatusTooManyRequests {
+		t.Error("A distinct identity should not be throttled")
+	}
+}
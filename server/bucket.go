@@ -0,0 +1,110 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// tokenBucket allows bursts of up to burst events, refilling at rate per
+// second. It is not safe for concurrent use; callers hold their own lock.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   now,
+	}
+}
+
+// allow takes a token if one is available at time now
+func (b *tokenBucket) allow(now time.Time) bool {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = min(b.burst, b.tokens+elapsed*b.rate)
+		b.last = now
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// full reports whether the bucket would be back to its burst at time now,
+// i.e. it has been idle long enough to forget
+func (b *tokenBucket) full(now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst
+}
+
+// TokenBucketLimiter limits connections per IP with a token bucket each:
+// an IP may burst up to burst connections, then one more per 1/rate
+// seconds. Unlike RateLimiter's window, capacity comes back gradually.
+type TokenBucketLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	rate    float64 // Tokens per second
+	burst   int
+	now     func() time.Time
+	stopCh  chan struct{}
+}
+
+func NewTokenBucketLimiter(rate float64, burst int) *TokenBucketLimiter {
+	tl := &TokenBucketLimiter{
+		buckets: make(map[string]*tokenBucket),
+		rate:    rate,
+		burst:   burst,
+		now:     time.Now,
+		stopCh:  make(chan struct{}),
+	}
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				tl.cleanup()
+			case <-tl.stopCh:
+				return
+			}
+		}
+	}()
+	return tl
+}
+
+func (tl *TokenBucketLimiter) Stop() {
+	close(tl.stopCh)
+}
+
+// Allow takes a token from the IP's bucket if one is available
+func (tl *TokenBucketLimiter) Allow(ip string) bool {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+
+	now := tl.now()
+	b, ok := tl.buckets[ip]
+	if !ok {
+		b = newTokenBucket(tl.rate, tl.burst, now)
+		tl.buckets[ip] = b
+	}
+	return b.allow(now)
+}
+
+// cleanup forgets IPs whose buckets have refilled, which a new bucket
+// would match anyway
+func (tl *TokenBucketLimiter) cleanup() {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+
+	now := tl.now()
+	for ip, b := range tl.buckets {
+		if b.full(now) {
+			delete(tl.buckets, ip)
+		}
+	}
+}
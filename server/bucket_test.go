@@ -0,0 +1,102 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(2, 3, now)
+
+	for i := 0; i < 3; i++ {
+		if !b.allow(now) {
+			t.Errorf("Burst event %d should be allowed", i+1)
+		}
+	}
+	if b.allow(now) {
+		t.Error("Event beyond burst should be denied")
+	}
+
+	// Half a second at 2/s refills one token
+	now = now.Add(500 * time.Millisecond)
+	if !b.allow(now) {
+		t.Error("Refilled token should be allowed")
+	}
+	if b.allow(now) {
+		t.Error("Only one token should have refilled")
+	}
+
+	// Refill is capped at the burst size
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		if !b.allow(now) {
+			t.Errorf("Event %d after long idle should be allowed", i+1)
+		}
+	}
+	if b.allow(now) {
+		t.Error("Tokens should not accumulate beyond burst")
+	}
+}
+
+func TestTokenBucketLimiter_VersusWindow(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := base
+	clock := func() time.Time { return now }
+
+	window := NewRateLimiter(4, time.Minute)
+	defer window.Stop()
+	window.now = clock
+	bucket := NewTokenBucketLimiter(4.0/60, 4)
+	defer bucket.Stop()
+	bucket.now = clock
+
+	ip := "192.168.1.1"
+	count := func(l ConnLimiter, attempts int) int {
+		allowed := 0
+		for i := 0; i < attempts; i++ {
+			if l.Allow(ip) {
+				allowed++
+			}
+		}
+		return allowed
+	}
+
+	// Both allow the same initial burst
+	if w, b := count(window, 10), count(bucket, 10); w != 4 || b != 4 {
+		t.Fatalf("Initial burst: window %d, bucket %d, want 4 each", w, b)
+	}
+
+	// Halfway through the minute the bucket has refilled two tokens while
+	// the window is still full
+	now = base.Add(30 * time.Second)
+	if w, b := count(window, 10), count(bucket, 10); w != 0 || b != 2 {
+		t.Errorf("After 30s: window %d, bucket %d, want 0 and 2", w, b)
+	}
+
+	// Once the window slides past the burst it frees all four slots at
+	// once; the bucket only has what refilled since
+	now = base.Add(time.Minute + time.Second)
+	if w, b := count(window, 10), count(bucket, 10); w != 4 || b != 2 {
+		t.Errorf("After 61s: window %d, bucket %d, want 4 and 2", w, b)
+	}
+}
+
+func TestTokenBucketLimiter_CleanupForgetsRefilled(t *testing.T) {
+	now := time.Now()
+	tl := NewTokenBucketLimiter(1, 2)
+	defer tl.Stop()
+	tl.now = func() time.Time { return now }
+
+	tl.Allow("10.0.0.1")
+	tl.cleanup()
+	if _, ok := tl.buckets["10.0.0.1"]; !ok {
+		t.Fatal("Bucket with tokens taken should be kept")
+	}
+
+	now = now.Add(2 * time.Second)
+	tl.cleanup()
+	if _, ok := tl.buckets["10.0.0.1"]; ok {
+		t.Error("Refilled bucket should be forgotten")
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// envBool reads a boolean environment variable, falling back to def when
+// unset or unparsable
+func envBool(key string, def bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		slog.Warn("Invalid boolean environment variable",
+			slog.String("key", key),
+			slog.String("value", v))
+		return def
+	}
+	return b
+}
+
+// envInt reads an integer environment variable, falling back to def when
+// unset or unparsable
+func envInt(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		slog.Warn("Invalid integer environment variable",
+			slog.String("key", key),
+			slog.String("value", v))
+		return def
+	}
+	return n
+}
+
+// envList reads a comma-separated list, trimming entries and skipping
+// empty ones
+func envList(key string) []string {
+	var list []string
+	for _, v := range strings.Split(os.Getenv(key), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// envCIDRs reads a comma-separated list of CIDR ranges, skipping (and
+// warning about) entries that don't parse
+func envCIDRs(key string) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, v := range strings.Split(os.Getenv(key), ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		p, err := netip.ParsePrefix(v)
+		if err != nil {
+			slog.Warn("Invalid CIDR in environment variable",
+				slog.String("key", key),
+				slog.String("value", v))
+			continue
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes
+}
+
+// envSeconds reads a duration given in whole seconds, falling back to def
+// when unset or unparsable
+func envSeconds(key string, def time.Duration) time.Duration {
+	return envDuration(key, def, time.Second)
+}
+
+// envMillis reads a duration given in whole milliseconds
+func envMillis(key string, def time.Duration) time.Duration {
+	return envDuration(key, def, time.Millisecond)
+}
+
+func envDuration(key string, def, unit time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		slog.Warn("Invalid duration environment variable",
+			slog.String("key", key),
+			slog.String("value", v))
+		return def
+	}
+	return time.Duration(n) * unit
+}
+
+// tlsVersions are the TLS_MIN_VERSION values accepted; older versions are
+// deliberately not offered
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// envTLSVersion reads a minimum TLS version such as "1.3", falling back to
+// def when unset or not one of tlsVersions
+func envTLSVersion(key string, def uint16) uint16 {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	version, ok := tlsVersions[v]
+	if !ok {
+		slog.Warn("Invalid TLS version environment variable, keeping default",
+			slog.String("key", key),
+			slog.String("value", v),
+			slog.String("default", tls.VersionName(def)))
+		return def
+	}
+	return version
+}
+
+// configureFromEnv applies environment overrides to the hub's defaults
+func (h *Hub) configureFromEnv() {
+	h.handshakeTimeout = envSeconds("HANDSHAKE_TIMEOUT", h.handshakeTimeout)
+	h.roomStateInterval = envSeconds("ROOM_STATE_INTERVAL", h.roomStateInterval)
+	h.peerJoinedDelay = envMillis("PEER_JOINED_DELAY_MS", h.peerJoinedDelay)
+	h.peerJoinedJitter = envMillis("PEER_JOINED_JITTER_MS", h.peerJoinedJitter)
+	h.strictMessages = envBool("STRICT_MESSAGES", h.strictMessages)
+	h.validateSDP = envBool("VALIDATE_SDP", h.validateSDP)
+	h.strictFrom = envBool("STRICT_FROM", h.strictFrom)
+	h.maxRoomsPerClient = envInt("MAX_ROOMS_PER_CLIENT", h.maxRoomsPerClient)
+	h.roomMessageRate = float64(envInt("ROOM_MESSAGE_RATE", int(h.roomMessageRate)))
+	h.roomMessageBurst = envInt("ROOM_MESSAGE_BURST", h.roomMessageBurst)
+	h.iceCandidateWindow = envSeconds("ICE_CANDIDATE_WINDOW", h.iceCandidateWindow)
+	h.maxRoomRelayBytes = int64(envInt("MAX_ROOM_RELAY_BYTES", int(h.maxRoomRelayBytes)))
+	h.maxRoomClients = envInt("MAX_ROOM_CLIENTS", h.maxRoomClients)
+	switch policy := os.Getenv("ROOM_FULL_POLICY"); policy {
+	case "":
+	case RoomFullReject, RoomFullObserver, RoomFullBump:
+		h.roomFullPolicy = policy
+	default:
+		slog.Warn("Invalid ROOM_FULL_POLICY, keeping default",
+			slog.String("value", policy),
+			slog.String("default", h.roomFullPolicy))
+	}
+	switch strategy := os.Getenv("SEND_OVERFLOW_STRATEGY"); strategy {
+	case "":
+	case OverflowDropNewest, OverflowDropOldest, OverflowDisconnect:
+		h.sendOverflow = strategy
+	default:
+		slog.Warn("Invalid SEND_OVERFLOW_STRATEGY, keeping default",
+			slog.String("value", strategy),
+			slog.String("default", h.sendOverflow))
+	}
+	h.minProtocolVersion = envInt("MIN_PROTOCOL_VERSION", h.minProtocolVersion)
+	h.upcomingMinVersion = envInt("UPCOMING_MIN_PROTOCOL_VERSION", h.upcomingMinVersion)
+	h.deprecationEvery = envSeconds("DEPRECATION_WARNING_INTERVAL", h.deprecationEvery)
+	if v := os.Getenv("PROTOCOL_DEPRECATION_DEADLINE"); v != "" {
+		if deadline, err := time.Parse(time.RFC3339, v); err == nil {
+			h.deprecationDeadline = deadline
+		} else {
+			slog.Warn("Invalid PROTOCOL_DEPRECATION_DEADLINE, expected RFC 3339",
+				slog.String("value", v))
+		}
+	}
+	h.compressThreshold = envInt("COMPRESS_THRESHOLD", h.compressThreshold)
+	h.stuckRoomTimeout = envSeconds("STUCK_ROOM_TIMEOUT", h.stuckRoomTimeout)
+	h.expireStuckRooms = envBool("EXPIRE_STUCK_ROOMS", h.expireStuckRooms)
+	h.forwardLog = newLogSampler(envInt("LOG_SAMPLE_RATE", int(h.forwardLog.n)))
+	if reason := os.Getenv("SHUTDOWN_REASON"); reason != "" {
+		h.shutdownReason = reason
+	}
+	h.shutdownDowntime = envSeconds("SHUTDOWN_ESTIMATED_DOWNTIME", h.shutdownDowntime)
+	h.maxRoomLifetime = envSeconds("MAX_ROOM_LIFETIME", h.maxRoomLifetime)
+	h.maxRoomTTL = envSeconds("MAX_ROOM_TTL", h.maxRoomTTL)
+	h.maxHandshakes = envInt("MAX_PENDING_HANDSHAKES", h.maxHandshakes)
+	h.maxInvalidMessages = envInt("MAX_INVALID_MESSAGES", h.maxInvalidMessages)
+	h.invalidWindow = envSeconds("INVALID_MESSAGE_WINDOW", h.invalidWindow)
+	h.transcriptLimit = envInt("TRANSCRIPT_LIMIT", h.transcriptLimit)
+	h.transcriptPayloads = envBool("TRANSCRIPT_PAYLOADS", h.transcriptPayloads)
+	if types := envList("PRIORITY_MESSAGE_TYPES"); len(types) > 0 {
+		priority := make([]MessageType, 0, len(types))
+		for _, t := range types {
+			if !slices.Contains(knownMessageTypes, MessageType(t)) {
+				slog.Warn("Unknown type in PRIORITY_MESSAGE_TYPES",
+					slog.String("type", t))
+				continue
+			}
+			priority = append(priority, MessageType(t))
+		}
+		h.priorityTypes = typeSet(priority)
+	}
+	if denied := envList("ROOM_DENYLIST"); len(denied) > 0 {
+		h.roomDenylist = make(map[string]bool, len(denied))
+		for _, id := range denied {
+			h.roomDenylist[id] = true
+		}
+	}
+	h.minPingInterval = envSeconds("MIN_PING_INTERVAL", h.minPingInterval)
+	h.pongLagThreshold = envSeconds("PONG_LAG_WARNING", h.pongLagThreshold)
+	h.writeCoalesce = envMillis("WRITE_COALESCE_MS", h.writeCoalesce)
+	h.presenceBacklog = envInt("PRESENCE_COALESCE_BACKLOG", h.presenceBacklog)
+	h.iceFilter = candidateFilter{
+		allow: envCIDRs("ICE_ALLOWED_CIDRS"),
+		deny:  envCIDRs("ICE_DENIED_CIDRS"),
+	}
+	limit := envInt("LIFECYCLE_LOG_LIMIT", h.registerLog.limit)
+	h.registerLog = newBurstLog(h.registerLog.summary, limit, h.registerLog.window)
+	h.unregisterLog = newBurstLog(h.unregisterLog.summary, limit, h.unregisterLog.window)
+}
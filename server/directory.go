@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxPublicRooms caps how many rooms one directory listing returns
+const maxPublicRooms = 50
+
+// PublicRoom is a directory entry for a public room
+type PublicRoom struct {
+	ID        string    `json:"id"`
+	Clients   int       `json:"clients"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// publicRoomsHandler lists public rooms across all shards, newest first.
+// ?q= filters by room ID substring and ?limit= lowers the listing size.
+func publicRoomsHandler(hubs ...*Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		setCORSHeaders(w, r)
+		setSecurityHeaders(w)
+
+		query := r.URL.Query().Get("q")
+		limit := maxPublicRooms
+		if n, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && n > 0 {
+			limit = min(n, maxPublicRooms)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(listPublicRooms(query, limit, hubs...))
+	}
+}
+
+// listPublicRooms returns up to limit public rooms whose ID contains query
+func listPublicRooms(query string, limit int, hubs ...*Hub) []PublicRoom {
+	rooms := []PublicRoom{}
+	for _, hub := range hubs {
+		hub.mu.RLock()
+		for _, room := range hub.rooms {
+			if !room.Public || !strings.Contains(room.ID, query) {
+				continue
+			}
+			room.mu.RLock()
+			rooms = append(rooms, PublicRoom{
+				ID:        room.ID,
+				Clients:   len(room.Clients),
+				CreatedAt: room.CreatedAt,
+			})
+			room.mu.RUnlock()
+		}
+		hub.mu.RUnlock()
+	}
+
+	slices.SortFunc(rooms, func(a, b PublicRoom) int {
+		return b.CreatedAt.Compare(a.CreatedAt)
+	})
+	if len(rooms) > limit {
+		rooms = rooms[:limit]
+	}
+	return rooms
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPublicRooms_ListsOnlyPublic(t *testing.T) {
+	hub := NewHub()
+	for i, id := range []string{"lobby-1", "secret-1", "lobby-2"} {
+		client := &Client{ID: id + "-owner", Hub: hub, Send: make(chan []byte, 256)}
+		hub.clients[client.ID] = client
+		hub.JoinRoomWith(client, id, JoinOptions{Public: i != 1})
+	}
+	// Joining an existing room can't change its visibility
+	guest := &Client{ID: "guest", Hub: hub, Send: make(chan []byte, 256)}
+	hub.JoinRoomWith(guest, "secret-1", JoinOptions{Public: true})
+
+	req := httptest.NewRequest("GET", "/rooms/public", nil)
+	rec := httptest.NewRecorder()
+	publicRoomsHandler(hub).ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", rec.Code)
+	}
+	var rooms []PublicRoom
+	if err := json.Unmarshal(rec.Body.Bytes(), &rooms); err != nil {
+		t.Fatalf("Failed to parse JSON: %v", err)
+	}
+	if len(rooms) != 2 {
+		t.Fatalf("Expected 2 public rooms, got %+v", rooms)
+	}
+	for _, room := range rooms {
+		if room.ID == "secret-1" {
+			t.Error("Private room was listed")
+		}
+		if room.Clients != 1 {
+			t.Errorf("%s: clients = %d, want 1", room.ID, room.Clients)
+		}
+	}
+
+	if got := listPublicRooms("lobby-2", maxPublicRooms, hub); len(got) != 1 || got[0].ID != "lobby-2" {
+		t.Errorf("Search for lobby-2 returned %+v", got)
+	}
+	if got := listPublicRooms("", 1, hub); len(got) != 1 {
+		t.Errorf("Listing limited to 1 returned %d rooms", len(got))
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Lifecycle event types
+const (
+	EventConnect    = "connect"
+	EventJoin       = "join"
+	EventLeave      = "leave"
+	EventDisconnect = "disconnect"
+)
+
+// eventBufferSize is how many events a subscriber may fall behind by
+// before it starts missing them
+const eventBufferSize = 64
+
+// LifecycleEvent is a client connection or room membership change
+type LifecycleEvent struct {
+	Type     string    `json:"type"`
+	ClientID string    `json:"clientId"`
+	RoomID   string    `json:"roomId,omitempty"`
+	At       time.Time `json:"at"`
+}
+
+// eventBus fans lifecycle events out to subscribers. Publishing never
+// blocks the hub: events for a subscriber whose buffer is full are dropped.
+type eventBus struct {
+	mu   sync.Mutex
+	subs map[chan LifecycleEvent]struct{}
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{subs: make(map[chan LifecycleEvent]struct{})}
+}
+
+// subscribe returns a channel receiving every event published from now on
+func (b *eventBus) subscribe() chan LifecycleEvent {
+	ch := make(chan LifecycleEvent, eventBufferSize)
+	b.mu.Lock()
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+	return ch
+}
+
+// unsubscribe stops delivery to ch and closes it
+func (b *eventBus) unsubscribe(ch chan LifecycleEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subs[ch]; ok {
+		delete(b.subs, ch)
+		close(ch)
+	}
+}
+
+// publish sends an event to every subscriber that has room for it
+func (b *eventBus) publish(eventType, clientID, roomID string) {
+	ev := LifecycleEvent{
+		Type:     eventType,
+		ClientID: clientID,
+		RoomID:   roomID,
+		At:       time.Now().UTC(),
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import "errors"
+
+// Topologies a room's creator may ask for in handshake-init. Rooms are a
+// full mesh by default: any member may signal any other.
+const (
+	// TopologyStar lets peripherals signal only the hub peer, the member
+	// that created the room, while the hub may signal every peripheral
+	TopologyStar = "star"
+)
+
+// errUnknownTopology is returned by JoinRoomWith for a topology other than
+// the default mesh or star
+var errUnknownTopology = errors.New("unknown topology")
+
+// forwardPolicy reports whether a message from one member may be forwarded
+// to another, whether sent to that member or broadcast to the room
+type forwardPolicy func(from, to string) bool
+
+// starPolicy only allows messages to or from the hub peer
+func starPolicy(hub string) forwardPolicy {
+	return func(from, to string) bool {
+		return from == hub || to == hub
+	}
+}
+
+// newForwardPolicy returns the policy for a topology, nil for the default
+// mesh, with hub the ID of the client creating the room
+func newForwardPolicy(topology, hub string) (forwardPolicy, error) {
+	switch topology {
+	case "":
+		return nil, nil
+	case TopologyStar:
+		return starPolicy(hub), nil
+	}
+	return nil, errUnknownTopology
+}
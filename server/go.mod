@@ -5,6 +5,7 @@ go 1.21
 require (
 	github.com/google/uuid v1.6.0
 	github.com/gorilla/websocket v1.5.1
+	golang.org/x/crypto v0.14.0
 )
 
 require golang.org/x/net v0.17.0 // indirect
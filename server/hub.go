@@ -1,10 +1,17 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
+	"io"
 	"log/slog"
+	"math/rand"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
@@ -12,11 +19,59 @@ import (
 )
 
 const (
-	writeWait        = 10 * time.Second
-	pongWait         = 60 * time.Second
-	pingPeriod       = (pongWait * 9) / 10
-	maxMessageSize   = 64 * 1024 // 64KB for signaling messages
-	roomExpiryDuration = 10 * time.Minute
+	writeWait          = 10 * time.Second
+	pongWait           = 60 * time.Second
+	pingPeriod         = (pongWait * 9) / 10
+	maxMessageSize     = 64 * 1024        // 64KB for signaling messages
+	roomExpiryDuration = 10 * time.Minute // Since the room's last activity
+	maxICECandidates   = 50               // Per room, per negotiation
+	maxReasonLength    = 64
+	joinKeyTTL         = time.Minute // How long a handshake idempotency key is remembered
+	maxJoinKeys        = 16          // Per client
+	maxRoomTombstones  = 256         // Recently expired room IDs remembered
+	sendRetries        = 3           // Attempts to requeue an offer or answer that didn't fit
+	sendRetryBackoff   = 5 * time.Millisecond
+	// How long an expired room's ID is refused before it can name a new room
+	roomTombstoneTTL = 5 * time.Minute
+	// Idle rooms are reaped this often, so a room can outlast its TTL by up
+	// to this long and no room may ask for a shorter TTL
+	roomCleanupInterval = time.Minute
+	// A client whose send buffer is this full (in quarters) is hinted to
+	// slow down, at most once per backpressureInterval
+	backpressureHighWater = 3
+	backpressureInterval  = 5 * time.Second
+	backpressureBaseDelay = 50 * time.Millisecond // Doubled per recent drop, up to 16x
+	// Presence changes withheld from a lagging client are gathered this
+	// long before the room-state replacing them is sent
+	presenceCoalesceDelay = 250 * time.Millisecond
+
+	defaultHandshakeTimeout  = 30 * time.Second
+	defaultMaxRoomsPerClient = 1
+	defaultMaxRoomClients    = 2 // One sender, one receiver
+	defaultRoomMessageBurst  = 50
+	defaultForwardLogSample  = 100
+	defaultCompressThreshold = 1024 // Bytes; smaller frames aren't worth deflating
+	defaultLifecycleLogLimit = 20   // Register/unregister lines per second
+	defaultShutdownReason    = "restart"
+	defaultMaxRoomLifetime   = time.Hour // Cap on how far extend-room can push expiry
+	defaultMaxRoomTTL        = time.Hour // Cap on the idle TTL handshake-init can ask for
+	defaultMinPingInterval   = 5 * time.Second
+	defaultInvalidWindow     = time.Minute // Span a run of invalid messages is counted over
+	defaultDeprecationEvery  = 10 * time.Minute
+	// Age at which an unanswered ping is flagged. With the default ping
+	// period the pong wait closes the connection about 6s after a ping.
+	defaultPongLagThreshold = 3 * time.Second
+)
+
+// Close reasons sent to clients in the WebSocket close frame
+const (
+	CloseReasonHandshakeTimeout = "HANDSHAKE_TIMEOUT"
+	CloseReasonSendOverflow     = "SEND_QUEUE_OVERFLOW"
+	CloseReasonClientIDInUse    = "CLIENT_ID_IN_USE"
+	CloseReasonMessageTooBig    = "MESSAGE_TOO_BIG"
+	CloseReasonInvalidMessages  = "TOO_MANY_INVALID_MESSAGES"
+	CloseReasonSessionReplaced  = "SESSION_REPLACED"
+	CloseReasonRoomExpired      = "ROOM_EXPIRED"
 )
 
 // MessageType defines the type of signaling message
@@ -33,9 +88,190 @@ const (
 	MsgTypePeerJoined      MessageType = "peer-joined"
 	MsgTypePeerLeft        MessageType = "peer-left"
 	MsgTypeRoomExpired     MessageType = "room-expired"
+	MsgTypeResetRoom       MessageType = "reset-room"
+	MsgTypeRoomState       MessageType = "room-state"
+	MsgTypeDisconnect      MessageType = "disconnect"
+	MsgTypeLANHint         MessageType = "lan-hint"
+	MsgTypeLeaveRoom       MessageType = "leave-room"
+	MsgTypeFeatures        MessageType = "features"
+	MsgTypeJoined          MessageType = "joined"
+	MsgTypeReady           MessageType = "ready"
+	MsgTypeStuck           MessageType = "stuck"
+	MsgTypeSessionStats    MessageType = "session-stats"
+	MsgTypeRelay           MessageType = "relay" // Data relayed when a direct link fails
+	MsgTypeKeepalive       MessageType = "keepalive"
+	MsgTypeCancelOffer     MessageType = "cancel-offer"
+	MsgTypeServerShutdown  MessageType = "server-shutdown"
+	MsgTypeExtendRoom      MessageType = "extend-room"
+	MsgTypeBackpressure    MessageType = "backpressure"
+	MsgTypeJoinChallenge   MessageType = "join-challenge"
+	MsgTypeServerTime      MessageType = "server-time"
+	MsgTypeDeprecation     MessageType = "deprecation-warning"
+	MsgTypeRoomFull        MessageType = "room-full"
+	MsgTypeRoomCreated     MessageType = "room-created"
+)
+
+// knownMessageTypes lists every MessageType, bounding metric label values
+var knownMessageTypes = []MessageType{
+	MsgTypeOffer, MsgTypeAnswer, MsgTypeICECandidate,
+	MsgTypeHandshakeInit, MsgTypeHandshakeVerify,
+	MsgTypeConnected, MsgTypeError,
+	MsgTypePeerJoined, MsgTypePeerLeft, MsgTypeRoomExpired,
+	MsgTypeResetRoom, MsgTypeRoomState, MsgTypeDisconnect,
+	MsgTypeLANHint, MsgTypeLeaveRoom, MsgTypeFeatures, MsgTypeJoined,
+	MsgTypeReady, MsgTypeStuck, MsgTypeSessionStats, MsgTypeRelay,
+	MsgTypeKeepalive, MsgTypeCancelOffer, MsgTypeServerShutdown,
+	MsgTypeExtendRoom, MsgTypeBackpressure, MsgTypeJoinChallenge,
+	MsgTypeServerTime, MsgTypeDeprecation, MsgTypeRoomFull,
+	MsgTypeRoomCreated,
+}
+
+// serverFeatures are the optional protocol features this server supports.
+// Clients advertise theirs in handshake-init and get back the overlap.
+// With "verify-join", handshake-init only reserves the join until the
+// client echoes a challenge back in handshake-verify.
+var serverFeatures = []string{"batching", "compression", "relay", "verify-join"}
+
+// Error codes for errors sent to clients, used as the metrics label
+const (
+	ErrCodeInvalidMessage = "invalid_message"
+	ErrCodeRoomRequired   = "room_required"
+	ErrCodeUnknownType    = "unknown_type"
+	ErrCodeNotInRoom      = "not_in_room"
+	ErrCodeRoomLimit      = "room_limit"
+	ErrCodeICELimit       = "ice_limit"
+	ErrCodeRoomRateLimit  = "room_rate_limit"
+	ErrCodeRoleTaken      = "role_taken"
+	ErrCodeRoomNotReady   = "room_not_ready"
+	ErrCodeRoomExpired    = "room_expired"
+	ErrCodeRoomFull       = "room_full"
+	ErrCodeBumped         = "bumped"
+	ErrCodeObserver       = "observer"
+	ErrCodeRelayDisabled  = "relay_not_negotiated"
+	ErrCodeRelayBudget    = "relay_budget_exceeded"
+	ErrCodeClientIDInUse  = "client_id_in_use"
+	ErrCodeExtensionLimit = "room_extension_limit"
+	ErrCodeInvalidSDP     = "invalid_sdp"
+	ErrCodeJoinChallenge  = "join_challenge_failed"
+	ErrCodeRoomDenied     = "room_denied"
+	ErrCodeServerBusy     = "server_busy"
+	ErrCodeRoomPassword   = "invalid_room_password"
+	ErrCodeForwardDenied  = "forward_denied"
+)
+
+// errRoomIDRequired is returned by JoinRoom for an empty room ID, which
+// would otherwise match every client not in a room
+var errRoomIDRequired = errors.New("room ID required")
+
+// errInvalidRoomID is returned by JoinRoom for a room ID validRoomID rejects
+var errInvalidRoomID = errors.New("invalid room ID")
+
+// checkRoomID reports why roomID can't name a room, if it can't
+func checkRoomID(roomID string) error {
+	if roomID == "" {
+		return errRoomIDRequired
+	}
+	if !validRoomID(roomID) {
+		return errInvalidRoomID
+	}
+	return nil
+}
+
+// validRoomID reports whether id is usable as a room ID. Room IDs are echoed
+// in every message relayed in the room, so they follow the same rules as
+// client-chosen IDs (see validClientID).
+func validRoomID(id string) bool {
+	return validClientID(id)
+}
+
+// errRoomLimit is returned by JoinRoom when a client is in as many rooms
+// as it may be
+var errRoomLimit = errors.New("room limit reached")
+
+// errRoleTaken is returned by JoinRoomWith when another member already holds
+// the requested role
+var errRoleTaken = errors.New("role already taken")
+
+// errUnknownRole is returned by JoinRoomWith for a role other than sender or
+// receiver
+var errUnknownRole = errors.New("unknown role")
+
+// errRoomTTLTooShort is returned by JoinRoomWith for a room TTL under
+// roomCleanupInterval, which expiry could not honour
+var errRoomTTLTooShort = errors.New("room TTL too short")
+
+// errRoomFull is returned by JoinRoomWith when the room is at capacity and
+// the full-room policy is reject
+var errRoomFull = errors.New("room full")
+
+// errRoomDenied is returned by JoinRoomWith for a room ID on the denylist
+var errRoomDenied = errors.New("room ID not allowed")
+
+// errRoomPassword is returned by JoinRoomWith when a password-protected
+// room is joined without its password
+var errRoomPassword = errors.New("invalid room password")
+
+// errServerBusy is returned by JoinRoomWith for a new room while too many
+// rooms are mid-handshake
+var errServerBusy = errors.New("too many handshakes in progress")
+
+// errMessageTooBig is returned by readMessage when a message inflates past
+// maxMessageSize
+var errMessageTooBig = errors.New("message too big")
+
+// What JoinRoomWith does when a room is at capacity
+const (
+	RoomFullReject   = "reject"   // Turn the newcomer away
+	RoomFullObserver = "observer" // Let the newcomer in to watch but not send
+	RoomFullBump     = "bump"     // Remove the longest-idle member to make space
+)
+
+// What enqueue does when a client's send buffer is full
+const (
+	OverflowDropNewest = "drop_newest" // Drop the message being sent
+	OverflowDropOldest = "drop_oldest" // Evict the oldest queued message to make room
+	OverflowDisconnect = "disconnect"  // Close the connection of a client that can't keep up
+)
+
+// roomExpiredError is returned by JoinRoomWith for a room that was expired
+// recently, so the client is told to start over rather than silently
+// getting a fresh, empty room under the old ID
+type roomExpiredError struct {
+	reason string // Why the room was deleted, as given to logSummary
+}
+
+func (e *roomExpiredError) Error() string {
+	if e.reason == "expired" {
+		return "room expired"
+	}
+	return "room expired (" + e.reason + ")"
+}
+
+// Roles a client may claim in handshake-init. A room whose members use
+// roles holds at most one of each and relays nothing until both are filled.
+const (
+	RoleSender   = "sender"
+	RoleReceiver = "receiver"
 )
 
-// SignalingMessage is the structure for all signaling messages
+// knownErrorCodes lists every error code, bounding metric label values
+var knownErrorCodes = []string{
+	ErrCodeInvalidMessage, ErrCodeRoomRequired, ErrCodeUnknownType,
+	ErrCodeNotInRoom, ErrCodeRoomLimit, ErrCodeICELimit, ErrCodeRoomRateLimit,
+	ErrCodeRoleTaken, ErrCodeRoomNotReady, ErrCodeRoomExpired,
+	ErrCodeRoomFull, ErrCodeBumped, ErrCodeObserver,
+	ErrCodeRelayDisabled, ErrCodeRelayBudget, ErrCodeClientIDInUse,
+	ErrCodeExtensionLimit, ErrCodeInvalidSDP, ErrCodeJoinChallenge,
+	ErrCodeRoomDenied, ErrCodeServerBusy, ErrCodeRoomPassword,
+	ErrCodeForwardDenied,
+}
+
+// SignalingMessage is the structure for all signaling messages.
+//
+// From is set by ReadPump on everything a client sends, and only those
+// messages are relayed through the hub's broadcast or priority channel.
+// Messages the server originates (expiry, room state, hints) leave From
+// empty and are enqueued to their recipients directly.
 type SignalingMessage struct {
 	Type     MessageType     `json:"type"`
 	From     string          `json:"from,omitempty"`
@@ -43,16 +279,130 @@ type SignalingMessage struct {
 	RoomID   string          `json:"roomId,omitempty"`
 	Payload  json.RawMessage `json:"payload,omitempty"`
 	ClientID string          `json:"clientId,omitempty"`
+	Features []string        `json:"features,omitempty"`
+	// ServerTime is when the server relayed an ICE candidate, in Unix
+	// milliseconds, set only when an ICE candidate window is configured
+	ServerTime int64 `json:"serverTime,omitempty"`
 }
 
-// Client represents a connected WebSocket client
+// Client represents a connected WebSocket client.
+//
+// All data frames reach Conn through WritePump: other goroutines hand
+// messages to Send via enqueue and must never write to Conn themselves.
+// The only direct writes are close frames sent with WriteControl, which
+// gorilla/websocket allows concurrently with WritePump.
 type Client struct {
-	ID     string
-	RoomID string
-	Conn   *websocket.Conn
-	Hub    *Hub
-	Send   chan []byte
-	mu     sync.Mutex
+	ID          string
+	RoomID      string          // Most recently joined room, used when a message names none
+	Rooms       map[string]bool // Every room the client is in
+	Conn        WSConn
+	Hub         *Hub
+	Send        chan []byte
+	IP          string // Public IP the client connected from
+	Version     string // App version the client advertised, "" if none
+	Subprotocol string // Negotiated WebSocket subprotocol, "" if none
+	ConnectedAt time.Time
+	Joined      bool        // Set once the client has joined any room
+	closed      atomic.Bool // Set when ReadPump exits, before unregister is processed
+	leaveReason string      // Reason given with an explicit disconnect, if any
+	lastError   atomic.Pointer[ClientError]
+	Features    []string // Features both the client and server support
+	joinKeys    map[string]joinKey
+	pendingJoin *pendingJoin // Join awaiting handshake-verify; ReadPump only
+	// Consecutive undecodable messages and when the run started; ReadPump only
+	invalidRun   int
+	invalidSince time.Time
+	mu           sync.Mutex
+	sendMu       sync.Mutex // Serializes sends with closing Send
+	sendClosed   bool
+	// Backpressure hint state, guarded by sendMu
+	lastBackpressure time.Time
+	dropsSinceHint   int
+	stalePresence    map[string]bool // Rooms with presence notices withheld, guarded by sendMu
+	overflow         string          // One of the Overflow strategies, "" meaning drop_newest
+	overflowed       atomic.Bool     // Set once the disconnect strategy has fired
+	stats            sessionStats
+	compressMin      int           // Frames at least this large are compressed, 0 disables
+	pingEvery        time.Duration // How often WritePump pings, 0 meaning pingPeriod
+	minPing          time.Duration // Shortest pingEvery the server allows
+	coalesce         time.Duration // How long WritePump waits to batch messages, 0 disables
+	pongLagAfter     time.Duration // Unanswered-ping age flagged as lag, 0 disables
+	presenceMax      int           // Queued messages past which presence is coalesced, 0 disables
+	reclaim          bool          // Connected with a stable ID, taking over any session holding it
+	resumeToken      string        // Issued to reclaim clients; proves a reconnect owns the session
+	resumeWith       string        // Resume token presented on connect
+	lastPong         atomic.Int64  // UnixNano of the last pong read
+	pongLagging      atomic.Bool   // Set while a ping is unanswered past pongLagAfter
+	batching         atomic.Bool   // Set once the client negotiated "batching"
+	Compressed       bool          // Set when the connection negotiated permessage-deflate
+	router           *ShardedHub   // Shards the client can move between, nil if unsharded
+}
+
+// sessionStats counts a client's traffic, updated by ReadPump and WritePump
+type sessionStats struct {
+	messagesIn  atomic.Int64
+	bytesIn     atomic.Int64
+	messagesOut atomic.Int64
+	bytesOut    atomic.Int64
+	dropped     atomic.Int64 // Messages for the client lost to a full send buffer
+}
+
+// SessionStatsPayload is the payload of a session-stats reply. Counts are
+// from the client's point of view: sent means sent to the server.
+type SessionStatsPayload struct {
+	MessagesSent     int64   `json:"messagesSent"`
+	BytesSent        int64   `json:"bytesSent"`
+	MessagesReceived int64   `json:"messagesReceived"`
+	BytesReceived    int64   `json:"bytesReceived"`
+	MessagesDropped  int64   `json:"messagesDropped"`
+	ConnectedSeconds float64 `json:"connectedSeconds"`
+}
+
+// HandshakePayload is the optional payload of handshake-init
+type HandshakePayload struct {
+	// IdempotencyKey makes retried handshakes resolve to the first room
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
+	// Role is "sender" or "receiver" when the room enforces one of each
+	Role string `json:"role,omitempty"`
+	// Public lists a room this handshake creates in the public directory
+	Public bool `json:"public,omitempty"`
+	// Transcript records the signaling in a room this handshake creates,
+	// for export by an admin while debugging
+	Transcript bool `json:"transcript,omitempty"`
+	// Password protects a room this handshake creates, and must match to
+	// join one that was created with a password
+	Password string `json:"password,omitempty"`
+	// TTLSeconds is how long a room this handshake creates may sit idle
+	// before it expires, in place of the default; at least a minute
+	TTLSeconds int `json:"ttlSeconds,omitempty"`
+	// Topology restricts which members of a room this handshake creates may
+	// send directed messages to which; "star" makes the creator the hub
+	Topology string `json:"topology,omitempty"`
+}
+
+// pendingJoin is a join reserved by handshake-init under verify-join
+type pendingJoin struct {
+	roomID    string
+	opts      JoinOptions
+	challenge string
+}
+
+// JoinChallengePayload is the payload of a join-challenge, and of the
+// handshake-verify that answers it
+type JoinChallengePayload struct {
+	Challenge string `json:"challenge"`
+}
+
+// joinKey remembers which room a handshake idempotency key resolved to
+type joinKey struct {
+	roomID string
+	at     time.Time
+}
+
+// DisconnectPayload carries the reason for an explicit disconnect. It is
+// sent by the leaving client and forwarded to peers with peer-left.
+type DisconnectPayload struct {
+	Reason string `json:"reason"`
 }
 
 // Room represents a transfer session between peers
@@ -60,7 +410,182 @@ type Room struct {
 	ID        string
 	Clients   map[string]*Client
 	CreatedAt time.Time
-	mu        sync.RWMutex
+	Public    bool // Listed in the public room directory; fixed at creation
+	// MaxClients is how many participants the room may hold (0 is
+	// unlimited), fixed at creation from MAX_ROOM_CLIENTS
+	MaxClients int
+	// LastActivity is when a member last joined or relayed a message,
+	// guarded by mu
+	LastActivity time.Time
+	// ExtendedUntil is the earliest the room may expire, however idle,
+	// pushed out by extend-room; guarded by mu
+	ExtendedUntil time.Time
+	// TTL is how long the room may sit idle, asked for by its creator up to
+	// MAX_ROOM_TTL; 0 means roomExpiryDuration
+	TTL           time.Duration
+	stuckNotified bool // Members already told the room looks stuck, guarded by mu
+	negotiation   negotiationState
+	rate          *tokenBucket         // Combined message rate of all members, nil if unlimited
+	peakClients   int                  // Highest occupancy seen, guarded by mu
+	roles         map[string]string    // Role -> holder's client ID, guarded by mu
+	observers     map[string]bool      // Members admitted over capacity, guarded by mu
+	lastSeen      map[string]time.Time // Each member's last join or relay, guarded by mu
+	forwarded     atomic.Int64         // Message deliveries relayed within the room
+	RelayedBytes  int64                // Payload bytes of relay messages admitted, guarded by mu
+	bytes         atomic.Int64         // Bytes of those deliveries
+	handshaking   atomic.Bool          // Counted in handshakeGauge
+	transcript    *transcript          // Relayed messages, nil unless requested at creation
+	password      *roomPassword        // Required to join, nil for open rooms; fixed at creation
+	forward       forwardPolicy        // Allowed directed messages, nil for a full mesh; fixed at creation
+	mu            sync.RWMutex
+}
+
+// recordForward counts one delivery of a relayed message
+func (r *Room) recordForward(size int) {
+	r.forwarded.Add(1)
+	r.bytes.Add(int64(size))
+}
+
+// roleHolder returns the ID of the client holding role, or "" if it is free
+func (r *Room) roleHolder(role string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.roles[role]
+}
+
+// has reports whether client is a member of the room
+func (r *Room) has(client *Client) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.Clients[client.ID] == client
+}
+
+// participants counts the members that are not observers. Caller must hold r.mu.
+func (r *Room) participants() int {
+	return len(r.Clients) - len(r.observers)
+}
+
+// idlest returns the participant that has been quiet the longest. Caller
+// must hold r.mu.
+func (r *Room) idlest() *Client {
+	var victim *Client
+	for id, client := range r.Clients {
+		if r.observers[id] {
+			continue
+		}
+		if victim == nil || r.lastSeen[id].Before(r.lastSeen[victim.ID]) {
+			victim = client
+		}
+	}
+	return victim
+}
+
+// ready reports whether both roles are filled. Caller must hold r.mu.
+func (r *Room) ready() bool {
+	return r.roles[RoleSender] != "" && r.roles[RoleReceiver] != ""
+}
+
+// logSummary logs the room's lifetime statistics when it is deleted
+func (r *Room) logSummary(reason string) {
+	r.mu.RLock()
+	peak := r.peakClients
+	r.mu.RUnlock()
+
+	slog.Info("Room summary",
+		slog.String("roomId", r.ID),
+		slog.String("reason", reason),
+		slog.Duration("lifetime", time.Since(r.CreatedAt)),
+		slog.Int("peakClients", peak),
+		slog.Int64("messagesForwarded", r.forwarded.Load()),
+		slog.Int64("bytesForwarded", r.bytes.Load()))
+}
+
+// negotiationState tracks signaling progress within a room so it can be
+// cleared when peers retry a failed transfer
+type negotiationState struct {
+	offerFrom string          // client that sent the current offer
+	offerAt   time.Time       // when the current offer was relayed
+	answered  bool            // an answer has been relayed for the offer
+	verified  map[string]bool // clients that have sent handshake-verify
+	ice       int             // ICE candidates relayed since the last offer
+	iceWarned bool            // sender already told about the ICE cap
+}
+
+// track records the effect of a relayed message and reports whether it
+// should be forwarded. Caller must hold r.mu.
+func (r *Room) track(msg *SignalingMessage) bool {
+	switch msg.Type {
+	case MsgTypeOffer:
+		// A new offer starts a fresh negotiation
+		r.negotiation.offerFrom = msg.From
+		r.negotiation.offerAt = time.Now()
+		r.negotiation.answered = false
+		r.negotiation.ice = 0
+		r.negotiation.iceWarned = false
+	case MsgTypeICECandidate:
+		if r.negotiation.ice >= maxICECandidates {
+			return false
+		}
+		r.negotiation.ice++
+	case MsgTypeCancelOffer:
+		// The offerer retracted its offer, so the room waits for a new one
+		if msg.From == r.negotiation.offerFrom {
+			verified := r.negotiation.verified
+			r.negotiation = negotiationState{verified: verified}
+		}
+	case MsgTypeAnswer:
+		r.negotiation.answered = true
+	case MsgTypeHandshakeVerify:
+		if r.negotiation.verified == nil {
+			r.negotiation.verified = make(map[string]bool)
+		}
+		r.negotiation.verified[msg.From] = true
+	}
+	return true
+}
+
+// defaultPriorityTypes are relayed ahead of other messages: they gate the
+// next step of negotiation, whereas ICE candidates trickle and keep
+var defaultPriorityTypes = []MessageType{MsgTypeOffer, MsgTypeAnswer, MsgTypeCancelOffer}
+
+func typeSet(types []MessageType) map[MessageType]bool {
+	set := make(map[MessageType]bool, len(types))
+	for _, t := range types {
+		set[t] = true
+	}
+	return set
+}
+
+// queueFor returns the channel a relayed message of the given type goes on.
+// Messages from one sender stay in order within a channel, but a priority
+// message may overtake ordinary ones sent before it.
+func (h *Hub) queueFor(t MessageType) chan *SignalingMessage {
+	if h.priorityTypes[t] {
+		return h.priority
+	}
+	return h.broadcast
+}
+
+// handshakeGauge counts rooms whose negotiation hasn't completed, that is
+// rooms with no answer relayed for their current offer yet
+type handshakeGauge struct {
+	n atomic.Int64
+}
+
+// set marks whether a room is mid-handshake, counting it at most once
+func (g *handshakeGauge) set(room *Room, pending bool) {
+	if room.handshaking.CompareAndSwap(!pending, pending) {
+		if pending {
+			g.n.Add(1)
+		} else {
+			g.n.Add(-1)
+		}
+	}
+}
+
+// reset clears all negotiation state. Caller must hold r.mu.
+func (r *Room) reset() {
+	r.negotiation = negotiationState{}
 }
 
 // Hub manages all rooms and clients
@@ -70,7 +595,110 @@ type Hub struct {
 	register   chan *Client
 	unregister chan *Client
 	broadcast  chan *SignalingMessage
-	mu         sync.RWMutex
+	// Relayed messages of priorityTypes, handled ahead of any backlog on
+	// broadcast
+	priority chan *SignalingMessage
+	done     chan struct{} // Closed once Run has shut down
+	mu       sync.RWMutex
+
+	// Clients that haven't joined a room within this are disconnected
+	handshakeTimeout time.Duration
+	// How often members receive the authoritative peer list (0 disables)
+	roomStateInterval time.Duration
+	// peer-joined notices wait this long plus up to peerJoinedJitter more,
+	// spreading out the offers a burst of joins triggers (0 sends at once)
+	peerJoinedDelay  time.Duration
+	peerJoinedJitter time.Duration
+	// Reject messages carrying JSON fields SignalingMessage doesn't define
+	strictMessages bool
+	// Reject offers and answers whose SDP lacks the required lines
+	validateSDP bool
+	// Reject messages claiming another client's ID in From, rather than
+	// overwriting it
+	strictFrom bool
+	// Rooms one connection may be in at once. At 1, joining switches rooms;
+	// above 1, joins past the limit are rejected.
+	maxRoomsPerClient int
+	// Combined messages per second all members of a room may relay (0 disables)
+	roomMessageRate  float64
+	roomMessageBurst int
+	// Decides which ICE candidates are relayed by their IP address
+	iceFilter candidateFilter
+	// ICE candidates arriving this long after the room's offer are dropped
+	// as too late to help (0 disables)
+	iceCandidateWindow time.Duration
+	// Payload bytes of relay messages one room may pass through the server
+	// (0 is unlimited)
+	maxRoomRelayBytes int64
+	// Participants a room may hold (0 is unlimited), and what happens to a
+	// newcomer once it is full: one of the RoomFull policies
+	maxRoomClients int
+	roomFullPolicy string
+	// What happens when a client's send buffer is full: one of the
+	// Overflow strategies
+	sendOverflow string
+	// Outgoing frames of at least this many bytes are compressed when the
+	// client negotiated permessage-deflate (0 disables)
+	compressThreshold int
+	// Rooms with two or more members that relay nothing for this long are
+	// sent a stuck hint, and expired as well if expireStuckRooms is set
+	// (0 disables)
+	stuckRoomTimeout time.Duration
+	expireStuckRooms bool
+	// Samples the per-message forward debug line; errors are always logged
+	forwardLog *logSampler
+	// Summarise register and unregister lines during connection storms
+	registerLog   *burstLog
+	unregisterLog *burstLog
+
+	// Connections negotiating an older subprotocol version are closed
+	minProtocolVersion int
+	// Clients below the version minProtocolVersion is about to be raised to
+	// are warned every deprecationEvery, with the cutoff if one is set
+	upcomingMinVersion  int
+	deprecationDeadline time.Time
+	deprecationEvery    time.Duration
+
+	// How long after creation extend-room can keep a room alive (0 disables
+	// extensions)
+	maxRoomLifetime time.Duration
+	// Longest idle TTL a room's creator may ask for in handshake-init
+	maxRoomTTL time.Duration
+	// New rooms are refused while this many are mid-handshake (0 disables).
+	// Shards check the shared count without coordinating, so the cap is
+	// soft by at most one room per shard.
+	maxHandshakes int
+	handshakes    *handshakeGauge // Shared by all shards
+	// Messages kept per room transcript, and whether payloads are kept too
+	transcriptLimit    int
+	transcriptPayloads bool
+	// Message types relayed through the priority channel
+	priorityTypes map[MessageType]bool
+	// Room IDs that can't be created or joined, nil if none
+	roomDenylist map[string]bool
+	// How long WritePump waits for more messages to send in the same frame
+	// to clients that negotiated batching (0 disables)
+	writeCoalesce time.Duration
+	// Clients with this many messages queued get peer-joined and peer-left
+	// notices folded into one room-state update instead (0 disables)
+	presenceBacklog int
+	// Clients sending this many undecodable messages in a row within
+	// invalidWindow are disconnected (0 tolerates any number)
+	maxInvalidMessages int
+	invalidWindow      time.Duration
+	// Floor on a client's ping interval, whatever the client asks for
+	minPingInterval time.Duration
+	// Clients leaving a ping unanswered this long are logged, as an early
+	// warning before the pong wait disconnects them (0 disables)
+	pongLagThreshold time.Duration
+	// Reported to clients in the server-shutdown message
+	shutdownReason   string
+	shutdownDowntime time.Duration
+
+	tombstones *roomTombstones // Recently expired rooms whose IDs this shard owns
+	events     *eventBus       // Lifecycle events, shared by all shards
+
+	router *ShardedHub // Set when this hub is one shard of several
 }
 
 // NewHub creates a new Hub instance
@@ -81,6 +709,31 @@ func NewHub() *Hub {
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
 		broadcast:  make(chan *SignalingMessage, 256),
+		priority:   make(chan *SignalingMessage, 256),
+		done:       make(chan struct{}),
+
+		handshakeTimeout:  defaultHandshakeTimeout,
+		maxRoomsPerClient: defaultMaxRoomsPerClient,
+		maxRoomClients:    defaultMaxRoomClients,
+		roomMessageBurst:  defaultRoomMessageBurst,
+		forwardLog:        newLogSampler(defaultForwardLogSample),
+		registerLog:       newBurstLog("Clients registered", defaultLifecycleLogLimit, time.Second),
+		unregisterLog:     newBurstLog("Clients unregistered", defaultLifecycleLogLimit, time.Second),
+		tombstones:        newRoomTombstones(maxRoomTombstones, roomTombstoneTTL),
+		roomFullPolicy:    RoomFullReject,
+		sendOverflow:      OverflowDropNewest,
+		compressThreshold: defaultCompressThreshold,
+		shutdownReason:    defaultShutdownReason,
+		maxRoomLifetime:   defaultMaxRoomLifetime,
+		maxRoomTTL:        defaultMaxRoomTTL,
+		minPingInterval:   defaultMinPingInterval,
+		invalidWindow:     defaultInvalidWindow,
+		deprecationEvery:  defaultDeprecationEvery,
+		pongLagThreshold:  defaultPongLagThreshold,
+		transcriptLimit:   defaultTranscriptLimit,
+		priorityTypes:     typeSet(defaultPriorityTypes),
+		handshakes:        &handshakeGauge{},
+		events:            newEventBus(),
 	}
 }
 
@@ -88,30 +741,82 @@ func NewHub() *Hub {
 func (h *Hub) Run(ctx context.Context) {
 	// Start room expiry cleanup goroutine
 	go h.cleanupExpiredRooms(ctx)
+	go h.flushLifecycleLogs(ctx)
+
+	if h.roomStateInterval > 0 {
+		go h.syncRoomStates(ctx)
+	}
+	if h.upcomingMinVersion > 0 && h.deprecationEvery > 0 {
+		go h.warnDeprecatedClients(ctx)
+	}
 
 	for {
+		// Drain priority messages first so they never wait behind a backlog
+		select {
+		case message := <-h.priority:
+			h.handleBroadcast(message)
+			continue
+		default:
+		}
+
 		select {
 		case <-ctx.Done():
 			slog.Info("Hub shutting down")
+			data, _ := json.Marshal(SignalingMessage{
+				Type:    MsgTypeServerShutdown,
+				Payload: h.shutdownPayload(),
+			})
 			h.mu.Lock()
 			for _, client := range h.clients {
-				close(client.Send)
+				client.enqueue(data)
+				client.closeSend()
 			}
 			h.mu.Unlock()
+			close(h.done)
 			return
 		case client := <-h.register:
 			h.handleRegister(client)
 		case client := <-h.unregister:
 			h.handleUnregister(client)
+		case message := <-h.priority:
+			h.handleBroadcast(message)
 		case message := <-h.broadcast:
 			h.handleBroadcast(message)
 		}
 	}
 }
 
-// cleanupExpiredRooms removes rooms that have exceeded the expiry duration
+// stopped reports whether the hub has shut down and accepts no more clients
+func (h *Hub) stopped() bool {
+	select {
+	case <-h.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// ShutdownPayload is the payload of a server-shutdown message, letting
+// clients pick a reconnect backoff
+type ShutdownPayload struct {
+	Reason string `json:"reason"`
+	// EstimatedDowntimeSeconds is how long the server expects to be away,
+	// omitted when unknown
+	EstimatedDowntimeSeconds int `json:"estimated_downtime_seconds,omitempty"`
+}
+
+func (h *Hub) shutdownPayload() json.RawMessage {
+	payload, _ := json.Marshal(ShutdownPayload{
+		Reason:                   h.shutdownReason,
+		EstimatedDowntimeSeconds: int(h.shutdownDowntime.Seconds()),
+	})
+	return payload
+}
+
+// cleanupExpiredRooms removes rooms that have gone idle every
+// roomCleanupInterval; busy rooms live as long as their members keep signaling
 func (h *Hub) cleanupExpiredRooms(ctx context.Context) {
-	ticker := time.NewTicker(time.Minute)
+	ticker := time.NewTicker(roomCleanupInterval)
 	defer ticker.Stop()
 
 	for {
@@ -119,263 +824,1727 @@ func (h *Hub) cleanupExpiredRooms(ctx context.Context) {
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			h.mu.Lock()
-			now := time.Now()
-
-			for roomID, room := range h.rooms {
-				if now.Sub(room.CreatedAt) > roomExpiryDuration {
-					room.mu.Lock()
-					// Notify clients that room is expiring
-					for _, client := range room.Clients {
-						msg := SignalingMessage{
-							Type:   MsgTypeRoomExpired,
-							RoomID: roomID,
-						}
-						data, _ := json.Marshal(msg)
-						select {
-						case client.Send <- data:
-						default:
-						}
-						client.RoomID = ""
-					}
-					room.mu.Unlock()
-
-					delete(h.rooms, roomID)
-					slog.Info("Room expired and deleted",
-						slog.String("roomId", roomID),
-						slog.Duration("age", now.Sub(room.CreatedAt)))
-				}
-			}
-			h.mu.Unlock()
+			h.expireRooms(time.Now())
+			h.removeOrphans()
 		}
 	}
 }
 
-func (h *Hub) handleRegister(client *Client) {
+// removeOrphans takes out of their rooms any members the hub no longer has
+// as clients, which only a missed cleanup leaves behind, telling the
+// remaining peers they left. Sends to an orphan are already harmless,
+// since enqueue never writes to a closed Send, but the room would keep
+// relaying to it and never empty. It returns how many were removed.
+func (h *Hub) removeOrphans() int {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
-	h.clients[client.ID] = client
-	slog.Info("Client registered",
-		slog.String("clientId", client.ID))
-
-	// Send connected message with client ID
-	msg := SignalingMessage{
-		Type:     MsgTypeConnected,
-		ClientID: client.ID,
+	type orphan struct {
+		client *Client
+		roomID string
 	}
-	data, _ := json.Marshal(msg)
-	client.Send <- data
-}
-
-func (h *Hub) handleUnregister(client *Client) {
-	h.mu.Lock()
-	defer h.mu.Unlock()
-
-	if _, ok := h.clients[client.ID]; ok {
-		delete(h.clients, client.ID)
-		close(client.Send)
-
-		// Remove from room if in one
-		if client.RoomID != "" {
-			if room, ok := h.rooms[client.RoomID]; ok {
-				room.mu.Lock()
-				delete(room.Clients, client.ID)
-
-				// Notify other peers in room
-				for _, peer := range room.Clients {
-					msg := SignalingMessage{
-						Type:     MsgTypePeerLeft,
-						From:     client.ID,
-						RoomID:   client.RoomID,
-						ClientID: client.ID,
-					}
-					data, _ := json.Marshal(msg)
-					select {
-					case peer.Send <- data:
-					default:
-					}
-				}
-
-				// Clean up empty rooms
-				if len(room.Clients) == 0 {
-					delete(h.rooms, client.RoomID)
-					slog.Info("Room deleted (empty)",
-						slog.String("roomId", client.RoomID))
-				}
-				room.mu.Unlock()
+	var orphans []orphan
+	for roomID, room := range h.rooms {
+		room.mu.RLock()
+		for id, client := range room.Clients {
+			if h.clients[id] != client {
+				orphans = append(orphans, orphan{client, roomID})
 			}
 		}
-		slog.Info("Client unregistered",
-			slog.String("clientId", client.ID))
+		room.mu.RUnlock()
 	}
-}
 
-func (h *Hub) handleBroadcast(message *SignalingMessage) {
-	h.mu.RLock()
-	defer h.mu.RUnlock()
-
-	// Direct message to specific client
-	if message.To != "" {
-		if client, ok := h.clients[message.To]; ok {
-			data, _ := json.Marshal(message)
-			select {
-			case client.Send <- data:
-			default:
-				slog.Warn("Failed to send to client, buffer full",
-					slog.String("clientId", message.To))
-			}
-		}
-		return
+	for _, o := range orphans {
+		slog.Warn("Removing orphaned room member",
+			slog.String("clientId", o.client.ID),
+			slog.String("roomId", o.roomID))
+		h.leaveRoom(o.client, o.roomID, true)
 	}
+	return len(orphans)
+}
 
-	// Broadcast to room
-	if message.RoomID != "" {
-		if room, ok := h.rooms[message.RoomID]; ok {
-			room.mu.RLock()
-			data, _ := json.Marshal(message)
-			for id, client := range room.Clients {
-				if id != message.From { // Don't echo back to sender
-					select {
-					case client.Send <- data:
-					default:
-						slog.Warn("Failed to broadcast to client",
-							slog.String("clientId", id))
-					}
-				}
-			}
-			room.mu.RUnlock()
+// flushLifecycleLogs writes the summaries of connection storms, so one is
+// reported even if no further client arrives or leaves afterwards
+func (h *Hub) flushLifecycleLogs(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			h.registerLog.flush(now)
+			h.unregisterLog.flush(now)
 		}
 	}
 }
 
-// JoinRoom adds a client to a room (creates room if needed)
-func (h *Hub) JoinRoom(client *Client, roomID string) {
+// expireRooms deletes every room that, as of now, has been idle for longer
+// than its TTL and is past any extension. It also flags rooms whose members
+// have gone silent for stuckRoomTimeout.
+// Membership and client room pointers are cleared under the same hub lock that
+// JoinRoom takes, so no client is left pointing at a deleted room.
+func (h *Hub) expireRooms(now time.Time) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
-	// Leave current room if in one
-	if client.RoomID != "" && client.RoomID != roomID {
-		if oldRoom, ok := h.rooms[client.RoomID]; ok {
-			oldRoom.mu.Lock()
-			delete(oldRoom.Clients, client.ID)
-			oldRoom.mu.Unlock()
+	for roomID, room := range h.rooms {
+		room.mu.RLock()
+		expiresAt := room.expiresAt()
+		room.mu.RUnlock()
+		if now.After(expiresAt) {
+			h.expireRoom(room, now, "expired")
+			continue
 		}
-	}
-
-	// Create room if it doesn't exist
-	room, ok := h.rooms[roomID]
-	if !ok {
-		room = &Room{
-			ID:        roomID,
-			Clients:   make(map[string]*Client),
-			CreatedAt: time.Now(),
+		if h.stuckRoomTimeout > 0 && h.checkStuck(room, now) && h.expireStuckRooms {
+			slog.Info("Expiring stuck room",
+				slog.String("roomId", roomID))
+			h.expireRoom(room, now, "stuck")
 		}
-		h.rooms[roomID] = room
-		slog.Info("Room created",
-			slog.String("roomId", roomID))
 	}
+}
 
-	// Add client to room
+// expireRoom tells the members a room has expired and deletes it.
+// Caller must hold h.mu.
+func (h *Hub) expireRoom(room *Room, now time.Time, reason string) {
 	room.mu.Lock()
-
-	// Notify existing peers
-	for _, peer := range room.Clients {
+	// Notify clients that room is expiring
+	for _, client := range room.Clients {
 		msg := SignalingMessage{
-			Type:     MsgTypePeerJoined,
-			From:     client.ID,
-			RoomID:   roomID,
-			ClientID: client.ID,
+			Type:   MsgTypeRoomExpired,
+			RoomID: room.ID,
 		}
 		data, _ := json.Marshal(msg)
-		select {
-		case peer.Send <- data:
-		default:
-		}
+		client.notifyOrClose(data, CloseReasonRoomExpired)
+		client.dropRoom(room.ID)
 	}
-
-	room.Clients[client.ID] = client
-	client.RoomID = roomID
 	room.mu.Unlock()
 
-	slog.Info("Client joined room",
-		slog.String("clientId", client.ID),
-		slog.String("roomId", roomID),
-		slog.Int("totalClients", len(room.Clients)))
+	delete(h.rooms, room.ID)
+	metrics.Rooms.Add(-1)
+	h.handshakes.set(room, false)
+	h.releaseRoom(room.ID)
+	// Rejoins route by the ID now the room is unpinned, so the tombstone
+	// goes to the shard they will reach
+	h.shardFor(room.ID).tombstones.add(room.ID, reason, now)
+	slog.Info("Room expired and deleted",
+		slog.String("roomId", room.ID),
+		slog.Duration("age", now.Sub(room.CreatedAt)))
+	room.logSummary(reason)
 }
 
-// NewClient creates a new client with unique ID
-func NewClient(conn *websocket.Conn, hub *Hub) *Client {
-	return &Client{
-		ID:   uuid.New().String()[:8], // Short ID for easier debugging
-		Conn: conn,
-		Hub:  hub,
-		Send: make(chan []byte, 256),
+// checkStuck reports whether a room with at least two members has relayed
+// nothing for stuckRoomTimeout, sending its members a stuck hint the first
+// time. Caller must hold h.mu.
+func (h *Hub) checkStuck(room *Room, now time.Time) bool {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	if len(room.Clients) < 2 || now.Sub(room.LastActivity) <= h.stuckRoomTimeout {
+		return false
+	}
+	if !room.stuckNotified {
+		room.stuckNotified = true
+		slog.Info("Room looks stuck",
+			slog.String("roomId", room.ID),
+			slog.Duration("idle", now.Sub(room.LastActivity)))
+		data, _ := json.Marshal(SignalingMessage{Type: MsgTypeStuck, RoomID: room.ID})
+		for _, client := range room.Clients {
+			client.enqueue(data)
+		}
 	}
+	return true
 }
 
-// ReadPump handles incoming messages from WebSocket
-func (c *Client) ReadPump() {
-	defer func() {
-		c.Hub.unregister <- c
-		c.Conn.Close()
-	}()
-
-	c.Conn.SetReadLimit(maxMessageSize)
-	c.Conn.SetReadDeadline(time.Now().Add(pongWait))
-	c.Conn.SetPongHandler(func(string) error {
-		c.Conn.SetReadDeadline(time.Now().Add(pongWait))
-		return nil
-	})
-
-	for {
-		_, data, err := c.Conn.ReadMessage()
-		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				slog.Warn("Client read error",
-					slog.String("clientId", c.ID),
-					slog.String("error", err.Error()))
-			}
-			break
-		}
+// expiresAt is when the room expires unless there is more activity or it
+// is extended. Caller must hold r.mu.
+func (r *Room) expiresAt() time.Time {
+	idle := r.LastActivity.Add(r.ttl())
+	if r.ExtendedUntil.After(idle) {
+		return r.ExtendedUntil
+	}
+	return idle
+}
 
-		var msg SignalingMessage
-		if err := json.Unmarshal(data, &msg); err != nil {
-			slog.Warn("Invalid JSON from client",
-				slog.String("clientId", c.ID),
-				slog.String("error", err.Error()))
-			c.sendError("Invalid message format")
-			continue
-		}
+// ttl is how long the room may sit idle before it expires
+func (r *Room) ttl() time.Duration {
+	if r.TTL > 0 {
+		return r.TTL
+	}
+	return roomExpiryDuration
+}
 
-		msg.From = c.ID // Always set the from field to prevent spoofing
+// remainingTTL is how long the room has left before it expires, as of now.
+// Caller must hold r.mu.
+func (r *Room) remainingTTL(now time.Time) time.Duration {
+	return max(r.expiresAt().Sub(now), 0)
+}
 
-		// Handle message based on type
-		switch msg.Type {
-		case MsgTypeHandshakeInit:
-			// Client wants to create/join a room
-			if msg.RoomID == "" {
-				c.sendError("Room ID required for handshake")
-				continue
-			}
-			c.Hub.JoinRoom(c, msg.RoomID)
+// touch records activity in the room. Caller must hold r.mu.
+func (r *Room) touch(now time.Time) {
+	r.LastActivity = now
+	r.stuckNotified = false
+}
 
-		case MsgTypeOffer, MsgTypeAnswer, MsgTypeICECandidate, MsgTypeHandshakeVerify:
-			// Forward to specific peer or broadcast to room
-			if msg.To == "" && msg.RoomID == "" {
-				msg.RoomID = c.RoomID
-			}
-			c.Hub.broadcast <- &msg
+// RoomStatePayload is the payload of a room-state message
+type RoomStatePayload struct {
+	Peers []string `json:"peers"`
+	// RemainingTTLSeconds is how long the room will last without activity
+	RemainingTTLSeconds int `json:"remaining_ttl_seconds"`
+}
 
-		default:
-			c.sendError("Unknown message type")
-		}
+// stateMessage encodes a room-state message listing the room's members.
+// Caller must hold r.mu.
+func (r *Room) stateMessage(now time.Time) []byte {
+	peers := make([]string, 0, len(r.Clients))
+	for id := range r.Clients {
+		peers = append(peers, id)
 	}
+	slices.Sort(peers)
+
+	payload, _ := json.Marshal(RoomStatePayload{
+		Peers:               peers,
+		RemainingTTLSeconds: int(r.remainingTTL(now).Seconds()),
+	})
+	data, _ := json.Marshal(SignalingMessage{
+		Type:    MsgTypeRoomState,
+		RoomID:  r.ID,
+		Payload: payload,
+	})
+	return data
 }
 
-// WritePump handles outgoing messages to WebSocket
-func (c *Client) WritePump() {
-	ticker := time.NewTicker(pingPeriod)
+// syncRoomStates periodically pushes each room's peer list to its members
+// so peers that missed a peer-joined or peer-left can reconcile
+func (h *Hub) syncRoomStates(ctx context.Context) {
+	ticker := time.NewTicker(h.roomStateInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			now := time.Now()
+			h.mu.RLock()
+			for _, room := range h.rooms {
+				room.mu.RLock()
+				data := room.stateMessage(now)
+				for _, client := range room.Clients {
+					client.enqueue(data)
+				}
+				room.mu.RUnlock()
+			}
+			h.mu.RUnlock()
+		}
+	}
+}
+
+func (h *Hub) handleRegister(client *Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// A second claimant of an active ID is turned away, unless it
+	// reconnected with the ID on purpose to take over the session
+	resumed := false
+	if !h.claimID(client) {
+		if resumed = client.reclaim && h.takeOver(client) != nil; !resumed {
+			slog.Warn("Rejected client with an ID already in use",
+				slog.String("clientId", client.ID))
+			client.sendError(ErrCodeClientIDInUse, "Client ID already in use")
+			if client.Conn != nil {
+				go client.closeWithReason(websocket.ClosePolicyViolation, CloseReasonClientIDInUse)
+			}
+			return
+		}
+	} else {
+		metrics.Clients.Add(1)
+	}
+	if client.reclaim {
+		client.resumeToken = uuid.NewString()
+	}
+
+	h.clients[client.ID] = client
+	if h.registerLog.allow(time.Now()) {
+		slog.Info("Client registered",
+			slog.String("clientId", client.ID))
+	}
+	h.events.publish(EventConnect, client.ID, "")
+
+	// Send connected message with client ID
+	msg := SignalingMessage{
+		Type:     MsgTypeConnected,
+		ClientID: client.ID,
+	}
+	info := client.connectionInfo()
+	msg.Payload, _ = json.Marshal(info)
+	data, _ := json.Marshal(msg)
+	client.enqueue(data)
+	if h.deprecated(client) {
+		client.enqueue(h.deprecationWarning())
+	}
+
+	// A resumed session gets its rooms' current state straight away rather
+	// than at the next sync, so its UI can carry on where it left off
+	if resumed {
+		now := time.Now()
+		for _, roomID := range info.Rooms {
+			if room, ok := h.rooms[roomID]; ok {
+				room.mu.RLock()
+				client.enqueue(room.stateMessage(now))
+				room.mu.RUnlock()
+			}
+		}
+	}
+
+	if h.handshakeTimeout > 0 {
+		time.AfterFunc(h.handshakeTimeout, func() {
+			h.enforceHandshake(client)
+		})
+	}
+}
+
+// takeOver hands the session of the client holding client's ID over to
+// client, which reconnected with the same ID: it steps into the old
+// connection's rooms without peers seeing it leave and rejoin, and the old
+// connection is closed. Only a session that connected with a stable ID can
+// be taken over, and only by a client presenting the resume token it was
+// issued. serveWs registers a reconnect on the shard holding its session; it
+// returns the replaced client, or nil if the takeover is refused or the
+// session moved shard in the meantime. Caller must hold h.mu.
+func (h *Hub) takeOver(client *Client) *Client {
+	old, ok := h.clients[client.ID]
+	if !ok || !old.reclaim || old.resumeToken == "" ||
+		subtle.ConstantTimeCompare([]byte(client.resumeWith), []byte(old.resumeToken)) != 1 {
+		return nil
+	}
+	if h.router != nil {
+		h.router.idMu.Lock()
+		h.router.ids[client.ID] = client
+		h.router.idMu.Unlock()
+	}
+
+	for roomID := range old.Rooms {
+		if room, ok := h.rooms[roomID]; ok {
+			room.mu.Lock()
+			room.Clients[client.ID] = client
+			room.mu.Unlock()
+		}
+	}
+	client.Rooms, client.RoomID, client.Joined = old.Rooms, old.RoomID, old.Joined
+	// The old connection unregisters as a stale claimant, leaving no rooms
+	old.Rooms, old.RoomID = nil, ""
+	slog.Info("Client session taken over by reconnect",
+		slog.String("clientId", client.ID))
+	if old.Conn != nil {
+		go old.closeWithReason(websocket.CloseNormalClosure, CloseReasonSessionReplaced)
+	}
+	return old
+}
+
+// ConnectedPayload is the payload of a connected message: the server's view
+// of the connection, to help clients debug connectivity
+type ConnectedPayload struct {
+	ClientID string `json:"client_id"`
+	// IP is the address the server saw, hashed when HASH_CLIENT_IPS is set
+	IP          string `json:"ip,omitempty"`
+	Subprotocol string `json:"subprotocol,omitempty"`
+	Compressed  bool   `json:"compressed"`
+	// Rooms the connection resumed from a session it took over
+	Rooms []string `json:"rooms,omitempty"`
+	// ResumeToken is issued to a connection with a stable ID; reconnecting
+	// with it as ?resumeToken= takes over this session
+	ResumeToken string `json:"resume_token,omitempty"`
+}
+
+// connectionInfo describes the connection for its connected message. Caller
+// must hold h.mu.
+func (c *Client) connectionInfo() ConnectedPayload {
+	info := ConnectedPayload{
+		ClientID:    c.ID,
+		Subprotocol: c.Subprotocol,
+		Compressed:  c.Compressed,
+		ResumeToken: c.resumeToken,
+	}
+	if c.IP != "" {
+		info.IP = ipHasher.Redact(c.IP)
+	}
+	for roomID := range c.Rooms {
+		info.Rooms = append(info.Rooms, roomID)
+	}
+	slices.Sort(info.Rooms)
+	return info
+}
+
+// claimID reserves the client's ID across every shard, reporting false if
+// another client holds it. Caller must hold h.mu.
+func (h *Hub) claimID(client *Client) bool {
+	if h.router == nil {
+		existing, ok := h.clients[client.ID]
+		return !ok || existing == client
+	}
+	return h.router.claimID(client)
+}
+
+// releaseID frees the client's ID once it has unregistered. Caller must
+// hold h.mu.
+func (h *Hub) releaseID(client *Client) {
+	if h.router != nil {
+		h.router.releaseID(client)
+	}
+}
+
+// enforceHandshake disconnects a client that is still connected but has
+// not joined a room. The client may have moved off the shard it registered
+// on, so it is looked up on the shard holding it now.
+func (h *Hub) enforceHandshake(client *Client) {
+	hub := h.sessionShard(client.ID)
+	hub.mu.RLock()
+	registered := hub.clients[client.ID] == client
+	joined := client.Joined
+	hub.mu.RUnlock()
+
+	if registered && !joined {
+		slog.Info("Client handshake timed out",
+			slog.String("clientId", client.ID),
+			slog.Duration("connectedFor", time.Since(client.ConnectedAt)))
+		client.closeWithReason(websocket.ClosePolicyViolation, CloseReasonHandshakeTimeout)
+	}
+}
+
+func (h *Hub) handleUnregister(client *Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.clients[client.ID] != client {
+		// Rejected at registration or taken over by a reconnect; just let
+		// its WritePump finish
+		client.closeSend()
+		return
+	}
+
+	delete(h.clients, client.ID)
+	metrics.Clients.Add(-1)
+	h.releaseID(client)
+	client.closeSend()
+
+	// Remove from every room, telling the peers left behind
+	h.leaveAllRooms(client, true)
+	if h.unregisterLog.allow(time.Now()) {
+		slog.Info("Client unregistered",
+			slog.String("clientId", client.ID))
+	}
+	h.events.publish(EventDisconnect, client.ID, "")
+}
+
+func (h *Hub) handleBroadcast(message *SignalingMessage) {
+	// Relayed messages always have a sender; without one the echo check
+	// below can't tell who not to send it back to
+	if message.From == "" {
+		slog.Warn("Dropped relayed message without a sender",
+			slog.String("type", string(message.Type)),
+			slog.String("roomId", message.RoomID))
+		return
+	}
+
+	// Messages queued here before their room migrated follow it
+	if message.RoomID != "" {
+		if owner := h.shardFor(message.RoomID); owner != h {
+			h.forward(owner, message)
+			return
+		}
+	}
+
+	if message.Type == MsgTypeICECandidate && !h.iceFilter.allows(message.Payload) {
+		slog.Debug("Dropped ICE candidate outside allowed ranges",
+			slog.String("clientId", message.From),
+			slog.String("roomId", message.RoomID))
+		return
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	room, forward := h.admit(message)
+	if !forward {
+		return
+	}
+	metrics.CountBroadcast(message.Type)
+	if h.forwardLog.sample() {
+		slog.Debug("Forwarding message",
+			slog.String("type", string(message.Type)),
+			slog.String("from", message.From),
+			slog.String("to", message.To),
+			slog.String("roomId", message.RoomID),
+			slog.Int64("sampleRate", h.forwardLog.n))
+	}
+
+	// Direct message to specific client
+	if message.To != "" {
+		if client, ok := h.clients[message.To]; ok {
+			data, _ := json.Marshal(message)
+			if !client.relay(message.Type, data) {
+				slog.Warn("Failed to send to client, buffer full",
+					slog.String("clientId", message.To))
+			} else if room != nil {
+				room.recordForward(len(data))
+			}
+		}
+		return
+	}
+
+	// Broadcast to room
+	if message.RoomID != "" && room != nil {
+		room.mu.RLock()
+		data, _ := json.Marshal(message)
+		for id, client := range room.Clients {
+			if id == message.From { // Don't echo back to sender
+				continue
+			}
+			// A star's peripherals broadcast to the hub peer alone
+			if room.forward != nil && !room.forward(message.From, id) {
+				continue
+			}
+			if !client.relay(message.Type, data) {
+				slog.Warn("Failed to broadcast to client",
+					slog.String("clientId", id))
+			} else {
+				room.recordForward(len(data))
+			}
+		}
+		room.mu.RUnlock()
+	}
+}
+
+// admit applies room policy (message rate, negotiation tracking) to a
+// relayed message, returning the room it belongs to (nil if none) and
+// whether it should be forwarded. Caller must hold h.mu.
+func (h *Hub) admit(message *SignalingMessage) (*Room, bool) {
+	sender := h.clients[message.From]
+	roomID := message.RoomID
+	if roomID == "" && sender != nil {
+		roomID = sender.RoomID
+	}
+	room, ok := h.rooms[roomID]
+	if !ok {
+		return nil, true
+	}
+
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	// Rooms using roles relay nothing until the sender and receiver are both in
+	if len(room.roles) > 0 && !room.ready() {
+		if sender != nil {
+			sender.sendError(ErrCodeRoomNotReady, "Waiting for both sender and receiver")
+		}
+		return room, false
+	}
+
+	if room.observers[message.From] {
+		if sender != nil {
+			sender.sendError(ErrCodeObserver, "Observers cannot send to the room")
+		}
+		return room, false
+	}
+
+	// Directed messages the topology forbids are refused; broadcasts only
+	// reach the members it allows
+	if message.To != "" && room.forward != nil && !room.forward(message.From, message.To) {
+		if sender != nil {
+			sender.sendError(ErrCodeForwardDenied, "Not allowed to signal that peer")
+		}
+		return room, false
+	}
+
+	now := time.Now()
+	room.touch(now)
+	if sender != nil && room.Clients[sender.ID] == sender {
+		room.lastSeen[sender.ID] = now
+	}
+	if room.rate != nil && !room.rate.allow(now) {
+		if sender != nil {
+			sender.sendError(ErrCodeRoomRateLimit, "Room message rate exceeded")
+		}
+		return room, false
+	}
+
+	if message.Type == MsgTypeRelay && h.maxRoomRelayBytes > 0 {
+		size := int64(len(message.Payload))
+		if room.RelayedBytes+size > h.maxRoomRelayBytes {
+			if sender != nil {
+				sender.sendError(ErrCodeRelayBudget, "Room relay budget exceeded")
+			}
+			return room, false
+		}
+		room.RelayedBytes += size
+	}
+
+	if message.Type == MsgTypeICECandidate && h.iceCandidateWindow > 0 {
+		offerAt := room.negotiation.offerAt
+		if !offerAt.IsZero() && now.Sub(offerAt) > h.iceCandidateWindow {
+			slog.Debug("Dropped late ICE candidate",
+				slog.String("clientId", message.From),
+				slog.String("roomId", roomID),
+				slog.Duration("sinceOffer", now.Sub(offerAt)))
+			return room, false
+		}
+		message.ServerTime = now.UnixMilli()
+	}
+
+	forward := room.track(message)
+	h.handshakes.set(room, !room.negotiation.answered)
+	if forward {
+		room.transcript.record(message, now)
+		return room, true
+	}
+
+	// Over the ICE candidate cap: drop, warning the sender only once
+	if !room.negotiation.iceWarned {
+		room.negotiation.iceWarned = true
+		slog.Warn("ICE candidate limit reached",
+			slog.String("clientId", message.From),
+			slog.String("roomId", roomID))
+		if sender != nil {
+			sender.sendError(ErrCodeICELimit, "ICE candidate limit reached")
+		}
+	}
+	return room, false
+}
+
+// Keepalive marks one of the client's rooms (its current room when roomID
+// is empty) as active without relaying anything, so peers that finished
+// signaling can hold the room open for renegotiation
+func (h *Hub) Keepalive(client *Client, roomID string) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if roomID == "" {
+		roomID = client.RoomID
+	}
+	room, ok := h.rooms[roomID]
+	if !ok || !client.Rooms[roomID] {
+		client.sendError(ErrCodeNotInRoom, "Not in a room")
+		return
+	}
+
+	now := time.Now()
+	room.mu.Lock()
+	room.touch(now)
+	room.lastSeen[client.ID] = now
+	room.mu.Unlock()
+}
+
+// ResetRoom clears the negotiation state of one of the client's rooms
+// (its current room when roomID is empty) and tells every member, including
+// the requester, to start over. Membership is kept.
+func (h *Hub) ResetRoom(client *Client, roomID string) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if roomID == "" {
+		roomID = client.RoomID
+	}
+	room, ok := h.rooms[roomID]
+	if !ok || !client.Rooms[roomID] {
+		client.sendError(ErrCodeNotInRoom, "Not in a room")
+		return
+	}
+
+	room.mu.Lock()
+	room.reset()
+	h.handshakes.set(room, true)
+
+	msg := SignalingMessage{
+		Type:     MsgTypeResetRoom,
+		From:     client.ID,
+		RoomID:   room.ID,
+		ClientID: client.ID,
+	}
+	data, _ := json.Marshal(msg)
+	for _, peer := range room.Clients {
+		peer.enqueue(data)
+	}
+	room.mu.Unlock()
+
+	slog.Info("Room reset",
+		slog.String("clientId", client.ID),
+		slog.String("roomId", room.ID))
+}
+
+// ExtendRoomPayload is the payload of extend-room. Clients ask for Seconds
+// more (roomExpiryDuration when 0); members are sent back the granted
+// remaining TTL.
+type ExtendRoomPayload struct {
+	Seconds             int `json:"seconds,omitempty"`
+	RemainingTTLSeconds int `json:"remaining_ttl_seconds,omitempty"`
+}
+
+// ExtendRoom keeps one of the client's rooms (its current room when roomID
+// is empty) alive for the requested time from now even if it goes idle,
+// for long transfers that relay nothing. The room's total lifetime stays
+// within maxRoomLifetime of its creation; every member is told the new
+// remaining TTL.
+func (h *Hub) ExtendRoom(client *Client, roomID string, by time.Duration, now time.Time) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if roomID == "" {
+		roomID = client.RoomID
+	}
+	room, ok := h.rooms[roomID]
+	if !ok || !client.Rooms[roomID] {
+		client.sendError(ErrCodeNotInRoom, "Not in a room")
+		return
+	}
+	if by <= 0 {
+		by = roomExpiryDuration
+	}
+
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	until := now.Add(by)
+	if limit := room.CreatedAt.Add(h.maxRoomLifetime); until.After(limit) {
+		until = limit
+	}
+	if !until.After(room.expiresAt()) {
+		client.sendError(ErrCodeExtensionLimit, "Room lifetime limit reached")
+		return
+	}
+	room.ExtendedUntil = until
+
+	payload, _ := json.Marshal(ExtendRoomPayload{
+		RemainingTTLSeconds: int(room.remainingTTL(now).Seconds()),
+	})
+	data, _ := json.Marshal(SignalingMessage{
+		Type:     MsgTypeExtendRoom,
+		RoomID:   room.ID,
+		ClientID: client.ID,
+		Payload:  payload,
+	})
+	for _, peer := range room.Clients {
+		peer.enqueue(data)
+	}
+
+	slog.Info("Room extended",
+		slog.String("clientId", client.ID),
+		slog.String("roomId", room.ID),
+		slog.Time("until", until))
+}
+
+// JoinOptions qualify a join
+type JoinOptions struct {
+	Role   string // RoleSender or RoleReceiver, or "" to join without one
+	Public bool   // List the room publicly if this join creates it
+	// Record a signaling transcript if this join creates the room
+	Transcript bool
+	// Password required of later joiners if this join creates the room,
+	// or the password of the room being joined
+	Password string
+	// Idle TTL of the room if this join creates it, 0 for the default
+	TTL time.Duration
+	// Topology of the room if this join creates it, "" for a full mesh
+	Topology string
+}
+
+// JoinRoom adds a client to a room (creates room if needed)
+func (h *Hub) JoinRoom(client *Client, roomID string) error {
+	return h.JoinRoomWith(client, roomID, JoinOptions{})
+}
+
+// JoinRoomWith adds a client to a room, optionally claiming a role. Once
+// both roles are filled every member is sent ready.
+func (h *Hub) JoinRoomWith(client *Client, roomID string, opts JoinOptions) error {
+	_, err := h.joinRoom(client, roomID, opts)
+	return err
+}
+
+// admitJoin reports why the client may not join roomID, if it may not,
+// without changing anything. checked is the room checkRoomPassword vetted.
+// Membership is read from the room rather than the client, so a shard can
+// vet a client still on another one. Caller must hold h.mu.
+func (h *Hub) admitJoin(client *Client, roomID string, opts JoinOptions, checked *Room) error {
+	role := opts.Role
+	if h.roomDenylist[roomID] {
+		return errRoomDenied
+	}
+	if role != "" && role != RoleSender && role != RoleReceiver {
+		return errUnknownRole
+	}
+	if _, err := newForwardPolicy(opts.Topology, client.ID); err != nil {
+		return err
+	}
+
+	room, ok := h.rooms[roomID]
+	if !ok {
+		// Rejoining a room that just expired should not quietly recreate it
+		if reason, expired := h.tombstones.reason(roomID, time.Now()); expired {
+			return &roomExpiredError{reason: reason}
+		}
+		if opts.TTL > 0 && opts.TTL < roomCleanupInterval {
+			return errRoomTTLTooShort
+		}
+		if h.maxHandshakes > 0 && h.handshakes.n.Load() >= int64(h.maxHandshakes) {
+			return errServerBusy
+		}
+		return nil
+	}
+	if role != "" {
+		if holder := room.roleHolder(role); holder != "" && holder != client.ID {
+			return errRoleTaken
+		}
+	}
+	if room.has(client) {
+		return nil
+	}
+
+	// A protected room created or replaced since checkRoomPassword ran
+	// was never checked against
+	if room.password != nil && room != checked {
+		return errRoomPassword
+	}
+	if room.MaxClients > 0 && h.roomFullPolicy != RoomFullObserver && h.roomFullPolicy != RoomFullBump {
+		room.mu.RLock()
+		full := room.participants() >= room.MaxClients
+		room.mu.RUnlock()
+		if full {
+			return errRoomFull
+		}
+	}
+	return nil
+}
+
+// checkJoin runs joinRoom's admission checks without joining, for a client
+// about to move here from another shard: moving leaves its rooms there, so
+// a join refused after the move would strand it outside all of them
+func (h *Hub) checkJoin(client *Client, roomID string, opts JoinOptions) error {
+	if err := checkRoomID(roomID); err != nil {
+		return err
+	}
+	checked, err := h.verifyRoomPassword(client, roomID, opts.Password)
+	if err != nil {
+		return err
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.admitJoin(client, roomID, opts, checked)
+}
+
+// joinRoom is JoinRoomWith, also describing the room the client joined
+func (h *Hub) joinRoom(client *Client, roomID string, opts JoinOptions) (RoomCreatedPayload, error) {
+	if err := checkRoomID(roomID); err != nil {
+		return RoomCreatedPayload{}, err
+	}
+	checked, password, err := h.checkRoomPassword(client, roomID, opts.Password)
+	if err != nil {
+		return RoomCreatedPayload{}, err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	role := opts.Role
+	if err := h.admitJoin(client, roomID, opts, checked); err != nil {
+		return RoomCreatedPayload{}, err
+	}
+	forward, _ := newForwardPolicy(opts.Topology, client.ID) // Checked by admitJoin
+
+	observer := false
+	if room, ok := h.rooms[roomID]; ok && room.MaxClients > 0 && !client.Rooms[roomID] {
+		room.mu.RLock()
+		full := room.participants() >= room.MaxClients
+		victim := room.idlest()
+		room.mu.RUnlock()
+
+		// admitJoin has turned the client away if the policy is reject
+		if full {
+			switch h.roomFullPolicy {
+			case RoomFullObserver:
+				observer = true
+			case RoomFullBump:
+				slog.Info("Bumping idle client from full room",
+					slog.String("clientId", victim.ID),
+					slog.String("roomId", roomID))
+				victim.sendError(ErrCodeBumped, "Removed from a full room to make space")
+				h.leaveRoom(victim, roomID, true)
+			}
+		}
+	}
+
+	if !client.Rooms[roomID] && len(client.Rooms) >= max(h.maxRoomsPerClient, 1) {
+		if h.maxRoomsPerClient > 1 {
+			return RoomCreatedPayload{}, errRoomLimit
+		}
+		// Single-room clients switch rooms
+		h.leaveAllRooms(client, false)
+	}
+
+	// Create room if it doesn't exist
+	room, ok := h.rooms[roomID]
+	created := !ok
+	if created {
+		room = &Room{
+			ID:         roomID,
+			Clients:    make(map[string]*Client),
+			CreatedAt:  time.Now(),
+			Public:     opts.Public,
+			MaxClients: h.maxRoomClients,
+			forward:    forward,
+		}
+		if h.roomMessageRate > 0 {
+			room.rate = newTokenBucket(h.roomMessageRate, h.roomMessageBurst, room.CreatedAt)
+		}
+		if opts.Transcript {
+			room.transcript = newTranscript(h.transcriptLimit, h.transcriptPayloads)
+		}
+		room.password = password
+		if opts.TTL > 0 {
+			room.TTL = min(opts.TTL, h.maxRoomTTL)
+		}
+		h.rooms[roomID] = room
+		h.tombstones.remove(roomID)
+		metrics.Rooms.Add(1)
+		h.handshakes.set(room, true)
+		slog.Info("Room created",
+			slog.String("roomId", roomID),
+			slog.Bool("public", room.Public))
+	}
+
+	// Add client to room
+	room.mu.Lock()
+
+	// Notify existing peers
+	for _, peer := range room.Clients {
+		msg := SignalingMessage{
+			Type:     MsgTypePeerJoined,
+			From:     client.ID,
+			RoomID:   roomID,
+			ClientID: client.ID,
+		}
+		data, _ := json.Marshal(msg)
+		h.announceJoin(peer, client, roomID, data)
+
+		// Peers sharing a public IP are likely on the same LAN and can
+		// prefer host candidates for a direct link
+		if client.IP != "" && peer.IP == client.IP && peer.ID != client.ID {
+			sendLANHint(peer, client.ID, roomID)
+			sendLANHint(client, peer.ID, roomID)
+		}
+	}
+
+	room.Clients[client.ID] = client
+	room.touch(time.Now())
+	if room.lastSeen == nil {
+		room.lastSeen = make(map[string]time.Time)
+	}
+	room.lastSeen[client.ID] = room.LastActivity
+	if observer {
+		if room.observers == nil {
+			room.observers = make(map[string]bool)
+		}
+		room.observers[client.ID] = true
+		role = "" // Observers cannot hold a role
+	}
+	room.peakClients = max(room.peakClients, len(room.Clients))
+	if client.Rooms == nil {
+		client.Rooms = make(map[string]bool)
+	}
+	client.Rooms[roomID] = true
+	client.RoomID = roomID
+	client.Joined = true
+
+	if role != "" {
+		wasReady := room.ready()
+		if room.roles == nil {
+			room.roles = make(map[string]string)
+		}
+		for r, id := range room.roles {
+			if id == client.ID {
+				delete(room.roles, r) // Switching roles frees the old one
+			}
+		}
+		room.roles[role] = client.ID
+		if !wasReady && room.ready() {
+			data, _ := json.Marshal(SignalingMessage{Type: MsgTypeReady, RoomID: roomID})
+			for _, member := range room.Clients {
+				member.enqueue(data)
+			}
+		}
+	}
+	info := RoomCreatedPayload{Created: created, Clients: len(room.Clients)}
+	room.mu.Unlock()
+
+	slog.Info("Client joined room",
+		slog.String("clientId", client.ID),
+		slog.String("roomId", roomID),
+		slog.Int("totalClients", len(room.Clients)))
+	h.events.publish(EventJoin, client.ID, roomID)
+	return info, nil
+}
+
+// RoomCreatedPayload is the payload of room-created, telling a client that
+// just joined whether it is first in, waiting for a peer, or joining one
+type RoomCreatedPayload struct {
+	Created bool `json:"created"` // The join created the room
+	Clients int  `json:"clients"` // Members including the joiner
+}
+
+// sendLANHint tells client that peerID connected from the same public IP
+func sendLANHint(client *Client, peerID, roomID string) {
+	msg := SignalingMessage{
+		Type:     MsgTypeLANHint,
+		RoomID:   roomID,
+		ClientID: peerID,
+	}
+	data, _ := json.Marshal(msg)
+	client.enqueue(data)
+}
+
+// LeaveRoom removes the client from one of its rooms (its current room when
+// roomID is empty) and notifies the remaining peers
+func (h *Hub) LeaveRoom(client *Client, roomID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if roomID == "" {
+		roomID = client.RoomID
+	}
+	if !client.Rooms[roomID] {
+		client.sendError(ErrCodeNotInRoom, "Not in a room")
+		return
+	}
+	h.leaveRoom(client, roomID, true)
+
+	slog.Info("Client left room",
+		slog.String("clientId", client.ID),
+		slog.String("roomId", roomID))
+}
+
+// leaveRoom removes the client from a room, optionally sending peer-left to
+// the members left behind, and deletes the room if it is left empty.
+// Caller must hold h.mu.
+func (h *Hub) leaveRoom(client *Client, roomID string, notify bool) {
+	if room, ok := h.rooms[roomID]; ok {
+		room.mu.Lock()
+		delete(room.Clients, client.ID)
+		delete(room.observers, client.ID)
+		delete(room.lastSeen, client.ID)
+		for role, id := range room.roles {
+			if id == client.ID {
+				delete(room.roles, role)
+			}
+		}
+
+		if notify {
+			msg := SignalingMessage{
+				Type:     MsgTypePeerLeft,
+				From:     client.ID,
+				RoomID:   roomID,
+				ClientID: client.ID,
+			}
+			if client.leaveReason != "" {
+				msg.Payload, _ = json.Marshal(DisconnectPayload{Reason: client.leaveReason})
+			}
+			data, _ := json.Marshal(msg)
+			for _, peer := range room.Clients {
+				peer.notifyPresence(h, roomID, data)
+			}
+		}
+
+		empty := len(room.Clients) == 0
+		room.mu.Unlock()
+
+		if empty {
+			delete(h.rooms, roomID)
+			metrics.Rooms.Add(-1)
+			h.handshakes.set(room, false)
+			h.releaseRoom(roomID)
+			slog.Info("Room deleted (empty)",
+				slog.String("roomId", roomID))
+			room.logSummary("empty")
+		}
+	}
+	if client.Rooms[roomID] {
+		h.events.publish(EventLeave, client.ID, roomID)
+	}
+	client.dropRoom(roomID)
+}
+
+// leaveAllRooms removes the client from every room it is in.
+// Caller must hold h.mu.
+func (h *Hub) leaveAllRooms(client *Client, notify bool) {
+	for roomID := range client.Rooms {
+		h.leaveRoom(client, roomID, notify)
+	}
+}
+
+// dropRoom forgets a room the client was in, falling back to any remaining
+// room as its current one. Caller must hold the hub lock.
+func (c *Client) dropRoom(roomID string) {
+	delete(c.Rooms, roomID)
+	if c.RoomID != roomID {
+		return
+	}
+	c.RoomID = ""
+	for id := range c.Rooms {
+		c.RoomID = id
+		break
+	}
+}
+
+// announceJoin sends a peer-joined notice to peer, after the configured
+// delay if any. A notice for a joiner that has left again by then is
+// dropped, so peers never hear of a join after its peer-left.
+func (h *Hub) announceJoin(peer, joiner *Client, roomID string, data []byte) {
+	delay := h.peerJoinedDelay
+	if h.peerJoinedJitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(h.peerJoinedJitter)))
+	}
+	if delay <= 0 {
+		peer.notifyPresence(h, roomID, data)
+		return
+	}
+	time.AfterFunc(delay, func() {
+		// The room may have migrated shards in the meantime
+		if h.shardFor(roomID).inRoom(joiner, roomID) {
+			peer.notifyPresence(h, roomID, data)
+		}
+	})
+}
+
+// notifyPresence queues a peer-joined or peer-left notice. A client with
+// presenceMax messages already queued is falling behind, and in a churning
+// room would fill its buffer with notices that are stale by the time they
+// are read, so the notice is withheld and the room marked for a single
+// room-state update, sent once presenceCoalesceDelay has gathered the rest.
+func (c *Client) notifyPresence(h *Hub, roomID string, data []byte) {
+	if c.presenceMax <= 0 || len(c.Send) < c.presenceMax {
+		c.enqueue(data)
+		return
+	}
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	if c.sendClosed {
+		return
+	}
+	if len(c.stalePresence) == 0 {
+		time.AfterFunc(presenceCoalesceDelay, func() { c.flushPresence(h) })
+	}
+	if c.stalePresence == nil {
+		c.stalePresence = make(map[string]bool)
+	}
+	c.stalePresence[roomID] = true
+}
+
+// flushPresence sends a room-state for each room whose presence notices
+// were withheld, if the client is still in it
+func (c *Client) flushPresence(h *Hub) {
+	c.sendMu.Lock()
+	stale := c.stalePresence
+	c.stalePresence = nil
+	c.sendMu.Unlock()
+
+	now := time.Now()
+	for roomID := range stale {
+		// The room may have migrated shards in the meantime
+		owner := h.shardFor(roomID)
+		owner.mu.RLock()
+		room, ok := owner.rooms[roomID]
+		var data []byte
+		if ok {
+			room.mu.RLock()
+			if room.Clients[c.ID] != nil {
+				data = room.stateMessage(now)
+			}
+			room.mu.RUnlock()
+		}
+		owner.mu.RUnlock()
+		if data != nil {
+			slog.Debug("Sent coalesced room state",
+				slog.String("clientId", c.ID),
+				slog.String("roomId", roomID))
+			c.enqueue(data)
+		}
+	}
+}
+
+// inRoom reports whether the client is a member of roomID
+func (h *Hub) inRoom(client *Client, roomID string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return client.Rooms[roomID]
+}
+
+// isObserver reports whether the client is only watching the given room
+func (h *Hub) isObserver(client *Client, roomID string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	room, ok := h.rooms[roomID]
+	if !ok {
+		return false
+	}
+	room.mu.RLock()
+	defer room.mu.RUnlock()
+	return room.observers[client.ID]
+}
+
+// roomOf returns the client's current room ID. RoomID is written by the hub
+// on join and expiry, so reads from other goroutines must hold the hub lock.
+func (h *Hub) roomOf(client *Client) string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return client.RoomID
+}
+
+// NewClient creates a new client with unique ID
+func NewClient(conn WSConn, hub *Hub) *Client {
+	return &Client{
+		ID:           uuid.New().String()[:8], // Short ID for easier debugging
+		Conn:         conn,
+		Hub:          hub,
+		Send:         make(chan []byte, 256),
+		ConnectedAt:  time.Now(),
+		overflow:     hub.sendOverflow,
+		compressMin:  hub.compressThreshold,
+		minPing:      hub.minPingInterval,
+		coalesce:     hub.writeCoalesce,
+		pongLagAfter: hub.pongLagThreshold,
+		presenceMax:  hub.presenceBacklog,
+		router:       hub.router,
+	}
+}
+
+// ReadPump handles incoming messages from WebSocket
+func (c *Client) ReadPump() {
+	defer func() {
+		c.closed.Store(true)
+		release := c.holdHub()
+		c.Hub.unregister <- c
+		release()
+		c.Conn.Close()
+	}()
+
+	c.Conn.SetReadLimit(maxMessageSize)
+	c.Conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.Conn.SetPongHandler(func(string) error {
+		c.Conn.SetReadDeadline(time.Now().Add(pongWait))
+		c.lastPong.Store(time.Now().UnixNano())
+		c.pongLagging.Store(false)
+		return nil
+	})
+
+	for {
+		data, err := c.readMessage()
+		if err != nil {
+			if errors.Is(err, errMessageTooBig) || errors.Is(err, websocket.ErrReadLimit) {
+				slog.Warn("Client message too large",
+					slog.String("clientId", c.ID),
+					slog.Int("limit", maxMessageSize))
+				if errors.Is(err, errMessageTooBig) {
+					c.closeWithReason(websocket.CloseMessageTooBig, CloseReasonMessageTooBig)
+				}
+			} else if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				slog.Warn("Client read error",
+					slog.String("clientId", c.ID),
+					slog.String("error", err.Error()))
+			}
+			break
+		}
+
+		c.stats.messagesIn.Add(1)
+		c.stats.bytesIn.Add(int64(len(data)))
+
+		release := c.holdHub()
+		done := c.handleMessage(data)
+		release()
+		if done {
+			return
+		}
+	}
+}
+
+// handleMessage acts on one message from the client, reporting whether the
+// client asked to disconnect. The caller holds the client's hub.
+func (c *Client) handleMessage(data []byte) bool {
+	msg, err := decodeMessage(data, c.Hub.strictMessages)
+	if err != nil {
+		slog.Warn("Invalid JSON from client",
+			slog.String("clientId", c.ID),
+			slog.String("error", err.Error()))
+		c.sendError(ErrCodeInvalidMessage, "Invalid message format")
+		if c.tooManyInvalid(time.Now()) {
+			slog.Warn("Disconnecting client sending invalid messages",
+				slog.String("clientId", c.ID),
+				slog.Int("consecutive", c.invalidRun),
+				slog.String("ip", ipHasher.Redact(c.IP)))
+			if c.Conn != nil {
+				c.closeWithReason(websocket.CloseUnsupportedData, CloseReasonInvalidMessages)
+			}
+			return true
+		}
+		return false
+	}
+	c.invalidRun = 0
+
+	if !msg.validPayload() {
+		c.sendError(ErrCodeInvalidMessage, "Invalid payload")
+		return false
+	}
+
+	if msg.From != "" && msg.From != c.ID && c.Hub.strictFrom {
+		slog.Warn("Rejected message with spoofed sender",
+			slog.String("clientId", c.ID),
+			slog.String("claimedFrom", msg.From),
+			slog.String("type", string(msg.Type)),
+			slog.String("ip", ipHasher.Redact(c.IP)))
+		c.sendError(ErrCodeInvalidMessage, "From does not match sender")
+		return false
+	}
+	msg.From = c.ID // Always set the from field to prevent spoofing
+	msg.ServerTime = 0
+	metrics.CountMessage(msg.Type)
+
+	// Handle message based on type
+	switch msg.Type {
+	case MsgTypeHandshakeInit:
+		// Client wants to create/join a room
+		if msg.RoomID == "" {
+			c.sendError(ErrCodeRoomRequired, "Room ID required for handshake")
+			return false
+		}
+		if !validRoomID(msg.RoomID) {
+			c.sendError(ErrCodeInvalidMessage, "Invalid room ID")
+			return false
+		}
+		if msg.Features != nil {
+			c.negotiateFeatures(msg.Features)
+		}
+
+		var hp HandshakePayload
+		json.Unmarshal(msg.Payload, &hp)
+		roomID, retry := c.resolveJoinKey(hp.IdempotencyKey, msg.RoomID)
+		if retry && c.Hub.inRoom(c, roomID) {
+			c.sendJoined(roomID) // Already joined by the original handshake
+			return false
+		}
+		opts := JoinOptions{
+			Role:       hp.Role,
+			Public:     hp.Public,
+			Transcript: hp.Transcript,
+			Password:   hp.Password,
+			TTL:        time.Duration(hp.TTLSeconds) * time.Second,
+			Topology:   hp.Topology,
+		}
+		if c.hasFeature("verify-join") {
+			c.challengeJoin(roomID, opts)
+			return false
+		}
+		c.completeJoin(roomID, opts)
+
+	case MsgTypeOffer, MsgTypeAnswer, MsgTypeICECandidate, MsgTypeHandshakeVerify, MsgTypeRelay, MsgTypeCancelOffer:
+		// Under verify-join the handshake-verify answering the challenge
+		// completes the join and is not relayed
+		if msg.Type == MsgTypeHandshakeVerify && c.pendingJoin != nil {
+			c.verifyJoin(msg.Payload)
+			return false
+		}
+		if msg.Type == MsgTypeRelay && !c.hasFeature("relay") {
+			c.sendError(ErrCodeRelayDisabled, "Relay feature not negotiated")
+			return false
+		}
+		if c.Hub.validateSDP && (msg.Type == MsgTypeOffer || msg.Type == MsgTypeAnswer) {
+			if err := validateSessionDescription(msg.Payload); err != nil {
+				slog.Warn("Rejected malformed SDP",
+					slog.String("clientId", c.ID),
+					slog.String("type", string(msg.Type)),
+					slog.String("error", err.Error()))
+				c.sendError(ErrCodeInvalidSDP, "Invalid SDP: "+err.Error())
+				return false
+			}
+		}
+		// Forward to specific peer or broadcast to room
+		if msg.To == "" && msg.RoomID == "" {
+			msg.RoomID = c.Hub.roomOf(c)
+		}
+		// Broadcasts are scoped to rooms the sender is in
+		if msg.RoomID != "" && !c.Hub.inRoom(c, msg.RoomID) {
+			c.sendError(ErrCodeNotInRoom, "Not in room")
+			return false
+		}
+		c.Hub.queueFor(msg.Type) <- &msg
+
+	case MsgTypeResetRoom:
+		c.Hub.ResetRoom(c, msg.RoomID)
+
+	case MsgTypeLeaveRoom:
+		c.Hub.LeaveRoom(c, msg.RoomID)
+
+	case MsgTypeKeepalive:
+		c.Hub.Keepalive(c, msg.RoomID)
+
+	case MsgTypeExtendRoom:
+		var req ExtendRoomPayload
+		if len(msg.Payload) > 0 && json.Unmarshal(msg.Payload, &req) != nil {
+			c.sendError(ErrCodeInvalidMessage, "Invalid extend-room payload")
+			return false
+		}
+		c.Hub.ExtendRoom(c, msg.RoomID, time.Duration(req.Seconds)*time.Second, time.Now())
+
+	case MsgTypeDisconnect:
+		c.disconnect(msg.Payload)
+		return true
+
+	case MsgTypeSessionStats:
+		c.sendSessionStats()
+
+	case MsgTypeServerTime:
+		c.sendServerTime(time.Now())
+
+	default:
+		c.sendError(ErrCodeUnknownType, "Unknown message type")
+	}
+	return false
+}
+
+// tooManyInvalid counts an undecodable message, reporting whether the
+// client has now sent the hub's limit of them in a row within its window. A
+// run older than the window starts over.
+func (c *Client) tooManyInvalid(now time.Time) bool {
+	if c.invalidRun == 0 || now.Sub(c.invalidSince) > c.Hub.invalidWindow {
+		c.invalidRun, c.invalidSince = 0, now
+	}
+	c.invalidRun++
+	return c.Hub.maxInvalidMessages > 0 && c.invalidRun >= c.Hub.maxInvalidMessages
+}
+
+// holdHub keeps room migrations from moving the client to another shard
+// until the returned func is called, so c.Hub stays put while a message is
+// handled
+func (c *Client) holdHub() func() {
+	if c.router == nil {
+		return func() {}
+	}
+	c.router.moveMu.RLock()
+	return c.router.moveMu.RUnlock
+}
+
+// sendSessionStats replies with the client's traffic counts so far
+func (c *Client) sendSessionStats() {
+	payload, _ := json.Marshal(SessionStatsPayload{
+		MessagesSent:     c.stats.messagesIn.Load(),
+		BytesSent:        c.stats.bytesIn.Load(),
+		MessagesReceived: c.stats.messagesOut.Load(),
+		BytesReceived:    c.stats.bytesOut.Load(),
+		MessagesDropped:  c.stats.dropped.Load(),
+		ConnectedSeconds: time.Since(c.ConnectedAt).Seconds(),
+	})
+	msg := SignalingMessage{
+		Type:     MsgTypeSessionStats,
+		ClientID: c.ID,
+		Payload:  payload,
+	}
+	data, _ := json.Marshal(msg)
+	c.enqueue(data)
+}
+
+// ServerTimePayload is the payload of a server-time reply. Clients estimate
+// their clock offset from it, halving the round trip for the transit time.
+type ServerTimePayload struct {
+	ServerTimeMs int64 `json:"serverTimeMs"` // Unix time in milliseconds
+}
+
+// sendServerTime replies with the server's clock
+func (c *Client) sendServerTime(now time.Time) {
+	payload, _ := json.Marshal(ServerTimePayload{ServerTimeMs: now.UnixMilli()})
+	msg := SignalingMessage{
+		Type:     MsgTypeServerTime,
+		ClientID: c.ID,
+		Payload:  payload,
+	}
+	data, _ := json.Marshal(msg)
+	c.enqueue(data)
+}
+
+// JoinedPayload is the payload of a joined message
+type JoinedPayload struct {
+	// Observer is set when the room was full and the client may only watch
+	Observer bool `json:"observer,omitempty"`
+	// RemainingTTLSeconds is how long the room will last without activity
+	RemainingTTLSeconds int `json:"remaining_ttl_seconds"`
+}
+
+// sendJoined acknowledges a successful handshake-init to the joining client
+func (c *Client) sendJoined(roomID string) {
+	msg := SignalingMessage{
+		Type:     MsgTypeJoined,
+		RoomID:   roomID,
+		ClientID: c.ID,
+	}
+	msg.Payload, _ = json.Marshal(c.Hub.joinedPayload(c, roomID, time.Now()))
+	data, _ := json.Marshal(msg)
+	c.enqueue(data)
+}
+
+// sendRoomFull tells the client it was turned away from a room at capacity.
+// It stays connected and may join another room.
+func (c *Client) sendRoomFull(roomID string) {
+	c.recordError(ErrCodeRoomFull, "Room is full")
+
+	payload, _ := json.Marshal("Room is full")
+	msg := SignalingMessage{
+		Type:    MsgTypeRoomFull,
+		RoomID:  roomID,
+		Payload: payload,
+	}
+	data, _ := json.Marshal(msg)
+	c.enqueue(data)
+}
+
+// joinedPayload describes the client's place in a room it just joined
+func (h *Hub) joinedPayload(client *Client, roomID string, now time.Time) JoinedPayload {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	room, ok := h.rooms[roomID]
+	if !ok {
+		return JoinedPayload{}
+	}
+	room.mu.RLock()
+	defer room.mu.RUnlock()
+	return JoinedPayload{
+		Observer:            room.observers[client.ID],
+		RemainingTTLSeconds: int(room.remainingTTL(now).Seconds()),
+	}
+}
+
+// completeJoin joins the room and acknowledges it, or tells the client why
+// it couldn't
+func (c *Client) completeJoin(roomID string, opts JoinOptions) {
+	info, err := c.join(roomID, opts)
+	if err != nil {
+		var expired *roomExpiredError
+		switch {
+		case errors.As(err, &expired):
+			slog.Info("Rejected join of expired room",
+				slog.String("clientId", c.ID),
+				slog.String("roomId", roomID),
+				slog.String("reason", expired.reason))
+			c.sendError(ErrCodeRoomExpired, "Room expired, please start a new transfer")
+		case err == errRoomIDRequired:
+			c.sendError(ErrCodeRoomRequired, "Room ID required for handshake")
+		case err == errInvalidRoomID:
+			c.sendError(ErrCodeInvalidMessage, "Invalid room ID")
+		case err == errRoomDenied:
+			slog.Info("Rejected join of denylisted room",
+				slog.String("clientId", c.ID),
+				slog.String("roomId", roomID))
+			c.sendError(ErrCodeRoomDenied, "Room ID not allowed")
+		case err == errServerBusy:
+			slog.Warn("Rejected new room, too many handshakes in progress",
+				slog.String("clientId", c.ID),
+				slog.String("roomId", roomID))
+			c.sendError(ErrCodeServerBusy, "Server busy, please retry shortly")
+		case err == errRoomFull:
+			c.sendRoomFull(roomID)
+		case err == errRoomPassword:
+			slog.Info("Rejected join with wrong room password",
+				slog.String("clientId", c.ID),
+				slog.String("roomId", roomID))
+			c.sendError(ErrCodeRoomPassword, "invalid room password")
+		case err == errRoleTaken:
+			c.sendError(ErrCodeRoleTaken, "Role already taken")
+		case err == errUnknownRole:
+			c.sendError(ErrCodeInvalidMessage, "Unknown role")
+		case err == errRoomOtherShard:
+			c.sendError(ErrCodeRoomLimit, "Leave your other rooms before joining this one")
+		case err == errUnknownTopology:
+			c.sendError(ErrCodeInvalidMessage, "Unknown topology")
+		case err == errRoomTTLTooShort:
+			c.sendError(ErrCodeInvalidMessage, "Room TTL must be at least a minute")
+		default:
+			c.sendError(ErrCodeRoomLimit, "Room limit reached")
+		}
+		return
+	}
+	c.sendRoomCreated(roomID, info)
+	c.sendJoined(roomID)
+}
+
+// sendRoomCreated tells a client that joined a room whether it created it
+func (c *Client) sendRoomCreated(roomID string, info RoomCreatedPayload) {
+	msg := SignalingMessage{
+		Type:   MsgTypeRoomCreated,
+		RoomID: roomID,
+	}
+	msg.Payload, _ = json.Marshal(info)
+	data, _ := json.Marshal(msg)
+	c.enqueue(data)
+}
+
+// challengeJoin reserves a join until the client proves it is still there
+// by echoing a challenge in handshake-verify, so a client that drops
+// mid-handshake never shows up to peers as a half-open member. A new
+// handshake-init replaces any join still pending.
+func (c *Client) challengeJoin(roomID string, opts JoinOptions) {
+	c.pendingJoin = &pendingJoin{
+		roomID:    roomID,
+		opts:      opts,
+		challenge: uuid.NewString(),
+	}
+	payload, _ := json.Marshal(JoinChallengePayload{Challenge: c.pendingJoin.challenge})
+	data, _ := json.Marshal(SignalingMessage{
+		Type:     MsgTypeJoinChallenge,
+		RoomID:   roomID,
+		ClientID: c.ID,
+		Payload:  payload,
+	})
+	c.enqueue(data)
+}
+
+// verifyJoin completes the pending join if the handshake-verify payload
+// echoes its challenge. Either way the reservation is used up: a client
+// that answers wrongly must start over with handshake-init.
+func (c *Client) verifyJoin(payload json.RawMessage) {
+	pending := c.pendingJoin
+	c.pendingJoin = nil
+
+	var answer JoinChallengePayload
+	json.Unmarshal(payload, &answer)
+	if subtle.ConstantTimeCompare([]byte(answer.Challenge), []byte(pending.challenge)) != 1 {
+		slog.Warn("Join challenge failed",
+			slog.String("clientId", c.ID),
+			slog.String("roomId", pending.roomID))
+		c.sendError(ErrCodeJoinChallenge, "Join challenge not answered")
+		return
+	}
+	c.completeJoin(pending.roomID, pending.opts)
+}
+
+// resolveJoinKey maps a handshake idempotency key to the room it first
+// resolved to, reporting whether this handshake is a retry. Keys are only
+// touched from ReadPump, so no locking is needed.
+func (c *Client) resolveJoinKey(key, roomID string) (string, bool) {
+	if key == "" {
+		return roomID, false
+	}
+
+	now := time.Now()
+	for k, jk := range c.joinKeys {
+		if now.Sub(jk.at) > joinKeyTTL {
+			delete(c.joinKeys, k)
+		}
+	}
+
+	if jk, ok := c.joinKeys[key]; ok {
+		return jk.roomID, true
+	}
+
+	if c.joinKeys == nil {
+		c.joinKeys = make(map[string]joinKey)
+	}
+	if len(c.joinKeys) >= maxJoinKeys {
+		// Forget the oldest key to keep memory per client bounded
+		var oldest string
+		for k, jk := range c.joinKeys {
+			if oldest == "" || jk.at.Before(c.joinKeys[oldest].at) {
+				oldest = k
+			}
+		}
+		delete(c.joinKeys, oldest)
+	}
+	c.joinKeys[key] = joinKey{roomID: roomID, at: now}
+	return roomID, false
+}
+
+// negotiateFeatures keeps the advertised features the server also supports
+// and tells the client the agreed set
+func (c *Client) negotiateFeatures(advertised []string) {
+	agreed := []string{}
+	for _, f := range serverFeatures {
+		if slices.Contains(advertised, f) {
+			agreed = append(agreed, f)
+		}
+	}
+	c.Features = agreed
+
+	msg := SignalingMessage{
+		Type:     MsgTypeFeatures,
+		Features: agreed,
+	}
+	data, _ := json.Marshal(msg)
+	c.enqueue(data)
+	c.batching.Store(slices.Contains(agreed, "batching"))
+}
+
+// hasFeature reports whether the client negotiated the given feature
+func (c *Client) hasFeature(name string) bool {
+	return slices.Contains(c.Features, name)
+}
+
+// disconnect handles a client's explicit request to leave. The reason is
+// logged and kept for the peer-left notification sent on unregister; the
+// deferred cleanup in ReadPump does the rest.
+func (c *Client) disconnect(payload json.RawMessage) {
+	var p DisconnectPayload
+	json.Unmarshal(payload, &p)
+
+	reason := p.Reason
+	if reason == "" {
+		reason = "unspecified"
+	}
+	if len(reason) > maxReasonLength {
+		reason = reason[:maxReasonLength]
+	}
+	c.leaveReason = reason
+
+	slog.Info("Client requested disconnect",
+		slog.String("clientId", c.ID),
+		slog.String("reason", reason))
+
+	c.Conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, reason),
+		time.Now().Add(writeWait))
+}
+
+// decodeMessage parses a client message. In strict mode unknown fields are
+// an error instead of being silently ignored.
+func decodeMessage(data []byte, strict bool) (SignalingMessage, error) {
+	var msg SignalingMessage
+	if !strict {
+		err := json.Unmarshal(data, &msg)
+		return msg, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&msg)
+	return msg, err
+}
+
+// validPayload reports whether the payload, if any, is well-formed JSON.
+// Decoding already guarantees this for messages read off the wire; the
+// check keeps a malformed fragment from ever being relayed to peers.
+func (m *SignalingMessage) validPayload() bool {
+	return len(m.Payload) == 0 || json.Valid(m.Payload)
+}
+
+// setPingInterval sets how often the client is pinged, clamped between the
+// server's floor and pingPeriod; pinging less often than that would let the
+// read deadline lapse. It must be called before WritePump starts.
+func (c *Client) setPingInterval(requested time.Duration) {
+	c.pingEvery = min(max(requested, c.minPing), pingPeriod)
+}
+
+// WritePump handles outgoing messages to WebSocket. When a write or ping
+// fails it closes the connection, which fails ReadPump's pending read so the
+// client is unregistered even though WritePump noticed the dead peer first.
+func (c *Client) WritePump() {
+	interval := c.pingEvery
+	if interval <= 0 {
+		interval = pingPeriod
+	}
+	ticker := time.NewTicker(interval)
 	defer func() {
 		ticker.Stop()
 		c.Conn.Close()
@@ -384,12 +2553,21 @@ func (c *Client) WritePump() {
 	for {
 		select {
 		case message, ok := <-c.Send:
+			count, open := 1, ok
+			if ok && c.coalesce > 0 && c.batching.Load() {
+				message, count, open = c.gather(message)
+			}
+
 			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if !ok {
 				c.Conn.WriteMessage(websocket.CloseMessage, []byte{})
 				return
 			}
 
+			// Deflating small control messages costs more CPU than it saves.
+			// This is a no-op unless the client negotiated compression.
+			c.Conn.EnableWriteCompression(c.compressMin > 0 && len(message) >= c.compressMin)
+
 			c.mu.Lock()
 			err := c.Conn.WriteMessage(websocket.TextMessage, message)
 			c.mu.Unlock()
@@ -400,24 +2578,273 @@ func (c *Client) WritePump() {
 					slog.String("error", err.Error()))
 				return
 			}
+			c.stats.messagesOut.Add(int64(count))
+			c.stats.bytesOut.Add(int64(len(message)))
+			if !open {
+				c.Conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
 
 		case <-ticker.C:
 			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if err := c.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				slog.Warn("Client ping failed",
+					slog.String("clientId", c.ID),
+					slog.String("error", err.Error()))
 				return
 			}
+			metrics.PingsSent.Add(1)
+			if c.pongLagAfter > 0 {
+				sent := time.Now()
+				time.AfterFunc(c.pongLagAfter, func() { c.checkPongLag(sent) })
+			}
 		}
 	}
 }
 
-func (c *Client) sendError(errMsg string) {
-	msg := SignalingMessage{
-		Type:    MsgTypeError,
-		Payload: json.RawMessage(`"` + errMsg + `"`),
+// checkPongLag flags the client if the ping sent at sent is still
+// unanswered: its socket is alive but nothing is reading pongs, and the
+// pong wait will soon close it
+func (c *Client) checkPongLag(sent time.Time) {
+	if c.closed.Load() || c.lastPong.Load() >= sent.UnixNano() {
+		return
 	}
-	data, _ := json.Marshal(msg)
+	if c.pongLagging.CompareAndSwap(false, true) {
+		metrics.PongLagWarnings.Add(1)
+		slog.Warn("Client not answering pings",
+			slog.String("clientId", c.ID),
+			slog.Duration("lag", time.Since(sent)))
+	}
+}
+
+// gather waits up to the coalescing window for more queued messages and
+// joins them to first, newline-separated, so a burst goes out as one frame.
+// It returns the batch, how many messages it holds, and false if Send was
+// closed meanwhile.
+func (c *Client) gather(first []byte) ([]byte, int, bool) {
+	batch, count := first, 1
+	timer := time.NewTimer(c.coalesce)
+	defer timer.Stop()
+
+	for len(batch) < maxMessageSize {
+		select {
+		case message, ok := <-c.Send:
+			if !ok {
+				return batch, count, false
+			}
+			// Copy on the first append; first may be shared with other clients
+			if count == 1 {
+				batch = append(make([]byte, 0, len(first)+1+len(message)), first...)
+			}
+			batch = append(append(batch, '\n'), message...)
+			count++
+		case <-timer.C:
+			return batch, count, true
+		}
+	}
+	return batch, count, true
+}
+
+// readMessage reads one whole message, however many continuation frames it
+// was split into. The connection's read limit already applies to the
+// reassembled message, but it counts bytes on the wire: a compressed message
+// can inflate well past it, so the inflated size is checked here too.
+// gorilla/websocket closes the connection itself when the wire limit trips.
+func (c *Client) readMessage() ([]byte, error) {
+	_, r, err := c.Conn.NextReader()
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(io.LimitReader(r, maxMessageSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxMessageSize {
+		return nil, errMessageTooBig
+	}
+	return data, nil
+}
+
+// closeWithReason sends a close frame carrying a machine-readable reason and
+// closes the connection, which makes ReadPump unregister the client
+func (c *Client) closeWithReason(code int, reason string) {
+	c.Conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, reason),
+		time.Now().Add(writeWait))
+	c.Conn.Close()
+}
+
+// enqueue hands a message to WritePump without blocking. It reports false
+// when the message was dropped; what else happens when the send buffer is
+// full depends on the client's overflow strategy.
+func (c *Client) enqueue(data []byte) bool {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	if c.sendClosed {
+		return false
+	}
+	select {
+	case c.Send <- data:
+		c.checkBackpressure()
+		return true
+	default:
+	}
+	c.stats.dropped.Add(1)
+	c.dropsSinceHint++
+
+	switch c.overflow {
+	case OverflowDropOldest:
+		// Fresh signaling beats stale: make room by discarding the front.
+		// WritePump may have drained a slot meanwhile, so this never blocks.
+		select {
+		case <-c.Send:
+		default:
+		}
+		c.Send <- data
+		return true
+	case OverflowDisconnect:
+		if c.Conn != nil && c.overflowed.CompareAndSwap(false, true) {
+			slog.Warn("Disconnecting client with full send buffer",
+				slog.String("clientId", c.ID))
+			// Closing writes to the network, so keep it off the caller's locks
+			go c.closeWithReason(websocket.ClosePolicyViolation, CloseReasonSendOverflow)
+		}
+	}
+	return false
+}
+
+// relay enqueues a message relayed from a peer. An offer or answer that
+// doesn't fit is retried a few times with backoff from its own goroutine,
+// since losing one stalls the whole negotiation while a lost ICE candidate
+// rarely matters; it may then arrive after messages relayed meanwhile.
+// Retries only apply to the drop_newest strategy: the others never leave
+// the message waiting for room.
+// It reports whether the message was queued or is being retried.
+func (c *Client) relay(t MessageType, data []byte) bool {
+	if c.enqueue(data) {
+		return true
+	}
+	if t != MsgTypeOffer && t != MsgTypeAnswer {
+		return false
+	}
+	if c.overflow != "" && c.overflow != OverflowDropNewest {
+		return false
+	}
+
+	go func() {
+		backoff := sendRetryBackoff
+		for i := 0; i < sendRetries; i++ {
+			time.Sleep(backoff)
+			if c.enqueue(data) {
+				return
+			}
+			backoff *= 2
+		}
+		slog.Warn("Dropped message after retries",
+			slog.String("clientId", c.ID),
+			slog.String("type", string(t)),
+			slog.Int("retries", sendRetries))
+	}()
+	return true
+}
+
+// notifyOrClose enqueues a notice the client must not miss, such as its
+// room expiring. If the send buffer stays full through a few retries the
+// connection is closed with reason instead, so the client finds out from
+// the close frame rather than through silent failures later.
+func (c *Client) notifyOrClose(data []byte, reason string) {
+	if c.enqueue(data) {
+		return
+	}
+	go func() {
+		backoff := sendRetryBackoff
+		for i := 0; i < sendRetries; i++ {
+			time.Sleep(backoff)
+			if c.enqueue(data) {
+				return
+			}
+			backoff *= 2
+		}
+		if c.Conn == nil || c.closed.Load() {
+			return
+		}
+		slog.Warn("Closing client that missed a notice with a full send buffer",
+			slog.String("clientId", c.ID),
+			slog.String("reason", reason))
+		c.closeWithReason(websocket.ClosePolicyViolation, reason)
+	}()
+}
+
+// BackpressurePayload is the payload of a backpressure hint
+type BackpressurePayload struct {
+	// DelayMs is how long the client should wait between messages it can
+	// pace, such as trickled ICE candidates
+	DelayMs int64 `json:"delay_ms"`
+}
+
+// checkBackpressure hints a client that isn't keeping up with its messages
+// to send fewer: its peers' replies are what fill its buffer. The suggested
+// delay grows with the messages dropped since the last hint. The hint is
+// queued only if it fits. Caller must hold c.sendMu.
+func (c *Client) checkBackpressure() {
+	if cap(c.Send) < 4 || len(c.Send) < cap(c.Send)*backpressureHighWater/4 {
+		return
+	}
+	now := time.Now()
+	if now.Sub(c.lastBackpressure) < backpressureInterval {
+		return
+	}
+
+	delay := backpressureBaseDelay << min(c.dropsSinceHint, 4)
+	payload, _ := json.Marshal(BackpressurePayload{DelayMs: delay.Milliseconds()})
+	data, _ := json.Marshal(SignalingMessage{
+		Type:     MsgTypeBackpressure,
+		ClientID: c.ID,
+		Payload:  payload,
+	})
 	select {
 	case c.Send <- data:
+		slog.Info("Sent backpressure hint",
+			slog.String("clientId", c.ID),
+			slog.Int("dropped", c.dropsSinceHint),
+			slog.Duration("delay", delay))
+		c.lastBackpressure = now
+		c.dropsSinceHint = 0
 	default:
 	}
 }
+
+// closeSend closes the send channel once, so WritePump exits. Messages
+// enqueued afterwards from other goroutines are dropped rather than
+// panicking on the closed channel. It is the only place Send is closed:
+// unregistering (possibly twice), a rejected registration and hub shutdown
+// may all reach it for the same client.
+func (c *Client) closeSend() {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	if !c.sendClosed {
+		c.sendClosed = true
+		close(c.Send)
+	}
+}
+
+// recordError keeps an error sent to the client for diagnostics and counts
+// it in metrics under the given code
+func (c *Client) recordError(code, errMsg string) {
+	c.lastError.Store(&ClientError{Code: code, Message: errMsg, At: time.Now().UTC()})
+	metrics.CountError(code)
+}
+
+// sendError sends an error to the client, recording it for diagnostics
+// and metrics under the given code
+func (c *Client) sendError(code, errMsg string) {
+	c.recordError(code, errMsg)
+
+	payload, _ := json.Marshal(errMsg)
+	msg := SignalingMessage{
+		Type:    MsgTypeError,
+		Payload: payload,
+	}
+	data, _ := json.Marshal(msg)
+	c.enqueue(data)
+}
@@ -1,16 +1,25 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func TestNewHub(t *testing.T) {
@@ -105,6 +114,100 @@ func TestHub_UnregisterClient(t *testing.T) {
 	}
 }
 
+func TestHub_DoubleUnregister(t *testing.T) {
+	hub := NewHub()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		hub.Run(ctx)
+	}()
+
+	client := &Client{ID: "test-client", Hub: hub, Send: make(chan []byte, 256)}
+	peer := &Client{ID: "peer", Hub: hub, Send: make(chan []byte, 256)}
+	hub.register <- client
+	hub.register <- peer
+	hub.JoinRoom(client, "room-123")
+	hub.JoinRoom(peer, "room-123")
+
+	// Both pushes must be handled without closing Send twice
+	hub.unregister <- client
+	hub.unregister <- client
+	client.closeSend()
+
+	// Shutdown closes the remaining clients' channels exactly once too
+	hub.unregister <- peer
+	cancel()
+	<-done
+	peer.closeSend()
+
+	for range client.Send {
+	}
+	if client.enqueue([]byte(`{}`)) {
+		t.Error("Enqueue after close should report the message dropped")
+	}
+	hub.mu.RLock()
+	defer hub.mu.RUnlock()
+	if len(hub.clients) != 0 || len(hub.rooms) != 0 {
+		t.Errorf("Expected hub emptied, got %d clients and %d rooms", len(hub.clients), len(hub.rooms))
+	}
+}
+
+func TestHub_RemoveOrphans(t *testing.T) {
+	hub := NewHub()
+	client := &Client{ID: "client", Hub: hub, Send: make(chan []byte, 256)}
+	orphan := &Client{ID: "orphan", Hub: hub, Send: make(chan []byte, 256)}
+	lonely := &Client{ID: "lonely", Hub: hub, Send: make(chan []byte, 256)}
+	for _, c := range []*Client{client, orphan, lonely} {
+		hub.clients[c.ID] = c
+	}
+	hub.JoinRoom(client, "room-123")
+	hub.JoinRoom(orphan, "room-123")
+	hub.JoinRoom(lonely, "room-456")
+	for len(client.Send) > 0 {
+		<-client.Send // drain peer-joined
+	}
+
+	// Simulate a partial cleanup that dropped the clients but not their
+	// room memberships
+	hub.mu.Lock()
+	delete(hub.clients, orphan.ID)
+	delete(hub.clients, lonely.ID)
+	hub.mu.Unlock()
+	orphan.closeSend()
+	lonely.closeSend()
+
+	// Relaying to the orphan before the sweep must not panic
+	hub.handleBroadcast(&SignalingMessage{Type: MsgTypeOffer, From: client.ID, RoomID: "room-123"})
+
+	if n := hub.removeOrphans(); n != 2 {
+		t.Errorf("Removed %d orphans, want 2", n)
+	}
+	if hub.inRoom(orphan, "room-123") {
+		t.Error("Orphan still in room")
+	}
+	hub.mu.RLock()
+	room, ok := hub.rooms["room-123"]
+	_, lonelyRoom := hub.rooms["room-456"]
+	hub.mu.RUnlock()
+	if !ok || len(room.Clients) != 1 {
+		t.Fatalf("Expected room-123 kept with 1 member")
+	}
+	if lonelyRoom {
+		t.Error("Room left empty by its orphan should be deleted")
+	}
+
+	var sm SignalingMessage
+	json.Unmarshal(<-client.Send, &sm)
+	if sm.Type != MsgTypePeerLeft || sm.ClientID != orphan.ID {
+		t.Errorf("Expected peer-left for the orphan, got %v %v", sm.Type, sm.ClientID)
+	}
+	if n := hub.removeOrphans(); n != 0 {
+		t.Errorf("Second sweep removed %d, want 0", n)
+	}
+}
+
 func TestHub_JoinRoom(t *testing.T) {
 	hub := NewHub()
 	ctx, cancel := context.WithCancel(context.Background())
@@ -145,6 +248,47 @@ func TestHub_JoinRoom(t *testing.T) {
 	}
 }
 
+func TestHub_DuplicateClientID(t *testing.T) {
+	for _, sharded := range []bool{false, true} {
+		hub := NewHub()
+		if sharded {
+			hub = NewShardedHub(2).Entry()
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		go hub.Run(ctx)
+
+		first := &Client{ID: "same-id", Hub: hub, Send: make(chan []byte, 256)}
+		second := &Client{ID: "same-id", Hub: hub, Send: make(chan []byte, 256)}
+
+		hub.register <- first
+		hub.register <- second
+		time.Sleep(10 * time.Millisecond)
+
+		var sm SignalingMessage
+		json.Unmarshal(<-second.Send, &sm)
+		if sm.Type != MsgTypeError {
+			t.Errorf("sharded=%v: second claimant expected error, got %v", sharded, sm.Type)
+		}
+		if got := second.lastError.Load(); got == nil || got.Code != ErrCodeClientIDInUse {
+			t.Errorf("sharded=%v: last error = %+v, want %s", sharded, got, ErrCodeClientIDInUse)
+		}
+
+		// The rejected client leaving must not take the first one with it
+		hub.unregister <- second
+		time.Sleep(10 * time.Millisecond)
+		hub.mu.RLock()
+		current := hub.clients["same-id"]
+		hub.mu.RUnlock()
+		if current != first {
+			t.Errorf("sharded=%v: existing client was replaced or removed", sharded)
+		}
+		if _, ok := <-second.Send; ok {
+			t.Errorf("sharded=%v: rejected client's send channel should be closed", sharded)
+		}
+		cancel()
+	}
+}
+
 func TestHub_PeerJoinedNotification(t *testing.T) {
 	hub := NewHub()
 	ctx, cancel := context.WithCancel(context.Background())
@@ -180,6 +324,154 @@ func TestHub_PeerJoinedNotification(t *testing.T) {
 	}
 }
 
+func TestHub_PresenceCoalescing(t *testing.T) {
+	hub := NewHub()
+	hub.maxRoomClients = 0
+	hub.presenceBacklog = 4
+
+	watcher := NewClient(nil, hub)
+	hub.clients[watcher.ID] = watcher
+	hub.JoinRoom(watcher, "room-123")
+	for len(watcher.Send) > 0 {
+		<-watcher.Send
+	}
+	// A backlog the client hasn't read yet
+	for i := 0; i < hub.presenceBacklog; i++ {
+		watcher.Send <- []byte(`{"type":"offer"}`)
+	}
+
+	var remaining []string
+	for i := 0; i < 20; i++ {
+		peer := &Client{ID: fmt.Sprintf("peer-%d", i), Hub: hub, Send: make(chan []byte, 256)}
+		hub.clients[peer.ID] = peer
+		hub.JoinRoom(peer, "room-123")
+		if i%2 == 0 {
+			hub.LeaveRoom(peer, "room-123")
+		} else {
+			remaining = append(remaining, peer.ID)
+		}
+	}
+	time.Sleep(2 * presenceCoalesceDelay)
+
+	counts := make(map[MessageType]int)
+	var state RoomStatePayload
+	for len(watcher.Send) > 0 {
+		var sm SignalingMessage
+		json.Unmarshal(<-watcher.Send, &sm)
+		counts[sm.Type]++
+		if sm.Type == MsgTypeRoomState {
+			json.Unmarshal(sm.Payload, &state)
+		}
+	}
+	if counts[MsgTypePeerJoined] != 0 || counts[MsgTypePeerLeft] != 0 {
+		t.Errorf("Got %d peer-joined and %d peer-left, want them coalesced",
+			counts[MsgTypePeerJoined], counts[MsgTypePeerLeft])
+	}
+	if counts[MsgTypeRoomState] != 1 {
+		t.Fatalf("Got %d room-state updates, want 1", counts[MsgTypeRoomState])
+	}
+	want := append([]string{watcher.ID}, remaining...)
+	slices.Sort(want)
+	if !slices.Equal(state.Peers, want) {
+		t.Errorf("Room state peers = %v, want %v", state.Peers, want)
+	}
+}
+
+func TestHub_PeerJoinedDelay(t *testing.T) {
+	hub := NewHub()
+	hub.peerJoinedDelay = 100 * time.Millisecond
+	hub.peerJoinedJitter = 20 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go hub.Run(ctx)
+
+	client1 := &Client{ID: "client-1", Hub: hub, Send: make(chan []byte, 256)}
+	client2 := &Client{ID: "client-2", Hub: hub, Send: make(chan []byte, 256)}
+	client3 := &Client{ID: "client-3", Hub: hub, Send: make(chan []byte, 256)}
+	for _, c := range []*Client{client1, client2, client3} {
+		hub.register <- c
+	}
+	time.Sleep(10 * time.Millisecond)
+	for _, c := range []*Client{client1, client2, client3} {
+		<-c.Send // drain connected
+	}
+
+	hub.JoinRoom(client1, "room-123")
+	start := time.Now()
+	hub.JoinRoom(client2, "room-123")
+
+	select {
+	case msg := <-client1.Send:
+		var sm SignalingMessage
+		json.Unmarshal(msg, &sm)
+		if sm.Type != MsgTypePeerJoined || sm.ClientID != "client-2" {
+			t.Errorf("Expected peer-joined for client-2, got %v %v", sm.Type, sm.ClientID)
+		}
+		if elapsed := time.Since(start); elapsed < hub.peerJoinedDelay {
+			t.Errorf("peer-joined sent after %v, want at least %v", elapsed, hub.peerJoinedDelay)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("No peer-joined notification")
+	}
+
+	// A joiner gone before the delay is never announced
+	hub.JoinRoom(client3, "room-123")
+	hub.LeaveRoom(client3, "room-123")
+	time.Sleep(200 * time.Millisecond)
+	for len(client1.Send) > 0 {
+		var sm SignalingMessage
+		json.Unmarshal(<-client1.Send, &sm)
+		if sm.Type == MsgTypePeerJoined {
+			t.Error("peer-joined sent for a client that already left")
+		}
+	}
+}
+
+func TestHub_LANHint(t *testing.T) {
+	hub := NewHub()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go hub.Run(ctx)
+
+	client1 := &Client{ID: "client-1", IP: "203.0.113.5", Hub: hub, Send: make(chan []byte, 256)}
+	client2 := &Client{ID: "client-2", IP: "203.0.113.5", Hub: hub, Send: make(chan []byte, 256)}
+	client3 := &Client{ID: "client-3", IP: "198.51.100.9", Hub: hub, Send: make(chan []byte, 256)}
+
+	for _, c := range []*Client{client1, client2, client3} {
+		hub.register <- c
+	}
+	time.Sleep(10 * time.Millisecond)
+	for _, c := range []*Client{client1, client2, client3} {
+		<-c.Send // drain connected
+	}
+
+	hub.JoinRoom(client1, "room-123")
+	hub.JoinRoom(client2, "room-123")
+	hub.JoinRoom(client3, "room-123")
+
+	readTypes := func(c *Client) map[MessageType]string {
+		types := make(map[MessageType]string)
+		for len(c.Send) > 0 {
+			var sm SignalingMessage
+			json.Unmarshal(<-c.Send, &sm)
+			types[sm.Type] = sm.ClientID
+		}
+		return types
+	}
+
+	if got := readTypes(client1)[MsgTypeLANHint]; got != "client-2" {
+		t.Errorf("client-1 LAN hint peer = %q, want client-2", got)
+	}
+	if got := readTypes(client2)[MsgTypeLANHint]; got != "client-1" {
+		t.Errorf("client-2 LAN hint peer = %q, want client-1", got)
+	}
+	if _, ok := readTypes(client3)[MsgTypeLANHint]; ok {
+		t.Error("client-3 on a different IP should not get a LAN hint")
+	}
+}
+
 func TestHub_BroadcastToRoom(t *testing.T) {
 	hub := NewHub()
 	ctx, cancel := context.WithCancel(context.Background())
@@ -227,6 +519,35 @@ func TestHub_BroadcastToRoom(t *testing.T) {
 	}
 }
 
+func TestHub_BroadcastWithoutSender(t *testing.T) {
+	hub := NewHub()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go hub.Run(ctx)
+
+	client1 := &Client{ID: "client-1", Hub: hub, Send: make(chan []byte, 256)}
+	client2 := &Client{ID: "client-2", Hub: hub, Send: make(chan []byte, 256)}
+
+	hub.register <- client1
+	hub.register <- client2
+	time.Sleep(10 * time.Millisecond)
+	<-client1.Send
+	<-client2.Send
+
+	hub.JoinRoom(client1, "room-123")
+	hub.JoinRoom(client2, "room-123")
+	<-client1.Send // drain peer-joined
+
+	hub.broadcast <- &SignalingMessage{Type: MsgTypeOffer, RoomID: "room-123"}
+	hub.broadcast <- &SignalingMessage{Type: MsgTypeOffer, To: client2.ID}
+	time.Sleep(10 * time.Millisecond)
+
+	if len(client1.Send) != 0 || len(client2.Send) != 0 {
+		t.Error("Message without a sender should not be relayed")
+	}
+}
+
 func TestHub_DirectMessage(t *testing.T) {
 	hub := NewHub()
 	ctx, cancel := context.WithCancel(context.Background())
@@ -330,103 +651,2867 @@ func TestHub_PeerLeftNotification(t *testing.T) {
 	}
 }
 
-func TestHub_GracefulShutdown(t *testing.T) {
+func TestHub_ResetRoom(t *testing.T) {
 	hub := NewHub()
 	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		hub.Run(ctx)
-	}()
+	go hub.Run(ctx)
 
-	client := &Client{ID: "test-client", Hub: hub, Send: make(chan []byte, 256)}
-	hub.register <- client
+	client1 := &Client{ID: "client-1", Hub: hub, Send: make(chan []byte, 256)}
+	client2 := &Client{ID: "client-2", Hub: hub, Send: make(chan []byte, 256)}
+
+	hub.register <- client1
+	hub.register <- client2
 	time.Sleep(10 * time.Millisecond)
+	<-client1.Send
+	<-client2.Send
 
-	cancel()
-	wg.Wait()
+	hub.JoinRoom(client1, "room-123")
+	hub.JoinRoom(client2, "room-123")
+	<-client1.Send // drain peer-joined
 
-	// Send channel should be closed
-	_, ok := <-client.Send
-	if ok {
-		// Channel might have buffered messages, drain them
-		for range client.Send {
-		}
+	// Build up some negotiation state
+	hub.broadcast <- &SignalingMessage{Type: MsgTypeHandshakeVerify, From: client1.ID, RoomID: "room-123"}
+	hub.broadcast <- &SignalingMessage{Type: MsgTypeOffer, From: client1.ID, RoomID: "room-123"}
+	hub.broadcast <- &SignalingMessage{Type: MsgTypeAnswer, From: client2.ID, To: client1.ID}
+	time.Sleep(10 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		<-client2.Send
 	}
-}
-
-func TestWebSocketIntegration(t *testing.T) {
-	hub := NewHub()
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	<-client1.Send
 
-	go hub.Run(ctx)
+	hub.mu.RLock()
+	room := hub.rooms["room-123"]
+	hub.mu.RUnlock()
 
-	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		serveWs(hub, w, r)
-	}))
-	defer server.Close()
+	room.mu.RLock()
+	if room.negotiation.offerFrom != client1.ID || !room.negotiation.answered || !room.negotiation.verified[client1.ID] {
+		t.Fatalf("Negotiation state not tracked: %+v", room.negotiation)
+	}
+	room.mu.RUnlock()
 
-	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+	hub.ResetRoom(client2, "")
 
-	ws, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
-	if err != nil {
-		t.Fatalf("Failed to connect: %v", err)
+	room.mu.RLock()
+	if room.negotiation.offerFrom != "" || room.negotiation.answered || len(room.negotiation.verified) != 0 {
+		t.Errorf("Negotiation state not cleared: %+v", room.negotiation)
 	}
-	defer ws.Close()
-
-	// Should receive connected message
-	var msg SignalingMessage
-	if err := ws.ReadJSON(&msg); err != nil {
-		t.Fatalf("Failed to read: %v", err)
+	if len(room.Clients) != 2 {
+		t.Errorf("Expected membership intact, got %d clients", len(room.Clients))
 	}
+	room.mu.RUnlock()
 
-	if msg.Type != MsgTypeConnected {
-		t.Errorf("Expected connected, got %v", msg.Type)
-	}
-	if msg.ClientID == "" {
-		t.Error("ClientID should not be empty")
+	for _, c := range []*Client{client1, client2} {
+		select {
+		case msg := <-c.Send:
+			var sm SignalingMessage
+			json.Unmarshal(msg, &sm)
+			if sm.Type != MsgTypeResetRoom {
+				t.Errorf("%s: expected reset-room, got %v", c.ID, sm.Type)
+			}
+			if sm.ClientID != client2.ID {
+				t.Errorf("%s: expected clientId client-2, got %v", c.ID, sm.ClientID)
+			}
+		case <-time.After(100 * time.Millisecond):
+			t.Errorf("%s: no reset-room notification", c.ID)
+		}
 	}
 }
 
-func TestWebSocket_JoinRoom(t *testing.T) {
+func TestHub_RetriesOfferOnFullBuffer(t *testing.T) {
 	hub := NewHub()
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	go hub.Run(ctx)
 
-	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		serveWs(hub, w, r)
-	}))
-	defer server.Close()
+	client1 := &Client{ID: "client-1", Hub: hub, Send: make(chan []byte, 256)}
+	client2 := &Client{ID: "client-2", Hub: hub, Send: make(chan []byte, 1)}
 
-	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+	hub.register <- client1
+	hub.register <- client2
+	time.Sleep(10 * time.Millisecond)
+	<-client1.Send
+	<-client2.Send
 
-	ws, _, _ := websocket.DefaultDialer.Dial(wsURL, nil)
-	defer ws.Close()
+	hub.JoinRoom(client1, "room-123")
+	hub.JoinRoom(client2, "room-123")
+	<-client1.Send // drain peer-joined
 
-	// Drain connected message
-	var msg SignalingMessage
-	ws.ReadJSON(&msg)
+	// client2's buffer is full while both messages arrive
+	client2.Send <- []byte(`{"type":"filler"}`)
+	hub.broadcast <- &SignalingMessage{Type: MsgTypeICECandidate, From: client1.ID, RoomID: "room-123"}
+	hub.broadcast <- &SignalingMessage{Type: MsgTypeOffer, From: client1.ID, RoomID: "room-123"}
+	time.Sleep(2 * time.Millisecond)
 
-	// Join room
-	joinMsg := SignalingMessage{
-		Type:   MsgTypeHandshakeInit,
-		RoomID: "test-room",
+	// The buffer drains before the retries run out
+	<-client2.Send
+	select {
+	case data := <-client2.Send:
+		var sm SignalingMessage
+		json.Unmarshal(data, &sm)
+		if sm.Type != MsgTypeOffer {
+			t.Errorf("Expected the retried offer, got %v", sm.Type)
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("Offer not delivered after the buffer drained")
 	}
-	ws.WriteJSON(joinMsg)
 
-	time.Sleep(50 * time.Millisecond)
+	// ICE candidates aren't worth retrying
+	select {
+	case data := <-client2.Send:
+		t.Errorf("Unexpected message: %s", data)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
 
-	hub.mu.RLock()
-	_, exists := hub.rooms["test-room"]
-	hub.mu.RUnlock()
+func TestClient_BackpressureHint(t *testing.T) {
+	client := &Client{ID: "slow", Send: make(chan []byte, 8)}
+	msg := []byte(`{"type":"ice-candidate"}`)
+
+	hints := func() []BackpressurePayload {
+		var found []BackpressurePayload
+		for n := len(client.Send); n > 0; n-- {
+			var sm SignalingMessage
+			json.Unmarshal(<-client.Send, &sm)
+			if sm.Type == MsgTypeBackpressure {
+				var p BackpressurePayload
+				json.Unmarshal(sm.Payload, &p)
+				found = append(found, p)
+			}
+		}
+		return found
+	}
 
-	if !exists {
-		t.Error("Room should be created after handshake-init")
+	// A client that stops reading fills up, then loses messages
+	for i := 0; i < 10; i++ {
+		client.enqueue(msg)
+	}
+	got := hints()
+	if len(got) != 1 || got[0].DelayMs != backpressureBaseDelay.Milliseconds() {
+		t.Fatalf("Expected one hint at the high-water mark, got %+v", got)
+	}
+	if dropped := client.stats.dropped.Load(); dropped != 3 {
+		t.Errorf("Expected 3 dropped messages, got %d", dropped)
+	}
+
+	// Still slow after the interval: the hint asks for longer, scaled by
+	// the drops since the last one
+	for i := 0; i < 8; i++ {
+		client.enqueue(msg)
+	}
+	if got := hints(); len(got) != 0 {
+		t.Errorf("Hinted again within the interval: %+v", got)
+	}
+	client.sendMu.Lock()
+	client.lastBackpressure = time.Now().Add(-backpressureInterval)
+	client.sendMu.Unlock()
+	for i := 0; i < 6; i++ {
+		client.enqueue(msg)
+	}
+	got = hints()
+	if len(got) != 1 || got[0].DelayMs != (backpressureBaseDelay<<3).Milliseconds() {
+		t.Errorf("Expected a longer delay after drops, got %+v", got)
+	}
+}
+
+func TestClient_ValidateSDP(t *testing.T) {
+	malformed, _ := json.Marshal(map[string]string{"type": "offer", "sdp": "v=0\r\ns=-\r\n"})
+	valid, _ := json.Marshal(map[string]string{"type": "offer", "sdp": testSDP})
+
+	tests := []struct {
+		name      string
+		enabled   bool
+		payload   json.RawMessage
+		forwarded bool
+	}{
+		{"valid SDP", true, valid, true},
+		{"malformed SDP", true, malformed, false},
+		{"validation disabled", false, malformed, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hub := NewHub()
+			hub.validateSDP = tt.enabled
+			client := &Client{ID: "client-1", Hub: hub, Send: make(chan []byte, 256)}
+			hub.clients[client.ID] = client
+			hub.JoinRoom(client, "room-123")
+
+			data, _ := json.Marshal(SignalingMessage{Type: MsgTypeOffer, RoomID: "room-123", Payload: tt.payload})
+			client.handleMessage(data)
+
+			if forwarded := len(hub.priority) == 1; forwarded != tt.forwarded {
+				t.Errorf("Forwarded = %v, want %v", forwarded, tt.forwarded)
+			}
+			got := client.lastError.Load()
+			if tt.forwarded && got != nil {
+				t.Errorf("Unexpected error: %+v", got)
+			}
+			if !tt.forwarded && (got == nil || got.Code != ErrCodeInvalidSDP) {
+				t.Errorf("Expected %s, got %+v", ErrCodeInvalidSDP, got)
+			}
+		})
+	}
+}
+
+func TestClient_StrictFrom(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		hub := NewHub()
+		hub.strictFrom = strict
+		client := &Client{ID: "client-1", Hub: hub, Send: make(chan []byte, 256)}
+		hub.clients[client.ID] = client
+		hub.JoinRoom(client, "room-123")
+
+		// Naming yourself is always fine
+		data, _ := json.Marshal(SignalingMessage{Type: MsgTypeOffer, From: client.ID, RoomID: "room-123"})
+		client.handleMessage(data)
+		<-hub.priority
+
+		data, _ = json.Marshal(SignalingMessage{Type: MsgTypeOffer, From: "client-2", RoomID: "room-123"})
+		client.handleMessage(data)
+
+		if strict {
+			if len(hub.priority) != 0 {
+				t.Error("Strict mode forwarded a spoofed message")
+			}
+			if got := client.lastError.Load(); got == nil || got.Code != ErrCodeInvalidMessage {
+				t.Errorf("Expected %s, got %+v", ErrCodeInvalidMessage, got)
+			}
+			continue
+		}
+		if len(hub.priority) != 1 {
+			t.Fatal("Lenient mode should forward the message")
+		}
+		if msg := <-hub.priority; msg.From != client.ID {
+			t.Errorf("From = %q, want it corrected to %q", msg.From, client.ID)
+		}
+		if got := client.lastError.Load(); got != nil {
+			t.Errorf("Lenient mode sent an error: %+v", got)
+		}
+	}
+}
+
+func TestHub_PriorityMessagesFirst(t *testing.T) {
+	hub := NewHub()
+	sender := &Client{ID: "sender", Hub: hub, Send: make(chan []byte, 256)}
+	receiver := &Client{ID: "receiver", Hub: hub, Send: make(chan []byte, 256)}
+	hub.clients[sender.ID] = sender
+	hub.clients[receiver.ID] = receiver
+	hub.JoinRoom(sender, "room-123")
+	hub.JoinRoom(receiver, "room-123")
+	for len(sender.Send) > 0 {
+		<-sender.Send // drain peer-joined
+	}
+
+	// Queue a backlog of candidates, then an answer, before the hub runs
+	for i := 0; i < 20; i++ {
+		data, _ := json.Marshal(SignalingMessage{Type: MsgTypeICECandidate, RoomID: "room-123"})
+		receiver.handleMessage(data)
+	}
+	data, _ := json.Marshal(SignalingMessage{Type: MsgTypeAnswer, RoomID: "room-123"})
+	receiver.handleMessage(data)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go hub.Run(ctx)
+
+	select {
+	case msg := <-sender.Send:
+		var sm SignalingMessage
+		json.Unmarshal(msg, &sm)
+		if sm.Type != MsgTypeAnswer {
+			t.Errorf("Expected the answer first, got %v", sm.Type)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Nothing relayed")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if n := len(sender.Send); n != 20 {
+		t.Errorf("Expected the 20 candidates after the answer, got %d", n)
+	}
+}
+
+func TestHub_CancelOffer(t *testing.T) {
+	hub := NewHub()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go hub.Run(ctx)
+
+	client1 := &Client{ID: "client-1", Hub: hub, Send: make(chan []byte, 256)}
+	client2 := &Client{ID: "client-2", Hub: hub, Send: make(chan []byte, 256)}
+
+	hub.register <- client1
+	hub.register <- client2
+	time.Sleep(10 * time.Millisecond)
+	<-client1.Send
+	<-client2.Send
+
+	hub.JoinRoom(client1, "room-123")
+	hub.JoinRoom(client2, "room-123")
+	<-client1.Send // drain peer-joined
+
+	hub.broadcast <- &SignalingMessage{Type: MsgTypeHandshakeVerify, From: client1.ID, RoomID: "room-123"}
+	hub.broadcast <- &SignalingMessage{Type: MsgTypeOffer, From: client1.ID, RoomID: "room-123"}
+	hub.broadcast <- &SignalingMessage{Type: MsgTypeICECandidate, From: client1.ID, RoomID: "room-123"}
+	time.Sleep(10 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		<-client2.Send
+	}
+
+	// Only the offerer can retract the offer
+	hub.broadcast <- &SignalingMessage{Type: MsgTypeCancelOffer, From: client2.ID, RoomID: "room-123"}
+	time.Sleep(10 * time.Millisecond)
+	<-client1.Send
+
+	hub.mu.RLock()
+	room := hub.rooms["room-123"]
+	hub.mu.RUnlock()
+
+	room.mu.RLock()
+	if room.negotiation.offerFrom != client1.ID {
+		t.Errorf("Peer's cancel should not clear the offer: %+v", room.negotiation)
+	}
+	room.mu.RUnlock()
+
+	hub.broadcast <- &SignalingMessage{Type: MsgTypeCancelOffer, From: client1.ID, RoomID: "room-123"}
+	select {
+	case msg := <-client2.Send:
+		var sm SignalingMessage
+		json.Unmarshal(msg, &sm)
+		if sm.Type != MsgTypeCancelOffer || sm.From != client1.ID {
+			t.Errorf("Expected cancel-offer from client-1, got %v from %v", sm.Type, sm.From)
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("cancel-offer not forwarded")
+	}
+
+	room.mu.RLock()
+	if room.negotiation.offerFrom != "" || !room.negotiation.offerAt.IsZero() || room.negotiation.ice != 0 {
+		t.Errorf("Offer state not cleared: %+v", room.negotiation)
+	}
+	if !room.negotiation.verified[client1.ID] {
+		t.Error("Cancelling an offer should keep handshake verification")
+	}
+	room.mu.RUnlock()
+}
+
+func TestHub_ICECandidateFilter(t *testing.T) {
+	hub := NewHub()
+	hub.iceFilter = candidateFilter{allow: []netip.Prefix{netip.MustParsePrefix("192.168.0.0/16")}}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go hub.Run(ctx)
+
+	client1 := &Client{ID: "client-1", Hub: hub, Send: make(chan []byte, 256)}
+	client2 := &Client{ID: "client-2", Hub: hub, Send: make(chan []byte, 256)}
+
+	hub.register <- client1
+	hub.register <- client2
+	time.Sleep(10 * time.Millisecond)
+	<-client1.Send
+	<-client2.Send
+
+	hub.JoinRoom(client1, "room-123")
+	hub.JoinRoom(client2, "room-123")
+	<-client1.Send // drain peer-joined
+
+	outside := candidatePayload("candidate:2 1 udp 1686052607 203.0.113.5 61000 typ srflx")
+	inside := candidatePayload("candidate:1 1 udp 2122260223 192.168.1.20 54321 typ host")
+	hub.broadcast <- &SignalingMessage{Type: MsgTypeICECandidate, From: client1.ID, RoomID: "room-123", Payload: outside}
+	hub.broadcast <- &SignalingMessage{Type: MsgTypeICECandidate, From: client1.ID, RoomID: "room-123", Payload: inside}
+	time.Sleep(20 * time.Millisecond)
+
+	if n := len(client2.Send); n != 1 {
+		t.Fatalf("Expected only the in-range candidate, got %d messages", n)
+	}
+	var sm SignalingMessage
+	json.Unmarshal(<-client2.Send, &sm)
+	if string(sm.Payload) != string(inside) {
+		t.Errorf("Unexpected candidate relayed: %s", sm.Payload)
+	}
+}
+
+func TestHub_ICECandidateLimit(t *testing.T) {
+	hub := NewHub()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go hub.Run(ctx)
+
+	client1 := &Client{ID: "client-1", Hub: hub, Send: make(chan []byte, 256)}
+	client2 := &Client{ID: "client-2", Hub: hub, Send: make(chan []byte, 256)}
+
+	hub.register <- client1
+	hub.register <- client2
+	time.Sleep(10 * time.Millisecond)
+	<-client1.Send
+	<-client2.Send
+
+	hub.JoinRoom(client1, "room-123")
+	hub.JoinRoom(client2, "room-123")
+	<-client1.Send // drain peer-joined
+
+	for i := 0; i < maxICECandidates+10; i++ {
+		hub.broadcast <- &SignalingMessage{Type: MsgTypeICECandidate, From: client1.ID, RoomID: "room-123"}
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	if got := len(client2.Send); got != maxICECandidates {
+		t.Errorf("Peer received %d candidates, want %d", got, maxICECandidates)
+	}
+	for len(client2.Send) > 0 {
+		<-client2.Send
+	}
+
+	// Sender is warned exactly once
+	if got := len(client1.Send); got != 1 {
+		t.Fatalf("Sender received %d messages, want 1 warning", got)
+	}
+	var sm SignalingMessage
+	json.Unmarshal(<-client1.Send, &sm)
+	if sm.Type != MsgTypeError {
+		t.Errorf("Expected error, got %v", sm.Type)
+	}
+
+	// A renegotiation resets the cap
+	hub.broadcast <- &SignalingMessage{Type: MsgTypeOffer, From: client1.ID, RoomID: "room-123"}
+	hub.broadcast <- &SignalingMessage{Type: MsgTypeICECandidate, From: client1.ID, RoomID: "room-123"}
+	time.Sleep(10 * time.Millisecond)
+
+	if got := len(client2.Send); got != 2 {
+		t.Errorf("Expected offer and candidate after renegotiation, got %d messages", got)
+	}
+}
+
+func TestHub_ICECandidateWindow(t *testing.T) {
+	hub := NewHub()
+	hub.iceCandidateWindow = 50 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go hub.Run(ctx)
+
+	client1 := &Client{ID: "client-1", Hub: hub, Send: make(chan []byte, 256)}
+	client2 := &Client{ID: "client-2", Hub: hub, Send: make(chan []byte, 256)}
+
+	hub.register <- client1
+	hub.register <- client2
+	time.Sleep(10 * time.Millisecond)
+	<-client1.Send
+	<-client2.Send
+
+	hub.JoinRoom(client1, "room-123")
+	hub.JoinRoom(client2, "room-123")
+	<-client1.Send // drain peer-joined
+
+	hub.broadcast <- &SignalingMessage{Type: MsgTypeOffer, From: client1.ID, RoomID: "room-123"}
+	hub.broadcast <- &SignalingMessage{Type: MsgTypeICECandidate, From: client1.ID, RoomID: "room-123"}
+	time.Sleep(10 * time.Millisecond)
+
+	var sm SignalingMessage
+	json.Unmarshal(<-client2.Send, &sm)
+	if sm.Type != MsgTypeOffer {
+		t.Fatalf("Expected offer, got %v", sm.Type)
+	}
+	json.Unmarshal(<-client2.Send, &sm)
+	if sm.Type != MsgTypeICECandidate || sm.ServerTime == 0 {
+		t.Errorf("Expected timestamped candidate within the window, got %v at %d", sm.Type, sm.ServerTime)
+	}
+
+	// Past the window, candidates are dropped without warning the sender
+	time.Sleep(60 * time.Millisecond)
+	hub.broadcast <- &SignalingMessage{Type: MsgTypeICECandidate, From: client1.ID, RoomID: "room-123"}
+	time.Sleep(10 * time.Millisecond)
+
+	if got := len(client2.Send); got != 0 {
+		t.Errorf("Late candidate was relayed (%d messages)", got)
+	}
+	if got := len(client1.Send); got != 0 {
+		t.Errorf("Sender got %d messages for a late candidate, want none", got)
+	}
+}
+
+func TestHub_StuckRoomDetection(t *testing.T) {
+	hub := NewHub()
+	hub.stuckRoomTimeout = time.Minute
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go hub.Run(ctx)
+
+	client1 := &Client{ID: "client-1", Hub: hub, Send: make(chan []byte, 256)}
+	client2 := &Client{ID: "client-2", Hub: hub, Send: make(chan []byte, 256)}
+
+	hub.register <- client1
+	hub.register <- client2
+	time.Sleep(10 * time.Millisecond)
+	<-client1.Send
+	<-client2.Send
+
+	hub.JoinRoom(client1, "room-123")
+	hub.JoinRoom(client2, "room-123")
+	<-client1.Send // drain peer-joined
+
+	// Silent for less than the timeout: nothing happens
+	hub.expireRooms(time.Now().Add(30 * time.Second))
+	if len(client1.Send) != 0 || len(client2.Send) != 0 {
+		t.Fatal("Room flagged as stuck before the timeout")
+	}
+
+	// Silent past the timeout: both members are hinted once, room is kept
+	hub.expireRooms(time.Now().Add(2 * time.Minute))
+	hub.expireRooms(time.Now().Add(3 * time.Minute))
+	for _, c := range []*Client{client1, client2} {
+		if got := len(c.Send); got != 1 {
+			t.Fatalf("%s received %d messages, want 1 stuck hint", c.ID, got)
+		}
+		var sm SignalingMessage
+		json.Unmarshal(<-c.Send, &sm)
+		if sm.Type != MsgTypeStuck || sm.RoomID != "room-123" {
+			t.Errorf("%s: expected stuck for room-123, got %v %v", c.ID, sm.Type, sm.RoomID)
+		}
+	}
+	if !hub.inRoom(client1, "room-123") {
+		t.Fatal("Stuck room should be kept unless expiry is enabled")
+	}
+
+	// With expiry enabled the stuck room is deleted
+	hub.expireStuckRooms = true
+	hub.expireRooms(time.Now().Add(2 * time.Minute))
+	if hub.inRoom(client1, "room-123") {
+		t.Error("Stuck room should have been expired")
+	}
+}
+
+func TestHub_RoomStateResync(t *testing.T) {
+	hub := NewHub()
+	hub.roomStateInterval = 20 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go hub.Run(ctx)
+
+	client1 := &Client{ID: "client-1", Hub: hub, Send: make(chan []byte, 256)}
+	client2 := &Client{ID: "client-2", Hub: hub, Send: make(chan []byte, 256)}
+
+	hub.register <- client1
+	hub.register <- client2
+	time.Sleep(10 * time.Millisecond)
+	<-client1.Send
+	<-client2.Send
+
+	hub.JoinRoom(client1, "room-123")
+	hub.JoinRoom(client2, "room-123")
+
+	received := 0
+	deadline := time.After(200 * time.Millisecond)
+	for received < 2 {
+		select {
+		case msg := <-client2.Send:
+			var sm SignalingMessage
+			json.Unmarshal(msg, &sm)
+			if sm.Type != MsgTypeRoomState {
+				continue
+			}
+			var state RoomStatePayload
+			if err := json.Unmarshal(sm.Payload, &state); err != nil {
+				t.Fatalf("Failed to unmarshal payload: %v", err)
+			}
+			if len(state.Peers) != 2 || state.Peers[0] != "client-1" || state.Peers[1] != "client-2" {
+				t.Errorf("Unexpected peers: %v", state.Peers)
+			}
+			if state.RemainingTTLSeconds <= 0 {
+				t.Errorf("Expected remaining TTL, got %d", state.RemainingTTLSeconds)
+			}
+			received++
+		case <-deadline:
+			t.Fatalf("Expected periodic room-state, got %d", received)
+		}
+	}
+}
+
+func TestHub_JoinedRemainingTTL(t *testing.T) {
+	hub := NewHub()
+	client := &Client{ID: "client-1", Hub: hub, Send: make(chan []byte, 256)}
+	hub.clients[client.ID] = client
+	hub.JoinRoom(client, "room-123")
+
+	client.sendJoined("room-123")
+	var sm SignalingMessage
+	json.Unmarshal(<-client.Send, &sm)
+	var joined JoinedPayload
+	if err := json.Unmarshal(sm.Payload, &joined); err != nil {
+		t.Fatalf("Failed to unmarshal payload: %v", err)
+	}
+	if joined.RemainingTTLSeconds <= 0 || joined.RemainingTTLSeconds > int(roomExpiryDuration.Seconds()) {
+		t.Errorf("Unexpected remaining TTL: %d", joined.RemainingTTLSeconds)
+	}
+
+	later := hub.joinedPayload(client, "room-123", time.Now().Add(time.Minute))
+	if later.RemainingTTLSeconds >= joined.RemainingTTLSeconds {
+		t.Errorf("Remaining TTL should decrease: %d then %d", joined.RemainingTTLSeconds, later.RemainingTTLSeconds)
+	}
+	past := hub.joinedPayload(client, "room-123", time.Now().Add(2*roomExpiryDuration))
+	if past.RemainingTTLSeconds != 0 {
+		t.Errorf("Remaining TTL should not go negative, got %d", past.RemainingTTLSeconds)
+	}
+}
+
+func TestHub_ExtendRoom(t *testing.T) {
+	hub := NewHub()
+	hub.maxRoomLifetime = 40 * time.Minute
+	client := &Client{ID: "client-1", Hub: hub, Send: make(chan []byte, 256)}
+	hub.clients[client.ID] = client
+	hub.JoinRoom(client, "room-123")
+
+	// The room is nearly idle-expired when the extension comes in
+	now := time.Now()
+	room := hub.rooms["room-123"]
+	room.CreatedAt = now.Add(-9 * time.Minute)
+	room.LastActivity = now.Add(-9 * time.Minute)
+
+	hub.ExtendRoom(client, "", 20*time.Minute, now)
+	var sm SignalingMessage
+	json.Unmarshal(<-client.Send, &sm)
+	var granted ExtendRoomPayload
+	json.Unmarshal(sm.Payload, &granted)
+	if sm.Type != MsgTypeExtendRoom || granted.RemainingTTLSeconds != 20*60 {
+		t.Errorf("Unexpected extension reply: %v %+v", sm.Type, granted)
+	}
+
+	hub.expireRooms(now.Add(15 * time.Minute))
+	if _, ok := hub.rooms["room-123"]; !ok {
+		t.Fatal("Extended room expired early")
+	}
+
+	// Asking for more than the lifetime cap allows is clamped to it...
+	hub.ExtendRoom(client, "room-123", time.Hour, now)
+	json.Unmarshal(<-client.Send, &sm)
+	json.Unmarshal(sm.Payload, &granted)
+	if want := 31 * 60; granted.RemainingTTLSeconds != want {
+		t.Errorf("Remaining TTL = %d, want %d (clamped to lifetime)", granted.RemainingTTLSeconds, want)
+	}
+
+	// ...and once there, further extensions are refused
+	hub.ExtendRoom(client, "room-123", time.Hour, now.Add(time.Minute))
+	if got := client.lastError.Load(); got == nil || got.Code != ErrCodeExtensionLimit {
+		t.Errorf("Expected %s, got %+v", ErrCodeExtensionLimit, got)
+	}
+
+	hub.expireRooms(now.Add(32 * time.Minute))
+	if _, ok := hub.rooms["room-123"]; ok {
+		t.Error("Room should expire at the lifetime cap")
+	}
+}
+
+func TestHub_ConcurrentJoinAndExpiry(t *testing.T) {
+	hub := NewHub()
+
+	clients := make([]*Client, 20)
+	for i := range clients {
+		clients[i] = &Client{ID: fmt.Sprintf("client-%d", i), Hub: hub, Send: make(chan []byte, 1024)}
+		hub.clients[clients[i].ID] = clients[i]
+	}
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+
+	// Expire everything as fast as possible
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				hub.expireRooms(time.Now().Add(roomExpiryDuration + time.Second))
+			}
+		}
+	}()
+
+	for i, c := range clients {
+		wg.Add(1)
+		go func(i int, c *Client) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				hub.JoinRoom(c, fmt.Sprintf("room-%d", (i+j)%5))
+				hub.roomOf(c) // Concurrent read, as ReadPump does
+			}
+		}(i, c)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+
+	hub.mu.RLock()
+	defer hub.mu.RUnlock()
+	for _, c := range clients {
+		if c.RoomID == "" {
+			continue
+		}
+		room, ok := hub.rooms[c.RoomID]
+		if !ok {
+			t.Errorf("%s points at deleted room %s", c.ID, c.RoomID)
+			continue
+		}
+		if room.Clients[c.ID] != c {
+			t.Errorf("%s points at room %s that doesn't contain it", c.ID, c.RoomID)
+		}
+	}
+	for id, room := range hub.rooms {
+		for cid, c := range room.Clients {
+			if c.RoomID != id {
+				t.Errorf("Room %s lists %s, which points at %q", id, cid, c.RoomID)
+			}
+		}
+	}
+}
+
+func TestHub_KeepaliveHoldsRoomOpen(t *testing.T) {
+	hub := NewHub()
+	active := &Client{ID: "active", Hub: hub, Send: make(chan []byte, 256)}
+	quiet := &Client{ID: "quiet", Hub: hub, Send: make(chan []byte, 256)}
+	hub.clients[active.ID] = active
+	hub.clients[quiet.ID] = quiet
+
+	hub.JoinRoom(active, "room-active")
+	hub.JoinRoom(quiet, "room-quiet")
+
+	// Both rooms have been around, silent, for longer than the expiry window
+	past := time.Now().Add(-roomExpiryDuration - time.Minute)
+	for _, id := range []string{"room-active", "room-quiet"} {
+		hub.rooms[id].CreatedAt = past
+		hub.rooms[id].LastActivity = past
+	}
+
+	hub.Keepalive(active, "")
+	if len(active.Send) != 0 {
+		t.Fatal("Keepalive should not send anything back")
+	}
+	hub.expireRooms(time.Now())
+
+	if !hub.inRoom(active, "room-active") {
+		t.Error("Room kept alive should survive past the expiry window")
+	}
+	if hub.inRoom(quiet, "room-quiet") {
+		t.Error("Room without keepalives should expire")
+	}
+
+	// Outside a room, a keepalive is an error
+	hub.Keepalive(quiet, "")
+	var sm SignalingMessage
+	json.Unmarshal(<-quiet.Send, &sm) // room-expired
+	json.Unmarshal(<-quiet.Send, &sm)
+	if sm.Type != MsgTypeError {
+		t.Errorf("Expected error for keepalive outside a room, got %v", sm.Type)
+	}
+}
+
+func TestHub_RelayedMessagesKeepRoomAlive(t *testing.T) {
+	hub := NewHub()
+	alice := &Client{ID: "alice", Hub: hub, Send: make(chan []byte, 256)}
+	bob := &Client{ID: "bob", Hub: hub, Send: make(chan []byte, 256)}
+	hub.clients[alice.ID] = alice
+	hub.clients[bob.ID] = bob
+	hub.JoinRoom(alice, "room-123")
+	hub.JoinRoom(bob, "room-123")
+
+	// A long transfer: the room was created well over the expiry window
+	// ago, but its members were signaling until just before it would go idle
+	room := hub.rooms["room-123"]
+	room.CreatedAt = time.Now().Add(-3 * roomExpiryDuration)
+	room.LastActivity = time.Now().Add(-roomExpiryDuration + time.Second)
+
+	hub.handleBroadcast(&SignalingMessage{Type: MsgTypeOffer, From: alice.ID, RoomID: "room-123"})
+	now := time.Now()
+	hub.expireRooms(now.Add(roomExpiryDuration / 2))
+	if !hub.inRoom(alice, "room-123") {
+		t.Fatal("Room with recent traffic should survive past the expiry window")
+	}
+
+	// Once the members go quiet the room is reaped a full window later
+	hub.expireRooms(now.Add(roomExpiryDuration + time.Second))
+	if hub.inRoom(alice, "room-123") || hub.inRoom(bob, "room-123") {
+		t.Error("Room should expire once it has been idle for the expiry window")
+	}
+}
+
+func TestHub_RoomExpiredWithFullBuffer(t *testing.T) {
+	setup := func() (*Hub, *Client, *memConn) {
+		hub := NewHub()
+		conn := newMemConn()
+		client := &Client{ID: "slow", Hub: hub, Conn: conn, Send: make(chan []byte, 1)}
+		hub.clients[client.ID] = client
+		hub.JoinRoom(client, "room-123")
+		for len(client.Send) > 0 {
+			<-client.Send
+		}
+		client.Send <- []byte(`{"type":"offer"}`) // Buffer full
+		return hub, client, conn
+	}
+	expire := func(hub *Hub) {
+		hub.mu.Lock()
+		hub.expireRoom(hub.rooms["room-123"], time.Now(), "expired")
+		hub.mu.Unlock()
+	}
+
+	t.Run("informed once the buffer drains", func(t *testing.T) {
+		hub, client, conn := setup()
+		expire(hub)
+		time.Sleep(sendRetryBackoff)
+		<-client.Send // The client catches up a little
+
+		var sm SignalingMessage
+		select {
+		case data := <-client.Send:
+			json.Unmarshal(data, &sm)
+		case <-time.After(time.Second):
+			t.Fatal("room-expired never queued")
+		}
+		if sm.Type != MsgTypeRoomExpired {
+			t.Errorf("Expected room-expired, got %v", sm.Type)
+		}
+		select {
+		case <-conn.done:
+			t.Error("Client informed of expiry should stay connected")
+		default:
+		}
+	})
+
+	t.Run("closed when it stays full", func(t *testing.T) {
+		hub, _, conn := setup()
+		expire(hub)
+		select {
+		case <-conn.done:
+		case <-time.After(time.Second):
+			t.Fatal("Client that can't be told of expiry was not closed")
+		}
+	})
+}
+
+func TestHub_RoomTTL(t *testing.T) {
+	hub := NewHub()
+	hub.maxRoomTTL = 5 * time.Minute
+	join := func(id, roomID string, ttl time.Duration) {
+		c := &Client{ID: id, Hub: hub, Send: make(chan []byte, 256)}
+		hub.clients[c.ID] = c
+		if err := hub.JoinRoomWith(c, roomID, JoinOptions{TTL: ttl}); err != nil {
+			t.Fatalf("Join %s failed: %v", roomID, err)
+		}
+	}
+	join("client-1", "short", 90*time.Second)
+	join("client-2", "default", 0)
+	join("client-3", "greedy", 24*time.Hour)
+
+	if ttl := hub.rooms["greedy"].TTL; ttl != hub.maxRoomTTL {
+		t.Errorf("Requested TTL clamped to %v, want %v", ttl, hub.maxRoomTTL)
+	}
+
+	// A TTL expiry can't honour between cleanup ticks is refused
+	tiny := &Client{ID: "client-4", Hub: hub, Send: make(chan []byte, 256)}
+	hub.clients[tiny.ID] = tiny
+	if err := hub.JoinRoomWith(tiny, "tiny", JoinOptions{TTL: 10 * time.Second}); err != errRoomTTLTooShort {
+		t.Errorf("Expected TTL too short error, got %v", err)
+	}
+	if _, ok := hub.rooms["tiny"]; ok {
+		t.Error("Room with too short a TTL should not be created")
+	}
+
+	hub.expireRooms(time.Now().Add(2 * time.Minute))
+	if _, ok := hub.rooms["short"]; ok {
+		t.Error("Room with a 90s TTL should expire after two minutes idle")
+	}
+	if _, ok := hub.rooms["default"]; !ok {
+		t.Error("Room with the default TTL should outlive a custom short one")
+	}
+
+	hub.expireRooms(time.Now().Add(hub.maxRoomTTL + time.Second))
+	if _, ok := hub.rooms["greedy"]; ok {
+		t.Error("Room with a clamped TTL should expire at MAX_ROOM_TTL")
+	}
+
+	hub.expireRooms(time.Now().Add(roomExpiryDuration + time.Second))
+	if _, ok := hub.rooms["default"]; ok {
+		t.Error("Room with the default TTL should expire after roomExpiryDuration")
+	}
+}
+
+func TestHub_JoinRoomRequiresID(t *testing.T) {
+	hub := NewHub()
+	client := &Client{ID: "client-1", Hub: hub, Send: make(chan []byte, 256)}
+	hub.clients[client.ID] = client
+
+	tests := []struct {
+		roomID string
+		want   error
+	}{
+		{"", errRoomIDRequired},
+		{"   ", errInvalidRoomID},
+		{"room 123", errInvalidRoomID},
+		{"room-123\n", errInvalidRoomID},
+		{strings.Repeat("r", maxClientIDLen+1), errInvalidRoomID},
+	}
+	for _, tt := range tests {
+		if err := hub.JoinRoom(client, tt.roomID); err != tt.want {
+			t.Errorf("JoinRoom(%q) = %v, want %v", tt.roomID, err, tt.want)
+		}
+	}
+	if len(hub.rooms) != 0 {
+		t.Errorf("No room should be created, got %d", len(hub.rooms))
+	}
+	if len(client.Rooms) != 0 || client.RoomID != "" || client.Joined {
+		t.Errorf("Client state changed: rooms %v, roomId %q", client.Rooms, client.RoomID)
+	}
+	if len(client.Send) != 0 {
+		t.Error("Nothing should be sent for a rejected join")
+	}
+
+	if err := hub.JoinRoom(client, strings.Repeat("r", maxClientIDLen)); err != nil {
+		t.Errorf("Room ID at the length limit rejected: %v", err)
+	}
+}
+
+func TestHub_RejoinExpiredRoom(t *testing.T) {
+	hub := NewHub()
+	client := &Client{ID: "client-1", Hub: hub, Send: make(chan []byte, 256)}
+	hub.clients[client.ID] = client
+
+	hub.JoinRoom(client, "room-123")
+	hub.expireRooms(time.Now().Add(roomExpiryDuration + time.Second))
+	<-client.Send // drain room-expired
+
+	err := hub.JoinRoom(client, "room-123")
+	var expired *roomExpiredError
+	if !errors.As(err, &expired) || expired.reason != "expired" {
+		t.Fatalf("Expected expired error on rejoin, got %v", err)
+	}
+	if hub.inRoom(client, "room-123") {
+		t.Error("Expired room should not be recreated")
+	}
+
+	// Rooms deleted for being empty can be rejoined, e.g. after a reconnect
+	hub.JoinRoom(client, "room-456")
+	hub.LeaveRoom(client, "room-456")
+	if err := hub.JoinRoom(client, "room-456"); err != nil {
+		t.Errorf("Rejoining an emptied room failed: %v", err)
+	}
+}
+
+func TestHub_RoomFullPolicy(t *testing.T) {
+	setup := func(policy string) (*Hub, *Client, *Client, *Client) {
+		hub := NewHub()
+		hub.maxRoomClients = 2
+		hub.roomFullPolicy = policy
+
+		idle := &Client{ID: "idle", Hub: hub, Send: make(chan []byte, 256)}
+		active := &Client{ID: "active", Hub: hub, Send: make(chan []byte, 256)}
+		late := &Client{ID: "late", Hub: hub, Send: make(chan []byte, 256)}
+		for _, c := range []*Client{idle, active, late} {
+			hub.clients[c.ID] = c
+		}
+
+		hub.JoinRoom(idle, "room-123")
+		hub.JoinRoom(active, "room-123")
+		time.Sleep(time.Millisecond)
+		hub.handleBroadcast(&SignalingMessage{Type: MsgTypeOffer, From: active.ID, RoomID: "room-123"})
+		for _, c := range []*Client{idle, active} {
+			for len(c.Send) > 0 {
+				<-c.Send
+			}
+		}
+		return hub, idle, active, late
+	}
+
+	t.Run("reject", func(t *testing.T) {
+		hub, _, _, late := setup(RoomFullReject)
+		if err := hub.JoinRoom(late, "room-123"); err != errRoomFull {
+			t.Errorf("Expected room full error, got %v", err)
+		}
+		if hub.inRoom(late, "room-123") {
+			t.Error("Rejected client should not be in the room")
+		}
+	})
+
+	t.Run("observer", func(t *testing.T) {
+		hub, idle, active, late := setup(RoomFullObserver)
+		if err := hub.JoinRoom(late, "room-123"); err != nil {
+			t.Fatalf("Observer join failed: %v", err)
+		}
+		if !hub.isObserver(late, "room-123") {
+			t.Fatal("Late client should have joined as an observer")
+		}
+
+		// Observers receive room traffic but cannot send
+		hub.handleBroadcast(&SignalingMessage{Type: MsgTypeAnswer, From: idle.ID, RoomID: "room-123"})
+		var sm SignalingMessage
+		json.Unmarshal(<-late.Send, &sm)
+		if sm.Type != MsgTypeAnswer {
+			t.Errorf("Observer expected answer, got %v", sm.Type)
+		}
+		hub.handleBroadcast(&SignalingMessage{Type: MsgTypeOffer, From: late.ID, RoomID: "room-123"})
+		json.Unmarshal(<-late.Send, &sm)
+		if sm.Type != MsgTypeError {
+			t.Errorf("Observer send should be refused, got %v", sm.Type)
+		}
+		if len(active.Send) != 2 { // peer-joined and the answer only
+			t.Errorf("Active peer got %d messages, want 2", len(active.Send))
+		}
+	})
+
+	t.Run("bump", func(t *testing.T) {
+		hub, idle, active, late := setup(RoomFullBump)
+		if err := hub.JoinRoom(late, "room-123"); err != nil {
+			t.Fatalf("Join with bump failed: %v", err)
+		}
+		if hub.inRoom(idle, "room-123") {
+			t.Error("Longest-idle member should have been bumped")
+		}
+		if !hub.inRoom(active, "room-123") || !hub.inRoom(late, "room-123") {
+			t.Error("Active member and newcomer should both be in the room")
+		}
+		var sm SignalingMessage
+		json.Unmarshal(<-idle.Send, &sm)
+		if sm.Type != MsgTypeError {
+			t.Errorf("Bumped client expected an error, got %v", sm.Type)
+		}
+	})
+}
+
+func TestHub_RoomCapacity(t *testing.T) {
+	hub := NewHub()
+	clients := make([]*Client, 3)
+	for i := range clients {
+		clients[i] = &Client{ID: fmt.Sprintf("client-%d", i), Hub: hub, Send: make(chan []byte, 256)}
+		hub.clients[clients[i].ID] = clients[i]
+	}
+
+	for _, c := range clients[:2] {
+		c.completeJoin("room-123", JoinOptions{})
+	}
+	third := clients[2]
+	third.completeJoin("room-123", JoinOptions{})
+
+	room := hub.rooms["room-123"]
+	if room.MaxClients != defaultMaxRoomClients {
+		t.Errorf("MaxClients = %d, want %d", room.MaxClients, defaultMaxRoomClients)
+	}
+	if _, ok := room.Clients[third.ID]; ok {
+		t.Error("Third client should not be in room.Clients")
+	}
+	if len(room.Clients) != 2 {
+		t.Errorf("Room has %d clients, want 2", len(room.Clients))
+	}
+
+	var sm SignalingMessage
+	json.Unmarshal(<-third.Send, &sm)
+	if sm.Type != MsgTypeRoomFull || sm.RoomID != "room-123" {
+		t.Errorf("Expected room-full for room-123, got %v for %q", sm.Type, sm.RoomID)
+	}
+
+	// Turned away clients can still join somewhere else
+	if err := hub.JoinRoom(third, "room-456"); err != nil {
+		t.Errorf("Joining another room after room-full failed: %v", err)
+	}
+}
+
+func TestHub_RoomCreatedAck(t *testing.T) {
+	hub := NewHub()
+	first := &Client{ID: "first", Hub: hub, Send: make(chan []byte, 256)}
+	second := &Client{ID: "second", Hub: hub, Send: make(chan []byte, 256)}
+	hub.clients[first.ID] = first
+	hub.clients[second.ID] = second
+
+	first.completeJoin("room-123", JoinOptions{})
+	second.completeJoin("room-123", JoinOptions{})
+
+	check := func(c *Client, wantCreated bool, wantClients int) {
+		t.Helper()
+		var sm SignalingMessage
+		json.Unmarshal(<-c.Send, &sm)
+		if sm.Type != MsgTypeRoomCreated || sm.RoomID != "room-123" {
+			t.Fatalf("%s: expected room-created for room-123, got %v", c.ID, sm.Type)
+		}
+		var info RoomCreatedPayload
+		json.Unmarshal(sm.Payload, &info)
+		if info.Created != wantCreated || info.Clients != wantClients {
+			t.Errorf("%s: got %+v, want created=%v clients=%d", c.ID, info, wantCreated, wantClients)
+		}
+	}
+	check(first, true, 1)
+	check(second, false, 2)
+
+	// The first joiner still hears about the second as before
+	for {
+		var sm SignalingMessage
+		select {
+		case data := <-first.Send:
+			json.Unmarshal(data, &sm)
+		default:
+			t.Fatal("First joiner got no peer-joined")
+		}
+		if sm.Type == MsgTypePeerJoined {
+			break
+		}
+	}
+}
+
+func TestHub_RoomPassword(t *testing.T) {
+	prevCost := roomPasswordCost
+	roomPasswordCost = bcrypt.MinCost
+	defer func() { roomPasswordCost = prevCost }()
+
+	setup := func(password string) (*Hub, *Client) {
+		hub := NewHub()
+		hub.maxRoomClients = 0
+		creator := &Client{ID: "creator", Hub: hub, Send: make(chan []byte, 256)}
+		hub.clients[creator.ID] = creator
+		creator.completeJoin("room-123", JoinOptions{Password: password})
+		return hub, creator
+	}
+	join := func(hub *Hub, id, password string) *Client {
+		c := &Client{ID: id, Hub: hub, Send: make(chan []byte, 256)}
+		hub.clients[c.ID] = c
+		c.completeJoin("room-123", JoinOptions{Password: password})
+		return c
+	}
+
+	t.Run("correct password", func(t *testing.T) {
+		hub, _ := setup("hunter2")
+		if c := join(hub, "joiner", "hunter2"); !hub.inRoom(c, "room-123") {
+			t.Error("Joiner with the right password should be in the room")
+		}
+	})
+
+	t.Run("wrong password", func(t *testing.T) {
+		hub, _ := setup("hunter2")
+		for _, password := range []string{"", "hunter3"} {
+			c := join(hub, "joiner-"+password, password)
+			if hub.inRoom(c, "room-123") {
+				t.Errorf("Joiner with password %q should be denied", password)
+			}
+			var sm SignalingMessage
+			json.Unmarshal(<-c.Send, &sm)
+			var text string
+			json.Unmarshal(sm.Payload, &text)
+			if sm.Type != MsgTypeError || text != "invalid room password" {
+				t.Errorf("Expected invalid room password error, got %v %q", sm.Type, text)
+			}
+		}
+	})
+
+	t.Run("no password", func(t *testing.T) {
+		hub, _ := setup("")
+		if c := join(hub, "joiner", "anything"); !hub.inRoom(c, "room-123") {
+			t.Error("Rooms created without a password should stay open")
+		}
+	})
+}
+
+func TestHub_StarTopology(t *testing.T) {
+	hub := NewHub()
+	hub.maxRoomClients = 0
+	center := &Client{ID: "center", Hub: hub, Send: make(chan []byte, 256)}
+	left := &Client{ID: "left", Hub: hub, Send: make(chan []byte, 256)}
+	right := &Client{ID: "right", Hub: hub, Send: make(chan []byte, 256)}
+	for _, c := range []*Client{center, left, right} {
+		hub.clients[c.ID] = c
+	}
+	hub.JoinRoomWith(center, "room-123", JoinOptions{Topology: TopologyStar})
+	hub.JoinRoom(left, "room-123")
+	hub.JoinRoom(right, "room-123")
+	drain := func() {
+		for _, c := range []*Client{center, left, right} {
+			for len(c.Send) > 0 {
+				<-c.Send
+			}
+		}
+	}
+	drain()
+
+	received := func(c *Client) bool {
+		if len(c.Send) == 0 {
+			return false
+		}
+		var sm SignalingMessage
+		json.Unmarshal(<-c.Send, &sm)
+		return sm.Type == MsgTypeOffer
+	}
+
+	// Peripheral to peripheral is blocked, and the sender told why
+	hub.handleBroadcast(&SignalingMessage{Type: MsgTypeOffer, From: left.ID, To: right.ID, RoomID: "room-123"})
+	if len(right.Send) != 0 {
+		t.Error("Peripheral-to-peripheral message should be blocked")
+	}
+	var sm SignalingMessage
+	json.Unmarshal(<-left.Send, &sm)
+	var text string
+	json.Unmarshal(sm.Payload, &text)
+	if sm.Type != MsgTypeError || text != "Not allowed to signal that peer" {
+		t.Errorf("Expected forward denied error, got %v %q", sm.Type, text)
+	}
+
+	// Peripheral to hub and hub to peripheral pass
+	hub.handleBroadcast(&SignalingMessage{Type: MsgTypeOffer, From: left.ID, To: center.ID, RoomID: "room-123"})
+	if !received(center) {
+		t.Error("Peripheral-to-hub message should pass")
+	}
+	hub.handleBroadcast(&SignalingMessage{Type: MsgTypeOffer, From: center.ID, To: right.ID, RoomID: "room-123"})
+	if !received(right) {
+		t.Error("Hub-to-peripheral message should pass")
+	}
+	drain()
+
+	// A peripheral's broadcast reaches the hub but no other peripheral,
+	// while the hub's reaches everyone
+	hub.handleBroadcast(&SignalingMessage{Type: MsgTypeOffer, From: left.ID, RoomID: "room-123"})
+	if !received(center) {
+		t.Error("Peripheral broadcast should reach the hub")
+	}
+	if len(right.Send) != 0 {
+		t.Error("Peripheral broadcast should not reach another peripheral")
+	}
+	hub.handleBroadcast(&SignalingMessage{Type: MsgTypeOffer, From: center.ID, RoomID: "room-123"})
+	if !received(left) || !received(right) {
+		t.Error("Hub broadcast should reach every peripheral")
+	}
+	drain()
+
+	// Unknown topologies are refused rather than falling back to a mesh
+	other := &Client{ID: "other", Hub: hub, Send: make(chan []byte, 256)}
+	hub.clients[other.ID] = other
+	if err := hub.JoinRoomWith(other, "room-456", JoinOptions{Topology: "ring"}); err != errUnknownTopology {
+		t.Errorf("Expected unknown topology error, got %v", err)
+	}
+}
+
+func TestHub_MultipleRoomsPerClient(t *testing.T) {
+	hub := NewHub()
+	hub.maxRoomsPerClient = 2
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go hub.Run(ctx)
+
+	multi := &Client{ID: "multi", Hub: hub, Send: make(chan []byte, 256)}
+	peer1 := &Client{ID: "peer-1", Hub: hub, Send: make(chan []byte, 256)}
+	peer2 := &Client{ID: "peer-2", Hub: hub, Send: make(chan []byte, 256)}
+
+	for _, c := range []*Client{multi, peer1, peer2} {
+		hub.register <- c
+	}
+	time.Sleep(10 * time.Millisecond)
+	for _, c := range []*Client{multi, peer1, peer2} {
+		<-c.Send // drain connected
+	}
+
+	hub.JoinRoom(multi, "room-1")
+	hub.JoinRoom(multi, "room-2")
+	hub.JoinRoom(peer1, "room-1")
+	hub.JoinRoom(peer2, "room-2")
+	<-multi.Send // drain peer-joined for room-1
+	<-multi.Send // drain peer-joined for room-2
+
+	if !multi.Rooms["room-1"] || !multi.Rooms["room-2"] {
+		t.Fatalf("Client should be in both rooms, got %v", multi.Rooms)
+	}
+
+	hub.broadcast <- &SignalingMessage{Type: MsgTypeOffer, From: peer1.ID, RoomID: "room-1"}
+	hub.broadcast <- &SignalingMessage{Type: MsgTypeAnswer, From: peer2.ID, RoomID: "room-2"}
+	time.Sleep(20 * time.Millisecond)
+
+	got := make(map[string]MessageType)
+	for len(multi.Send) > 0 {
+		var sm SignalingMessage
+		json.Unmarshal(<-multi.Send, &sm)
+		got[sm.RoomID] = sm.Type
+	}
+	if got["room-1"] != MsgTypeOffer || got["room-2"] != MsgTypeAnswer {
+		t.Errorf("Multi-room client got %v", got)
+	}
+	if len(peer1.Send) != 0 || len(peer2.Send) != 0 {
+		t.Error("Broadcasts leaked into the other room")
+	}
+
+	// At the limit, further joins are rejected
+	if err := hub.JoinRoom(multi, "room-3"); err != errRoomLimit {
+		t.Errorf("Expected room limit error joining past the limit, got %v", err)
+	}
+	if multi.Rooms["room-3"] {
+		t.Error("Client should not be in room-3")
+	}
+
+	// Leaving one room keeps the other
+	hub.LeaveRoom(multi, "room-1")
+	if multi.Rooms["room-1"] || !multi.Rooms["room-2"] || multi.RoomID != "room-2" {
+		t.Errorf("Unexpected rooms after leave: %v (current %q)", multi.Rooms, multi.RoomID)
+	}
+	var sm SignalingMessage
+	json.Unmarshal(<-peer1.Send, &sm)
+	if sm.Type != MsgTypePeerLeft || sm.RoomID != "room-1" {
+		t.Errorf("Expected peer-left for room-1, got %v %v", sm.Type, sm.RoomID)
+	}
+	if len(peer2.Send) != 0 {
+		t.Error("Peer in room-2 should not be told about leaving room-1")
+	}
+}
+
+func TestWebSocket_BroadcastRequiresMembership(t *testing.T) {
+	hub := NewHub()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go hub.Run(ctx)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveWs(hub, w, r)
+	}))
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	ws, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer ws.Close()
+
+	var msg SignalingMessage
+	ws.ReadJSON(&msg)
+
+	ws.WriteJSON(SignalingMessage{Type: MsgTypeHandshakeInit, RoomID: "my-room"})
+	ws.WriteJSON(SignalingMessage{Type: MsgTypeOffer, RoomID: "other-room"})
+
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	ws.ReadJSON(&msg) // drain room-created
+	ws.ReadJSON(&msg) // drain joined
+	if err := ws.ReadJSON(&msg); err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	if msg.Type != MsgTypeError {
+		t.Errorf("Expected error for broadcast to a room not joined, got %v", msg.Type)
+	}
+}
+
+func TestClient_EnqueueFullBuffer(t *testing.T) {
+	client := &Client{ID: "test-client", Send: make(chan []byte, 2)}
+
+	if !client.enqueue([]byte("one")) || !client.enqueue([]byte("two")) {
+		t.Fatal("Enqueue should succeed while the buffer has room")
+	}
+
+	done := make(chan bool)
+	go func() { done <- client.enqueue([]byte("three")) }()
+
+	select {
+	case ok := <-done:
+		if ok {
+			t.Error("Enqueue should report false when the buffer is full")
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("Enqueue blocked on a full buffer")
+	}
+
+	if got := string(<-client.Send); got != "one" {
+		t.Errorf("First message = %q, want 'one'", got)
+	}
+	if !client.enqueue([]byte("three")) {
+		t.Error("Enqueue should succeed once the buffer drains")
+	}
+}
+
+func TestClient_EnqueueDropOldest(t *testing.T) {
+	client := &Client{ID: "test-client", Send: make(chan []byte, 2), overflow: OverflowDropOldest}
+
+	for _, m := range []string{"one", "two", "three"} {
+		if !client.enqueue([]byte(m)) {
+			t.Fatalf("Enqueue of %q should succeed by evicting the oldest", m)
+		}
+	}
+
+	if got := string(<-client.Send); got != "two" {
+		t.Errorf("First message = %q, want 'two'", got)
+	}
+	if got := string(<-client.Send); got != "three" {
+		t.Errorf("Second message = %q, want 'three'", got)
+	}
+}
+
+func TestClient_EnqueueDisconnectOnOverflow(t *testing.T) {
+	clients := make(chan *Client, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		clients <- &Client{ID: "test-client", Conn: conn, Send: make(chan []byte, 1), overflow: OverflowDisconnect}
+	}))
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+	ws, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer ws.Close()
+
+	client := <-clients
+	client.enqueue([]byte("one"))
+	if client.enqueue([]byte("two")) {
+		t.Error("Enqueue should report false on overflow")
+	}
+
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err = ws.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) {
+		t.Fatalf("Expected close frame, got %v", err)
+	}
+	if closeErr.Code != websocket.ClosePolicyViolation || closeErr.Text != CloseReasonSendOverflow {
+		t.Errorf("Close = %d %q, want %d %q", closeErr.Code, closeErr.Text,
+			websocket.ClosePolicyViolation, CloseReasonSendOverflow)
+	}
+}
+
+// countingConn counts the bytes read off the wire
+type countingConn struct {
+	net.Conn
+	read atomic.Int64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read.Add(int64(n))
+	return n, err
+}
+
+func TestClient_WritePumpCompressesLargeFrames(t *testing.T) {
+	clients := make(chan *Client, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		client := &Client{ID: "test-client", Conn: conn, Send: make(chan []byte, 8), compressMin: 1024}
+		go client.WritePump()
+		clients <- client
+	}))
+	defer server.Close()
+
+	var wire *countingConn
+	dialer := websocket.Dialer{
+		EnableCompression: true,
+		NetDial: func(network, addr string) (net.Conn, error) {
+			conn, err := net.Dial(network, addr)
+			wire = &countingConn{Conn: conn}
+			return wire, err
+		},
+	}
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+	ws, resp, err := dialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer ws.Close()
+	if ext := resp.Header.Get("Sec-WebSocket-Extensions"); !strings.Contains(ext, "permessage-deflate") {
+		t.Fatalf("Compression not negotiated, extensions %q", ext)
+	}
+	client := <-clients
+
+	// wireSize sends msg through WritePump and returns its size on the wire
+	wireSize := func(msg []byte) int64 {
+		before := wire.read.Load()
+		client.enqueue(msg)
+		ws.SetReadDeadline(time.Now().Add(time.Second))
+		_, data, err := ws.ReadMessage()
+		if err != nil || !bytes.Equal(data, msg) {
+			t.Fatalf("Read %d bytes (%v), want the %d sent", len(data), err, len(msg))
+		}
+		return wire.read.Load() - before
+	}
+
+	small := []byte(`{"type":"peer-joined","clientId":"aaaaaaaa","roomId":"aaaaaaaa"}`)
+	if n := wireSize(small); n < int64(len(small)) {
+		t.Errorf("Small message took %d bytes on the wire for %d of data; should be uncompressed", n, len(small))
+	}
+
+	large := []byte(`{"type":"offer","payload":"` + strings.Repeat("a", 8192) + `"}`)
+	if n := wireSize(large); n >= int64(len(large))/4 {
+		t.Errorf("Large message took %d bytes on the wire for %d of data; should be compressed", n, len(large))
+	}
+}
+
+func TestHub_RoomSummaryOnDelete(t *testing.T) {
+	var buf syncBuffer
+	prevLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+	defer slog.SetDefault(prevLogger)
+
+	hub := NewHub()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go hub.Run(ctx)
+
+	client1 := &Client{ID: "client-1", Hub: hub, Send: make(chan []byte, 256)}
+	client2 := &Client{ID: "client-2", Hub: hub, Send: make(chan []byte, 256)}
+
+	hub.register <- client1
+	hub.register <- client2
+	time.Sleep(10 * time.Millisecond)
+
+	hub.JoinRoom(client1, "room-123")
+	hub.JoinRoom(client2, "room-123")
+
+	offer := &SignalingMessage{Type: MsgTypeOffer, From: client1.ID, RoomID: "room-123"}
+	answer := &SignalingMessage{Type: MsgTypeAnswer, From: client2.ID, To: client1.ID}
+	offerData, _ := json.Marshal(offer)
+	answerData, _ := json.Marshal(answer)
+	hub.broadcast <- offer
+	hub.broadcast <- answer
+	time.Sleep(10 * time.Millisecond) // Let the hub relay before anyone leaves
+
+	hub.unregister <- client1
+	hub.unregister <- client2
+	time.Sleep(20 * time.Millisecond)
+
+	var summary map[string]any
+	for _, line := range strings.Split(buf.String(), "\n") {
+		var entry map[string]any
+		if json.Unmarshal([]byte(line), &entry) == nil && entry["msg"] == "Room summary" {
+			summary = entry
+		}
+	}
+	if summary == nil {
+		t.Fatalf("No room summary logged:\n%s", buf.String())
+	}
+
+	if summary["roomId"] != "room-123" {
+		t.Errorf("roomId = %v, want room-123", summary["roomId"])
+	}
+	if summary["reason"] != "empty" {
+		t.Errorf("reason = %v, want empty", summary["reason"])
+	}
+	if summary["peakClients"] != float64(2) {
+		t.Errorf("peakClients = %v, want 2", summary["peakClients"])
+	}
+	if summary["messagesForwarded"] != float64(2) {
+		t.Errorf("messagesForwarded = %v, want 2", summary["messagesForwarded"])
+	}
+	if want := float64(len(offerData) + len(answerData)); summary["bytesForwarded"] != want {
+		t.Errorf("bytesForwarded = %v, want %v", summary["bytesForwarded"], want)
+	}
+	if _, ok := summary["lifetime"]; !ok {
+		t.Error("Summary missing lifetime")
+	}
+}
+
+func TestClient_PingIntervalFloor(t *testing.T) {
+	hub := NewHub()
+	client := NewClient(nil, hub)
+
+	client.setPingInterval(10 * time.Millisecond)
+	if client.pingEvery != defaultMinPingInterval {
+		t.Errorf("Ultra-short interval gave %v, want floor %v", client.pingEvery, defaultMinPingInterval)
+	}
+	client.setPingInterval(time.Hour)
+	if client.pingEvery != pingPeriod {
+		t.Errorf("Long interval gave %v, want %v", client.pingEvery, pingPeriod)
+	}
+	client.setPingInterval(20 * time.Second)
+	if client.pingEvery != 20*time.Second {
+		t.Errorf("Interval within bounds changed to %v", client.pingEvery)
+	}
+}
+
+func TestServeWs_RequestedPingInterval(t *testing.T) {
+	hub := NewHub()
+	hub.minPingInterval = 2 * time.Second
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go hub.Run(ctx)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveWs(hub, w, r)
+	}))
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+	tests := []struct {
+		query string
+		want  time.Duration
+	}{
+		{"?pingInterval=20", 20 * time.Second},
+		{"?pingInterval=1", 2 * time.Second}, // Held to the floor
+		{"?pingInterval=3600", pingPeriod},
+		{"?pingInterval=soon", 0},
+		{"", 0},
+	}
+	for _, tt := range tests {
+		ws, _, err := websocket.DefaultDialer.Dial(wsURL+tt.query, nil)
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		var msg SignalingMessage
+		ws.ReadJSON(&msg)
+
+		hub.mu.RLock()
+		got := hub.clients[msg.ClientID].pingEvery
+		hub.mu.RUnlock()
+		if got != tt.want {
+			t.Errorf("%q: ping interval %v, want %v", tt.query, got, tt.want)
+		}
+		ws.Close()
+	}
+}
+
+func TestClient_NegotiateFeatures(t *testing.T) {
+	client := &Client{ID: "test-client", Send: make(chan []byte, 256)}
+
+	client.negotiateFeatures([]string{"compression"})
+
+	if !client.hasFeature("compression") {
+		t.Error("Expected compression to be negotiated")
+	}
+	if client.hasFeature("relay") {
+		t.Error("relay was not advertised and should not be negotiated")
+	}
+
+	var sm SignalingMessage
+	json.Unmarshal(<-client.Send, &sm)
+	if sm.Type != MsgTypeFeatures || len(sm.Features) != 1 || sm.Features[0] != "compression" {
+		t.Errorf("Unexpected features reply: %+v", sm)
+	}
+}
+
+func TestClient_ResolveJoinKeyExpiry(t *testing.T) {
+	client := &Client{ID: "test-client"}
+
+	if room, retry := client.resolveJoinKey("k", "room-a"); room != "room-a" || retry {
+		t.Errorf("First use = (%q, %v), want (room-a, false)", room, retry)
+	}
+	if room, retry := client.resolveJoinKey("k", "room-b"); room != "room-a" || !retry {
+		t.Errorf("Retry = (%q, %v), want (room-a, true)", room, retry)
+	}
+
+	// Once the TTL passes the key is treated as new
+	jk := client.joinKeys["k"]
+	jk.at = jk.at.Add(-joinKeyTTL - time.Second)
+	client.joinKeys["k"] = jk
+	if room, retry := client.resolveJoinKey("k", "room-b"); room != "room-b" || retry {
+		t.Errorf("After TTL = (%q, %v), want (room-b, false)", room, retry)
+	}
+
+	for i := 0; i < maxJoinKeys*2; i++ {
+		client.resolveJoinKey(fmt.Sprintf("key-%d", i), "room")
+	}
+	if len(client.joinKeys) > maxJoinKeys {
+		t.Errorf("Kept %d keys, want at most %d", len(client.joinKeys), maxJoinKeys)
+	}
+}
+
+func TestHub_RoomMessageRateLimit(t *testing.T) {
+	hub := NewHub()
+	hub.roomMessageRate = 1
+	hub.roomMessageBurst = 5
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go hub.Run(ctx)
+
+	client1 := &Client{ID: "client-1", Hub: hub, Send: make(chan []byte, 256)}
+	client2 := &Client{ID: "client-2", Hub: hub, Send: make(chan []byte, 256)}
+
+	hub.register <- client1
+	hub.register <- client2
+	time.Sleep(10 * time.Millisecond)
+	<-client1.Send
+	<-client2.Send
+
+	hub.JoinRoom(client1, "room-123")
+	hub.JoinRoom(client2, "room-123")
+	<-client1.Send // drain peer-joined
+
+	// Both peers share the room's budget
+	for i := 0; i < 4; i++ {
+		hub.broadcast <- &SignalingMessage{Type: MsgTypeOffer, From: client1.ID, RoomID: "room-123"}
+		hub.broadcast <- &SignalingMessage{Type: MsgTypeAnswer, From: client2.ID, RoomID: "room-123"}
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	relayed, throttled := 0, 0
+	for _, c := range []*Client{client1, client2} {
+		for len(c.Send) > 0 {
+			var sm SignalingMessage
+			json.Unmarshal(<-c.Send, &sm)
+			switch sm.Type {
+			case MsgTypeOffer, MsgTypeAnswer:
+				relayed++
+			case MsgTypeError:
+				throttled++
+			}
+		}
+	}
+
+	if relayed != 5 {
+		t.Errorf("Relayed %d messages, want burst of 5", relayed)
+	}
+	if throttled != 3 {
+		t.Errorf("Got %d backpressure errors, want 3", throttled)
+	}
+}
+
+func TestHub_SenderReceiverRoles(t *testing.T) {
+	hub := NewHub()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go hub.Run(ctx)
+
+	sender := &Client{ID: "sender", Hub: hub, Send: make(chan []byte, 256)}
+	receiver := &Client{ID: "receiver", Hub: hub, Send: make(chan []byte, 256)}
+	extra := &Client{ID: "extra", Hub: hub, Send: make(chan []byte, 256)}
+
+	for _, c := range []*Client{sender, receiver, extra} {
+		hub.register <- c
+	}
+	time.Sleep(10 * time.Millisecond)
+	for _, c := range []*Client{sender, receiver, extra} {
+		<-c.Send // drain connected
+	}
+
+	if err := hub.JoinRoomWith(sender, "room-123", JoinOptions{Role: RoleSender}); err != nil {
+		t.Fatalf("Sender join failed: %v", err)
+	}
+
+	// Nothing is relayed while the receiver role is empty
+	hub.broadcast <- &SignalingMessage{Type: MsgTypeOffer, From: sender.ID, RoomID: "room-123"}
+	time.Sleep(10 * time.Millisecond)
+	var sm SignalingMessage
+	json.Unmarshal(<-sender.Send, &sm)
+	if sm.Type != MsgTypeError {
+		t.Fatalf("Expected room-not-ready error, got %v", sm.Type)
+	}
+
+	if err := hub.JoinRoomWith(receiver, "room-123", JoinOptions{Role: RoleReceiver}); err != nil {
+		t.Fatalf("Receiver join failed: %v", err)
+	}
+	<-sender.Send // drain peer-joined
+
+	for _, c := range []*Client{sender, receiver} {
+		json.Unmarshal(<-c.Send, &sm)
+		if sm.Type != MsgTypeReady || sm.RoomID != "room-123" {
+			t.Errorf("%s: expected ready for room-123, got %v %v", c.ID, sm.Type, sm.RoomID)
+		}
+	}
+
+	// A second sender is turned away without joining
+	if err := hub.JoinRoomWith(extra, "room-123", JoinOptions{Role: RoleSender}); err != errRoleTaken {
+		t.Errorf("Expected role taken error for a second sender, got %v", err)
+	}
+	if extra.Rooms["room-123"] {
+		t.Error("Rejected client should not be in the room")
+	}
+	if err := hub.JoinRoomWith(extra, "room-123", JoinOptions{Role: "observer"}); err != errUnknownRole {
+		t.Errorf("Expected unknown role error, got %v", err)
+	}
+
+	hub.broadcast <- &SignalingMessage{Type: MsgTypeOffer, From: sender.ID, RoomID: "room-123"}
+	time.Sleep(10 * time.Millisecond)
+	json.Unmarshal(<-receiver.Send, &sm)
+	if sm.Type != MsgTypeOffer {
+		t.Errorf("Expected offer once ready, got %v", sm.Type)
+	}
+
+	// The role frees up when its holder leaves
+	hub.LeaveRoom(receiver, "room-123")
+	if err := hub.JoinRoomWith(extra, "room-123", JoinOptions{Role: RoleReceiver}); err != nil {
+		t.Errorf("Receiver role should be free after leave, got %v", err)
+	}
+}
+
+func TestHub_RoomRelayBudget(t *testing.T) {
+	hub := NewHub()
+	hub.maxRoomRelayBytes = 10
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go hub.Run(ctx)
+
+	client1 := &Client{ID: "client-1", Hub: hub, Send: make(chan []byte, 256)}
+	client2 := &Client{ID: "client-2", Hub: hub, Send: make(chan []byte, 256)}
+
+	hub.register <- client1
+	hub.register <- client2
+	time.Sleep(10 * time.Millisecond)
+	<-client1.Send
+	<-client2.Send
+
+	hub.JoinRoom(client1, "room-123")
+	hub.JoinRoom(client2, "room-123")
+	<-client1.Send // drain peer-joined
+
+	// Two 4-byte payloads fit the budget, a third does not
+	for i := 0; i < 3; i++ {
+		hub.broadcast <- &SignalingMessage{Type: MsgTypeRelay, From: client1.ID, RoomID: "room-123",
+			Payload: json.RawMessage(`"ab"`)}
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	if got := len(client2.Send); got != 2 {
+		t.Errorf("Peer received %d relays, want 2", got)
+	}
+	if got := len(client1.Send); got != 1 {
+		t.Fatalf("Sender received %d messages, want 1 budget error", got)
+	}
+	var sm SignalingMessage
+	json.Unmarshal(<-client1.Send, &sm)
+	var text string
+	json.Unmarshal(sm.Payload, &text)
+	if sm.Type != MsgTypeError || text != "Room relay budget exceeded" {
+		t.Errorf("Expected relay budget error, got %v %q", sm.Type, text)
+	}
+	if got := client1.lastError.Load(); got == nil || got.Code != ErrCodeRelayBudget {
+		t.Errorf("Last error = %+v, want code %s", got, ErrCodeRelayBudget)
+	}
+}
+
+func TestHub_GracefulShutdown(t *testing.T) {
+	hub := NewHub()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		hub.Run(ctx)
+	}()
+
+	client := &Client{ID: "test-client", Hub: hub, Send: make(chan []byte, 256)}
+	hub.register <- client
+	time.Sleep(10 * time.Millisecond)
+
+	cancel()
+	wg.Wait()
+
+	// Send channel should be closed
+	_, ok := <-client.Send
+	if ok {
+		// Channel might have buffered messages, drain them
+		for range client.Send {
+		}
+	}
+}
+
+func TestWebSocket_RejectedAfterShutdown(t *testing.T) {
+	hub := NewHub()
+	hub.shutdownReason = "deploy"
+	ctx, cancel := context.WithCancel(context.Background())
+	go hub.Run(ctx)
+	cancel()
+	select {
+	case <-hub.done:
+	case <-time.After(time.Second):
+		t.Fatal("Hub did not shut down")
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveWs(hub, w, r)
+	}))
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+	ws, resp, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err == nil {
+		ws.Close()
+		t.Fatal("Connection accepted by a hub that has shut down")
+	}
+	if resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("Expected 503, got %v", resp)
+	}
+	var body UpgradeFailure
+	json.NewDecoder(resp.Body).Decode(&body)
+	if body.Reason != UpgradeReasonShuttingDown || !strings.Contains(body.Error, "deploy") {
+		t.Errorf("Body = %+v, want shutting_down with the shutdown reason", body)
+	}
+}
+
+func TestHub_ShutdownReason(t *testing.T) {
+	t.Setenv("SHUTDOWN_REASON", "deploy")
+	t.Setenv("SHUTDOWN_ESTIMATED_DOWNTIME", "45")
+
+	hub := NewHub()
+	hub.configureFromEnv()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		hub.Run(ctx)
+	}()
+
+	client := &Client{ID: "test-client", Hub: hub, Send: make(chan []byte, 256)}
+	hub.register <- client
+	time.Sleep(10 * time.Millisecond)
+	<-client.Send // drain connected
+
+	cancel()
+	<-done
+
+	var sm SignalingMessage
+	json.Unmarshal(<-client.Send, &sm)
+	if sm.Type != MsgTypeServerShutdown {
+		t.Fatalf("Expected server-shutdown, got %v", sm.Type)
+	}
+	var payload ShutdownPayload
+	if err := json.Unmarshal(sm.Payload, &payload); err != nil {
+		t.Fatalf("Failed to unmarshal payload: %v", err)
+	}
+	if payload.Reason != "deploy" || payload.EstimatedDowntimeSeconds != 45 {
+		t.Errorf("Unexpected shutdown payload: %+v", payload)
+	}
+	if _, ok := <-client.Send; ok {
+		t.Error("Send channel should be closed after the shutdown message")
+	}
+}
+
+func TestWebSocketIntegration(t *testing.T) {
+	hub := NewHub()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go hub.Run(ctx)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveWs(hub, w, r)
+	}))
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	ws, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer ws.Close()
+
+	// Should receive connected message
+	var msg SignalingMessage
+	if err := ws.ReadJSON(&msg); err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+
+	if msg.Type != MsgTypeConnected {
+		t.Errorf("Expected connected, got %v", msg.Type)
+	}
+	if msg.ClientID == "" {
+		t.Error("ClientID should not be empty")
+	}
+}
+
+func TestWebSocket_ConnectedInfo(t *testing.T) {
+	hub := NewHub()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go hub.Run(ctx)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveWs(hub, w, r)
+	}))
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+	dialer := websocket.Dialer{Subprotocols: []string{"warp.v1"}}
+	ws, _, err := dialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer ws.Close()
+
+	var msg SignalingMessage
+	if err := ws.ReadJSON(&msg); err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	var info ConnectedPayload
+	if err := json.Unmarshal(msg.Payload, &info); err != nil {
+		t.Fatalf("Bad connected payload %s: %v", msg.Payload, err)
+	}
+	if info.ClientID != msg.ClientID || info.ClientID == "" {
+		t.Errorf("Payload client ID %q, message %q", info.ClientID, msg.ClientID)
+	}
+	if info.IP != "127.0.0.1" {
+		t.Errorf("Expected IP 127.0.0.1, got %q", info.IP)
+	}
+	if info.Subprotocol != "warp.v1" {
+		t.Errorf("Expected subprotocol warp.v1, got %q", info.Subprotocol)
+	}
+	if info.Compressed {
+		t.Error("Compression reported without being negotiated")
+	}
+}
+
+func TestWebSocket_JoinRoom(t *testing.T) {
+	hub := NewHub()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go hub.Run(ctx)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveWs(hub, w, r)
+	}))
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	ws, _, _ := websocket.DefaultDialer.Dial(wsURL, nil)
+	defer ws.Close()
+
+	// Drain connected message
+	var msg SignalingMessage
+	ws.ReadJSON(&msg)
+
+	// Join room
+	joinMsg := SignalingMessage{
+		Type:   MsgTypeHandshakeInit,
+		RoomID: "test-room",
+	}
+	ws.WriteJSON(joinMsg)
+
+	time.Sleep(50 * time.Millisecond)
+
+	hub.mu.RLock()
+	_, exists := hub.rooms["test-room"]
+	hub.mu.RUnlock()
+
+	if !exists {
+		t.Error("Room should be created after handshake-init")
+	}
+}
+
+func TestWebSocket_ReconnectTakesOverSession(t *testing.T) {
+	hub := NewHub()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go hub.Run(ctx)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveWs(hub, w, r)
+	}))
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+	join := func(query string) (*websocket.Conn, ConnectedPayload) {
+		ws, _, err := websocket.DefaultDialer.Dial(wsURL+query, nil)
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		var msg SignalingMessage
+		ws.ReadJSON(&msg) // connected
+		var info ConnectedPayload
+		json.Unmarshal(msg.Payload, &info)
+		ws.WriteJSON(SignalingMessage{Type: MsgTypeHandshakeInit, RoomID: "test-room"})
+		time.Sleep(50 * time.Millisecond)
+		return ws, info
+	}
+
+	first, issued := join("?clientId=mobile-1")
+	defer first.Close()
+	peer, peerInfo := join("")
+	defer peer.Close()
+	if issued.ResumeToken == "" {
+		t.Fatal("No resume token issued for a stable client ID")
+	}
+
+	again, _, err := websocket.DefaultDialer.Dial(wsURL+"?clientId=mobile-1&resumeToken="+issued.ResumeToken, nil)
+	if err != nil {
+		t.Fatalf("Failed to reconnect: %v", err)
+	}
+	defer again.Close()
+
+	var msg SignalingMessage
+	again.ReadJSON(&msg)
+	var info ConnectedPayload
+	json.Unmarshal(msg.Payload, &info)
+	if msg.ClientID != "mobile-1" || !slices.Equal(info.Rooms, []string{"test-room"}) {
+		t.Fatalf("Expected mobile-1 resuming test-room, got %q in %v", msg.ClientID, info.Rooms)
+	}
+	if info.ResumeToken == "" || info.ResumeToken == issued.ResumeToken {
+		t.Error("Resumed session should be issued a fresh resume token")
+	}
+
+	// It is sent the resumed room's state without waiting for a sync
+	again.SetReadDeadline(time.Now().Add(time.Second))
+	if err := again.ReadJSON(&msg); err != nil || msg.Type != MsgTypeRoomState || msg.RoomID != "test-room" {
+		t.Fatalf("Expected test-room's state after resuming, got %v %q (%v)", msg.Type, msg.RoomID, err)
+	}
+	var state RoomStatePayload
+	json.Unmarshal(msg.Payload, &state)
+	want := []string{"mobile-1", peerInfo.ClientID}
+	slices.Sort(want)
+	if !slices.Equal(state.Peers, want) {
+		t.Errorf("Expected peers %v, got %v", want, state.Peers)
+	}
+	again.SetReadDeadline(time.Time{})
+
+	// The old connection is closed cleanly
+	first.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		_, _, err := first.ReadMessage()
+		if err == nil {
+			continue
+		}
+		if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+			t.Errorf("Expected a normal close of the old connection, got %v", err)
+		}
+		break
+	}
+
+	// The new connection relays in the room as before
+	again.WriteJSON(SignalingMessage{Type: MsgTypeOffer, RoomID: "test-room", Payload: json.RawMessage(`{}`)})
+
+	peer.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	gotOffer := false
+	for {
+		var sm SignalingMessage
+		if err := peer.ReadJSON(&sm); err != nil {
+			break
+		}
+		switch sm.Type {
+		case MsgTypePeerLeft, MsgTypePeerJoined:
+			t.Errorf("Peer saw %s during the takeover", sm.Type)
+		case MsgTypeOffer:
+			gotOffer = sm.From == "mobile-1"
+		}
+	}
+	if !gotOffer {
+		t.Error("Peer did not get the offer from the reconnected client")
+	}
+}
+
+func TestWebSocket_TakeoverRequiresResumeToken(t *testing.T) {
+	hub := NewHub()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go hub.Run(ctx)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveWs(hub, w, r)
+	}))
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+	dial := func(query string) (*websocket.Conn, SignalingMessage) {
+		ws, _, err := websocket.DefaultDialer.Dial(wsURL+query, nil)
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		var msg SignalingMessage
+		ws.SetReadDeadline(time.Now().Add(time.Second))
+		ws.ReadJSON(&msg)
+		return ws, msg
+	}
+
+	// A session that got a server-assigned ID can't be taken over at all
+	victim, connected := dial("")
+	defer victim.Close()
+	victim.WriteJSON(SignalingMessage{Type: MsgTypeHandshakeInit, RoomID: "test-room"})
+	time.Sleep(50 * time.Millisecond)
+
+	// Nor can a stable-ID session without its resume token
+	owner, _ := dial("?clientId=mobile-1")
+	defer owner.Close()
+
+	for _, query := range []string{
+		"?clientId=" + connected.ClientID,
+		"?clientId=mobile-1",
+		"?clientId=mobile-1&resumeToken=guess",
+	} {
+		// Turned away with an error or straight to the close frame
+		hijacker, msg := dial(query)
+		if msg.Type == MsgTypeConnected {
+			t.Errorf("%s: hijack attempt was connected", query)
+		}
+		hijacker.Close()
+	}
+
+	hub.mu.RLock()
+	stillOwned := hub.clients[connected.ClientID] != nil && hub.rooms["test-room"] != nil &&
+		hub.rooms["test-room"].Clients[connected.ClientID].Conn != nil
+	hub.mu.RUnlock()
+	if !stillOwned {
+		t.Error("Victim lost its session to a hijack attempt")
+	}
+	victim.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	for {
+		var msg SignalingMessage
+		if err := victim.ReadJSON(&msg); err != nil {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				t.Error("Victim connection was closed by a hijack attempt")
+			}
+			break
+		}
+	}
+}
+
+func TestWebSocket_HandshakeTimeout(t *testing.T) {
+	hub := NewHub()
+	hub.handshakeTimeout = 50 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go hub.Run(ctx)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveWs(hub, w, r)
+	}))
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	ws, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer ws.Close()
+
+	// Drain connected message, then never send handshake-init
+	var msg SignalingMessage
+	ws.ReadJSON(&msg)
+
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err = ws.ReadMessage()
+
+	closeErr, ok := err.(*websocket.CloseError)
+	if !ok {
+		t.Fatalf("Expected close error, got %v", err)
+	}
+	if closeErr.Code != websocket.ClosePolicyViolation {
+		t.Errorf("Close code = %d, want %d", closeErr.Code, websocket.ClosePolicyViolation)
+	}
+	if closeErr.Text != CloseReasonHandshakeTimeout {
+		t.Errorf("Close reason = %q, want %q", closeErr.Text, CloseReasonHandshakeTimeout)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	hub.mu.RLock()
+	remaining := len(hub.clients)
+	hub.mu.RUnlock()
+	if remaining != 0 {
+		t.Errorf("Expected client to be unregistered, %d remaining", remaining)
+	}
+}
+
+func TestWebSocket_HandshakeTimeoutSkippedAfterJoin(t *testing.T) {
+	hub := NewHub()
+	hub.handshakeTimeout = 50 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go hub.Run(ctx)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveWs(hub, w, r)
+	}))
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	ws, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer ws.Close()
+
+	var msg SignalingMessage
+	ws.ReadJSON(&msg)
+	ws.WriteJSON(SignalingMessage{Type: MsgTypeHandshakeInit, RoomID: "test-room"})
+
+	time.Sleep(100 * time.Millisecond)
+
+	hub.mu.RLock()
+	_, stillConnected := hub.clients[msg.ClientID]
+	hub.mu.RUnlock()
+	if !stillConnected {
+		t.Error("Client that joined a room should not be disconnected")
+	}
+}
+
+func TestWebSocket_MessageStrictness(t *testing.T) {
+	tests := []struct {
+		name       string
+		strict     bool
+		wantRoom   bool
+		wantErrMsg bool
+	}{
+		{name: "lenient accepts unknown fields", strict: false, wantRoom: true},
+		{name: "strict rejects unknown fields", strict: true, wantErrMsg: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hub := NewHub()
+			hub.strictMessages = tt.strict
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			go hub.Run(ctx)
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				serveWs(hub, w, r)
+			}))
+			defer server.Close()
+
+			wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+			ws, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+			if err != nil {
+				t.Fatalf("Failed to connect: %v", err)
+			}
+			defer ws.Close()
+
+			var msg SignalingMessage
+			ws.ReadJSON(&msg)
+
+			ws.WriteMessage(websocket.TextMessage,
+				[]byte(`{"type":"handshake-init","roomId":"test-room","extra":true}`))
+
+			if tt.wantErrMsg {
+				ws.SetReadDeadline(time.Now().Add(time.Second))
+				if err := ws.ReadJSON(&msg); err != nil {
+					t.Fatalf("Failed to read: %v", err)
+				}
+				if msg.Type != MsgTypeError {
+					t.Errorf("Expected error, got %v", msg.Type)
+				}
+			} else {
+				time.Sleep(50 * time.Millisecond)
+			}
+
+			hub.mu.RLock()
+			_, exists := hub.rooms["test-room"]
+			hub.mu.RUnlock()
+			if exists != tt.wantRoom {
+				t.Errorf("Room exists = %v, want %v", exists, tt.wantRoom)
+			}
+		})
+	}
+}
+
+func TestSignalingMessage_ValidPayload(t *testing.T) {
+	tests := []struct {
+		payload string
+		want    bool
+	}{
+		{"", true},
+		{`"text"`, true},
+		{`{"sdp":"v=0"}`, true},
+		{`{bad`, false},
+		{`"unterminated`, false},
+	}
+
+	for _, tt := range tests {
+		msg := SignalingMessage{Type: MsgTypeOffer, Payload: json.RawMessage(tt.payload)}
+		if got := msg.validPayload(); got != tt.want {
+			t.Errorf("validPayload(%q) = %v, want %v", tt.payload, got, tt.want)
+		}
+	}
+}
+
+func TestWebSocket_InvalidPayload(t *testing.T) {
+	hub := NewHub()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go hub.Run(ctx)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveWs(hub, w, r)
+	}))
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	ws, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer ws.Close()
+
+	var msg SignalingMessage
+	ws.ReadJSON(&msg)
+
+	ws.WriteMessage(websocket.TextMessage, []byte(`{"type":"offer","payload":{bad}`))
+
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	if err := ws.ReadJSON(&msg); err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	if msg.Type != MsgTypeError {
+		t.Errorf("Expected error for a malformed payload, got %v", msg.Type)
+	}
+}
+
+func TestClient_SendErrorEscapesMessage(t *testing.T) {
+	client := &Client{ID: "client-1", Send: make(chan []byte, 1)}
+	client.sendError(ErrCodeInvalidMessage, `bad "quoted" \ message`)
+
+	var msg SignalingMessage
+	if err := json.Unmarshal(<-client.Send, &msg); err != nil {
+		t.Fatalf("Error message is not valid JSON: %v", err)
+	}
+	var text string
+	if err := json.Unmarshal(msg.Payload, &text); err != nil {
+		t.Fatalf("Error payload is not a JSON string: %v", err)
+	}
+	if text != `bad "quoted" \ message` {
+		t.Errorf("Payload = %q", text)
+	}
+}
+
+func TestWebSocket_Disconnect(t *testing.T) {
+	var buf syncBuffer
+	prevLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+	defer slog.SetDefault(prevLogger)
+
+	hub := NewHub()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go hub.Run(ctx)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveWs(hub, w, r)
+	}))
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	leaver, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer leaver.Close()
+	stayer, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer stayer.Close()
+
+	var msg SignalingMessage
+	leaver.ReadJSON(&msg)
+	stayer.ReadJSON(&msg)
+
+	stayer.WriteJSON(SignalingMessage{Type: MsgTypeHandshakeInit, RoomID: "test-room"})
+	stayer.ReadJSON(&msg) // drain room-created
+	stayer.ReadJSON(&msg) // drain joined
+	leaver.WriteJSON(SignalingMessage{Type: MsgTypeHandshakeInit, RoomID: "test-room"})
+	stayer.ReadJSON(&msg) // drain peer-joined
+	stayer.ReadJSON(&msg) // drain lan-hint, both connect from localhost
+
+	leaver.WriteJSON(SignalingMessage{
+		Type:    MsgTypeDisconnect,
+		Payload: json.RawMessage(`{"reason":"completed"}`),
+	})
+
+	// Leaver gets a normal close carrying the reason, after any pending messages
+	leaver.SetReadDeadline(time.Now().Add(time.Second))
+	for err == nil {
+		_, _, err = leaver.ReadMessage()
+	}
+	closeErr, ok := err.(*websocket.CloseError)
+	if !ok {
+		t.Fatalf("Expected close error, got %v", err)
+	}
+	if closeErr.Code != websocket.CloseNormalClosure || closeErr.Text != "completed" {
+		t.Errorf("Unexpected close: %d %q", closeErr.Code, closeErr.Text)
+	}
+
+	// Peer is told who left and why
+	stayer.SetReadDeadline(time.Now().Add(time.Second))
+	if err := stayer.ReadJSON(&msg); err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	if msg.Type != MsgTypePeerLeft {
+		t.Fatalf("Expected peer-left, got %v", msg.Type)
+	}
+	var payload DisconnectPayload
+	json.Unmarshal(msg.Payload, &payload)
+	if payload.Reason != "completed" {
+		t.Errorf("Expected reason 'completed', got %q", payload.Reason)
+	}
+
+	logs := buf.String()
+	if !strings.Contains(logs, "Client requested disconnect") || !strings.Contains(logs, `"reason":"completed"`) {
+		t.Errorf("Expected disconnect reason in logs: %s", logs)
+	}
+}
+
+func TestWebSocket_FeatureNegotiation(t *testing.T) {
+	hub := NewHub()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go hub.Run(ctx)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveWs(hub, w, r)
+	}))
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	ws, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer ws.Close()
+
+	var msg SignalingMessage
+	ws.ReadJSON(&msg)
+
+	ws.WriteJSON(SignalingMessage{
+		Type:     MsgTypeHandshakeInit,
+		RoomID:   "test-room",
+		Features: []string{"relay", "batching", "teleport"},
+	})
+
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	if err := ws.ReadJSON(&msg); err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	if msg.Type != MsgTypeFeatures {
+		t.Fatalf("Expected features, got %v", msg.Type)
+	}
+	if len(msg.Features) != 2 || msg.Features[0] != "batching" || msg.Features[1] != "relay" {
+		t.Errorf("Negotiated features = %v, want [batching relay]", msg.Features)
+	}
+}
+
+func TestWebSocket_IdempotentHandshake(t *testing.T) {
+	hub := NewHub()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go hub.Run(ctx)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveWs(hub, w, r)
+	}))
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	peer, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer peer.Close()
+	retrier, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer retrier.Close()
+
+	var msg SignalingMessage
+	peer.ReadJSON(&msg)
+	retrier.ReadJSON(&msg)
+	retrierID := msg.ClientID
+
+	peer.WriteJSON(SignalingMessage{Type: MsgTypeHandshakeInit, RoomID: "room-a"})
+	time.Sleep(20 * time.Millisecond)
+
+	payload := json.RawMessage(`{"idempotencyKey":"retry-1"}`)
+	retrier.WriteJSON(SignalingMessage{Type: MsgTypeHandshakeInit, RoomID: "room-a", Payload: payload})
+	retrier.WriteJSON(SignalingMessage{Type: MsgTypeHandshakeInit, RoomID: "room-b", Payload: payload})
+	time.Sleep(50 * time.Millisecond)
+
+	hub.mu.RLock()
+	client := hub.clients[retrierID]
+	roomID := client.RoomID
+	_, roomBExists := hub.rooms["room-b"]
+	hub.mu.RUnlock()
+
+	if roomID != "room-a" {
+		t.Errorf("Retried handshake resolved to %q, want room-a", roomID)
+	}
+	if roomBExists {
+		t.Error("Retried handshake should not create a new room")
+	}
+
+	// The peer sees exactly one join, plus the LAN hint for sharing localhost
+	peerJoined := 0
+	peer.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	for peer.ReadJSON(&msg) == nil {
+		if msg.Type == MsgTypePeerJoined {
+			peerJoined++
+		}
+	}
+	if peerJoined != 1 {
+		t.Errorf("Peer received %d peer-joined, want 1", peerJoined)
+	}
+}
+
+func TestWebSocket_JoinAck(t *testing.T) {
+	hub := NewHub()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go hub.Run(ctx)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveWs(hub, w, r)
+	}))
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	ws, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer ws.Close()
+
+	var connected, msg SignalingMessage
+	ws.ReadJSON(&connected)
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+
+	// Failed handshake: no room ID
+	ws.WriteJSON(SignalingMessage{Type: MsgTypeHandshakeInit})
+	if err := ws.ReadJSON(&msg); err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	if msg.Type != MsgTypeError {
+		t.Errorf("Expected error for failed handshake, got %v", msg.Type)
+	}
+
+	// Successful handshake
+	ws.WriteJSON(SignalingMessage{Type: MsgTypeHandshakeInit, RoomID: "test-room"})
+	if err := ws.ReadJSON(&msg); err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	if msg.Type != MsgTypeRoomCreated {
+		t.Fatalf("Expected room-created, got %v", msg.Type)
+	}
+	if err := ws.ReadJSON(&msg); err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	if msg.Type != MsgTypeJoined {
+		t.Fatalf("Expected joined, got %v", msg.Type)
+	}
+	if msg.RoomID != "test-room" {
+		t.Errorf("Joined roomId = %q, want test-room", msg.RoomID)
+	}
+	if msg.ClientID != connected.ClientID {
+		t.Errorf("Joined clientId = %q, want %q", msg.ClientID, connected.ClientID)
+	}
+}
+
+func TestWebSocket_SessionStats(t *testing.T) {
+	hub := NewHub()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go hub.Run(ctx)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveWs(hub, w, r)
+	}))
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	ws, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer ws.Close()
+
+	var received int64
+	read := func() SignalingMessage {
+		ws.SetReadDeadline(time.Now().Add(time.Second))
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatalf("Failed to read: %v", err)
+		}
+		received += int64(len(data))
+		var msg SignalingMessage
+		json.Unmarshal(data, &msg)
+		return msg
+	}
+
+	read() // connected
+	join := []byte(`{"type":"handshake-init","roomId":"test-room"}`)
+	ws.WriteMessage(websocket.TextMessage, join)
+	read() // room-created
+	read() // joined
+	time.Sleep(10 * time.Millisecond)
+
+	// The reply itself isn't counted yet when the stats are taken
+	want := received
+	query := []byte(`{"type":"session-stats"}`)
+	ws.WriteMessage(websocket.TextMessage, query)
+	msg := read()
+	if msg.Type != MsgTypeSessionStats {
+		t.Fatalf("Expected session-stats, got %v", msg.Type)
+	}
+
+	var stats SessionStatsPayload
+	if err := json.Unmarshal(msg.Payload, &stats); err != nil {
+		t.Fatalf("Failed to parse stats: %v", err)
+	}
+	if stats.MessagesSent != 2 || stats.BytesSent != int64(len(join)+len(query)) {
+		t.Errorf("Sent %d messages / %d bytes, want 2 / %d",
+			stats.MessagesSent, stats.BytesSent, len(join)+len(query))
+	}
+	if stats.MessagesReceived != 3 || stats.BytesReceived != want {
+		t.Errorf("Received %d messages / %d bytes, want 3 / %d",
+			stats.MessagesReceived, stats.BytesReceived, want)
+	}
+}
+
+func TestHub_RoomDenylist(t *testing.T) {
+	t.Setenv("ROOM_DENYLIST", "admin, ,test")
+	hub := NewHub()
+	hub.configureFromEnv()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go hub.Run(ctx)
+
+	client, conn := connectMem(t, hub)
+	for _, roomID := range []string{"admin", "test"} {
+		conn.send(t, SignalingMessage{Type: MsgTypeHandshakeInit, RoomID: roomID})
+		conn.expect(t, MsgTypeError)
+		if got := client.lastError.Load(); got == nil || got.Code != ErrCodeRoomDenied {
+			t.Errorf("%s: expected %s, got %+v", roomID, ErrCodeRoomDenied, got)
+		}
+	}
+	hub.mu.RLock()
+	created := len(hub.rooms)
+	hub.mu.RUnlock()
+	if created != 0 {
+		t.Errorf("Denylisted joins created %d rooms", created)
+	}
+
+	conn.send(t, SignalingMessage{Type: MsgTypeHandshakeInit, RoomID: "transfer-42"})
+	conn.expect(t, MsgTypeJoined)
+	if len(hub.roomDenylist) != 2 || hub.roomDenylist[""] {
+		t.Errorf("Unexpected denylist %v", hub.roomDenylist)
+	}
+}
+
+func TestHub_MaxPendingHandshakes(t *testing.T) {
+	hub := NewHub()
+	hub.maxHandshakes = 2
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go hub.Run(ctx)
+
+	clients := make([]*Client, 4)
+	for i := range clients {
+		clients[i] = &Client{ID: fmt.Sprintf("client-%d", i), Hub: hub, Send: make(chan []byte, 256)}
+		hub.register <- clients[i]
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	hub.JoinRoom(clients[0], "room-a")
+	hub.JoinRoom(clients[1], "room-b")
+	if err := hub.JoinRoom(clients[2], "room-c"); err != errServerBusy {
+		t.Fatalf("Expected new room to be throttled, got %v", err)
+	}
+
+	// Existing rooms can still be joined, and an answer frees a slot
+	if err := hub.JoinRoom(clients[2], "room-a"); err != nil {
+		t.Fatalf("Joining a pending room failed: %v", err)
+	}
+	hub.broadcast <- &SignalingMessage{Type: MsgTypeOffer, From: clients[0].ID, RoomID: "room-a"}
+	hub.broadcast <- &SignalingMessage{Type: MsgTypeAnswer, From: clients[2].ID, RoomID: "room-a"}
+	time.Sleep(20 * time.Millisecond)
+	if err := hub.JoinRoom(clients[3], "room-c"); err != nil {
+		t.Errorf("New room refused after a handshake completed: %v", err)
+	}
+
+	// Deleting a pending room frees its slot too
+	hub.LeaveRoom(clients[1], "room-b")
+	if n := hub.handshakes.n.Load(); n != 1 {
+		t.Errorf("Expected 1 pending handshake, got %d", n)
+	}
+}
+
+func TestHub_DeprecationWarning(t *testing.T) {
+	hub := NewHub()
+	hub.upcomingMinVersion = 2
+	hub.deprecationEvery = 30 * time.Millisecond
+	hub.deprecationDeadline = time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go hub.Run(ctx)
+
+	old := &Client{ID: "old", Subprotocol: "warp.v1", Hub: hub, Send: make(chan []byte, 256)}
+	current := &Client{ID: "current", Subprotocol: "warp.v2", Hub: hub, Send: make(chan []byte, 256)}
+	hub.register <- old
+	hub.register <- current
+	time.Sleep(100 * time.Millisecond)
+
+	warnings := 0
+	for len(old.Send) > 0 {
+		var sm SignalingMessage
+		json.Unmarshal(<-old.Send, &sm)
+		if sm.Type != MsgTypeDeprecation {
+			continue
+		}
+		warnings++
+		var payload DeprecationWarningPayload
+		json.Unmarshal(sm.Payload, &payload)
+		if payload.MinVersion != 2 || payload.Deadline == nil || !payload.Deadline.Equal(hub.deprecationDeadline) {
+			t.Errorf("Unexpected warning payload: %s", sm.Payload)
+		}
+	}
+	if warnings < 2 {
+		t.Errorf("Old client got %d warnings, want one on connect plus periodic ones", warnings)
+	}
+	if old.closed.Load() {
+		t.Error("Old client should stay connected during the deprecation window")
+	}
+
+	for len(current.Send) > 0 {
+		var sm SignalingMessage
+		json.Unmarshal(<-current.Send, &sm)
+		if sm.Type == MsgTypeDeprecation {
+			t.Error("Current client should not be warned")
+		}
+	}
+}
+
+func TestClient_ServerTime(t *testing.T) {
+	hub := NewHub()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go hub.Run(ctx)
+
+	_, conn := connectMem(t, hub)
+	before := time.Now().UnixMilli()
+	conn.send(t, SignalingMessage{Type: MsgTypeServerTime})
+	msg := conn.expect(t, MsgTypeServerTime)
+	after := time.Now().UnixMilli()
+
+	var payload ServerTimePayload
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+		t.Fatalf("Failed to parse server time: %v", err)
+	}
+	if payload.ServerTimeMs < before || payload.ServerTimeMs > after {
+		t.Errorf("Server time %d outside [%d, %d]", payload.ServerTimeMs, before, after)
 	}
 }
 
@@ -446,6 +3531,26 @@ func TestMessageType_Constants(t *testing.T) {
 		{MsgTypePeerJoined, "peer-joined"},
 		{MsgTypePeerLeft, "peer-left"},
 		{MsgTypeRoomExpired, "room-expired"},
+		{MsgTypeResetRoom, "reset-room"},
+		{MsgTypeRoomState, "room-state"},
+		{MsgTypeDisconnect, "disconnect"},
+		{MsgTypeLANHint, "lan-hint"},
+		{MsgTypeLeaveRoom, "leave-room"},
+		{MsgTypeFeatures, "features"},
+		{MsgTypeJoined, "joined"},
+		{MsgTypeReady, "ready"},
+		{MsgTypeStuck, "stuck"},
+		{MsgTypeSessionStats, "session-stats"},
+		{MsgTypeRelay, "relay"},
+		{MsgTypeKeepalive, "keepalive"},
+		{MsgTypeCancelOffer, "cancel-offer"},
+		{MsgTypeServerShutdown, "server-shutdown"},
+		{MsgTypeExtendRoom, "extend-room"},
+		{MsgTypeBackpressure, "backpressure"},
+		{MsgTypeServerTime, "server-time"},
+		{MsgTypeDeprecation, "deprecation-warning"},
+		{MsgTypeRoomFull, "room-full"},
+		{MsgTypeRoomCreated, "room-created"},
 	}
 
 	for _, tt := range tests {
@@ -454,3 +3559,276 @@ func TestMessageType_Constants(t *testing.T) {
 		}
 	}
 }
+
+// syncBuffer is a bytes.Buffer safe for use as a log sink across goroutines
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestWebSocket_FragmentedMessage(t *testing.T) {
+	hub := NewHub()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go hub.Run(ctx)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveWs(hub, w, r)
+	}))
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	// A small write buffer makes the dialer split messages into many frames
+	dialer := &websocket.Dialer{WriteBufferSize: 1024}
+	sender, _, err := dialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer sender.Close()
+	receiver, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer receiver.Close()
+
+	for _, ws := range []*websocket.Conn{sender, receiver} {
+		ws.WriteJSON(SignalingMessage{Type: MsgTypeHandshakeInit, RoomID: "frag-room"})
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	sdp := strings.Repeat("a=candidate:1 1 udp 2122260223 192.168.1.2 54321 typ host\r\n", 500)
+	payload, _ := json.Marshal(map[string]string{"sdp": sdp})
+	data, _ := json.Marshal(SignalingMessage{Type: MsgTypeOffer, RoomID: "frag-room", Payload: payload})
+	if len(data) <= 4*1024 || len(data) >= maxMessageSize {
+		t.Fatalf("Test message size %d should span frames but fit the limit", len(data))
+	}
+
+	w, err := sender.NextWriter(websocket.TextMessage)
+	if err != nil {
+		t.Fatalf("Failed to start message: %v", err)
+	}
+	for i := 0; i < len(data); i += 1000 {
+		w.Write(data[i:min(i+1000, len(data))])
+	}
+	w.Close()
+
+	receiver.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		var msg SignalingMessage
+		if err := receiver.ReadJSON(&msg); err != nil {
+			t.Fatalf("Offer not received: %v", err)
+		}
+		if msg.Type != MsgTypeOffer {
+			continue
+		}
+		var got map[string]string
+		json.Unmarshal(msg.Payload, &got)
+		if got["sdp"] != sdp {
+			t.Errorf("Reassembled SDP differs: got %d bytes, want %d", len(got["sdp"]), len(sdp))
+		}
+		break
+	}
+}
+
+func TestWebSocket_MessageTooBig(t *testing.T) {
+	hub := NewHub()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go hub.Run(ctx)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveWs(hub, w, r)
+	}))
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	tests := []struct {
+		name   string
+		dialer *websocket.Dialer
+		reason string
+	}{
+		// gorilla/websocket closes with no reason, and may reset the
+		// connection before the still-writing client reads the close frame
+		{"fragmented on the wire", &websocket.Dialer{WriteBufferSize: 1024}, ""},
+		// Compresses to a fraction of the limit but inflates past it
+		{"inflated", &websocket.Dialer{EnableCompression: true}, CloseReasonMessageTooBig},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ws, _, err := tt.dialer.Dial(wsURL, nil)
+			if err != nil {
+				t.Fatalf("Failed to connect: %v", err)
+			}
+			defer ws.Close()
+
+			payload, _ := json.Marshal(map[string]string{"sdp": strings.Repeat("a", 2*maxMessageSize)})
+			ws.WriteJSON(SignalingMessage{Type: MsgTypeOffer, Payload: payload})
+
+			ws.SetReadDeadline(time.Now().Add(time.Second))
+			for {
+				_, _, err := ws.ReadMessage()
+				if err == nil {
+					continue
+				}
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					t.Fatal("Connection still open after oversized message")
+				}
+				if tt.reason == "" {
+					return
+				}
+				var closeErr *websocket.CloseError
+				if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseMessageTooBig {
+					t.Fatalf("Expected close 1009, got %v", err)
+				}
+				if closeErr.Text != tt.reason {
+					t.Errorf("Close reason = %q, want %q", closeErr.Text, tt.reason)
+				}
+				return
+			}
+		})
+	}
+}
+
+func TestHub_ConnectionStormLogsSummary(t *testing.T) {
+	var buf bytes.Buffer
+	prevLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+	defer slog.SetDefault(prevLogger)
+
+	hub := NewHub()
+	hub.handshakeTimeout = 0
+	hub.registerLog = newBurstLog("Clients registered", 5, time.Minute)
+
+	for i := 0; i < 30; i++ {
+		hub.handleRegister(&Client{ID: fmt.Sprintf("client-%d", i), Hub: hub, Send: make(chan []byte, 256)})
+	}
+	if n := strings.Count(buf.String(), `"msg":"Client registered"`); n != 5 {
+		t.Errorf("Logged %d individual registrations, want 5", n)
+	}
+	if strings.Contains(buf.String(), `"msg":"Clients registered"`) {
+		t.Error("Summary logged before the window ended")
+	}
+
+	hub.registerLog.flush(time.Now().Add(time.Minute))
+	var summary struct {
+		Msg      string `json:"msg"`
+		Count    int    `json:"count"`
+		Unlogged int    `json:"unlogged"`
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	json.Unmarshal([]byte(lines[len(lines)-1]), &summary)
+	if summary.Msg != "Clients registered" || summary.Count != 30 || summary.Unlogged != 25 {
+		t.Errorf("Unexpected summary: %+v", summary)
+	}
+}
+
+func TestWebSocket_VerifyJoin(t *testing.T) {
+	hub := NewHub()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go hub.Run(ctx)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveWs(hub, w, r)
+	}))
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	// Connects, asks to join with verify-join and returns the challenge
+	reserve := func(t *testing.T) (*websocket.Conn, string, string) {
+		ws, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		ws.SetReadDeadline(time.Now().Add(time.Second))
+		var connected SignalingMessage
+		ws.ReadJSON(&connected)
+
+		ws.WriteJSON(SignalingMessage{Type: MsgTypeHandshakeInit, RoomID: "verify-room", Features: []string{"verify-join"}})
+		for {
+			var msg SignalingMessage
+			if err := ws.ReadJSON(&msg); err != nil {
+				t.Fatalf("No join challenge: %v", err)
+			}
+			if msg.Type == MsgTypeJoinChallenge {
+				var p JoinChallengePayload
+				json.Unmarshal(msg.Payload, &p)
+				return ws, connected.ClientID, p.Challenge
+			}
+		}
+	}
+	inRoom := func(id string) bool {
+		hub.mu.RLock()
+		defer hub.mu.RUnlock()
+		room, ok := hub.rooms["verify-room"]
+		if !ok {
+			return false
+		}
+		room.mu.RLock()
+		defer room.mu.RUnlock()
+		_, ok = room.Clients[id]
+		return ok
+	}
+
+	t.Run("verified", func(t *testing.T) {
+		ws, id, challenge := reserve(t)
+		defer ws.Close()
+		if challenge == "" {
+			t.Fatal("Empty challenge")
+		}
+		time.Sleep(20 * time.Millisecond)
+		if inRoom(id) {
+			t.Fatal("Client joined before answering the challenge")
+		}
+
+		payload, _ := json.Marshal(JoinChallengePayload{Challenge: challenge})
+		ws.WriteJSON(SignalingMessage{Type: MsgTypeHandshakeVerify, Payload: payload})
+		var msg SignalingMessage
+		ws.ReadJSON(&msg) // room-created
+		if err := ws.ReadJSON(&msg); err != nil || msg.Type != MsgTypeJoined {
+			t.Fatalf("Expected joined, got %v (%v)", msg.Type, err)
+		}
+		if !inRoom(id) {
+			t.Error("Verified client not in room")
+		}
+	})
+
+	t.Run("wrong challenge", func(t *testing.T) {
+		ws, id, _ := reserve(t)
+		defer ws.Close()
+
+		payload, _ := json.Marshal(JoinChallengePayload{Challenge: "guess"})
+		ws.WriteJSON(SignalingMessage{Type: MsgTypeHandshakeVerify, Payload: payload})
+		var msg SignalingMessage
+		if err := ws.ReadJSON(&msg); err != nil || msg.Type != MsgTypeError {
+			t.Fatalf("Expected error, got %v (%v)", msg.Type, err)
+		}
+		var text string
+		json.Unmarshal(msg.Payload, &text)
+		if text != "Join challenge not answered" {
+			t.Errorf("Unexpected error: %q", text)
+		}
+		if inRoom(id) {
+			t.Error("Client added despite failing the challenge")
+		}
+	})
+}
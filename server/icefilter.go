@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"net/netip"
+	"strings"
+)
+
+// candidateFilter decides which ICE candidates are relayed by the IP
+// address in the candidate line. With an allow list only addresses inside
+// it get through (e.g. LAN ranges for LAN-only transfers); addresses inside
+// the deny list never do (e.g. private ranges for privacy).
+type candidateFilter struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+// allows reports whether an ice-candidate payload may be relayed.
+// Candidates without an IP address (mDNS hostnames, end-of-candidates) or
+// that can't be parsed are relayed as they are: the peer's WebRTC stack
+// will reject anything truly broken.
+func (f *candidateFilter) allows(payload json.RawMessage) bool {
+	if len(f.allow) == 0 && len(f.deny) == 0 {
+		return true
+	}
+	addr, ok := candidateAddr(payload)
+	if !ok {
+		return true
+	}
+	if containsAddr(f.deny, addr) {
+		return false
+	}
+	return len(f.allow) == 0 || containsAddr(f.allow, addr)
+}
+
+// candidateAddr extracts the connection address from an RTCIceCandidateInit
+// payload, whose candidate line reads
+// "candidate:<foundation> <component> <transport> <priority> <address> <port> typ <type> ..."
+func candidateAddr(payload json.RawMessage) (netip.Addr, bool) {
+	var init struct {
+		Candidate string `json:"candidate"`
+	}
+	if json.Unmarshal(payload, &init) != nil {
+		return netip.Addr{}, false
+	}
+	fields := strings.Fields(strings.TrimPrefix(init.Candidate, "a="))
+	if len(fields) < 8 || !strings.HasPrefix(fields[0], "candidate:") {
+		return netip.Addr{}, false
+	}
+	addr, err := netip.ParseAddr(fields[4])
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
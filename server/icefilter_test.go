@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"net/netip"
+	"testing"
+)
+
+func candidatePayload(line string) json.RawMessage {
+	payload, _ := json.Marshal(map[string]any{"candidate": line, "sdpMid": "0", "sdpMLineIndex": 0})
+	return payload
+}
+
+func TestCandidateFilter_Allows(t *testing.T) {
+	lan := candidateFilter{allow: []netip.Prefix{netip.MustParsePrefix("192.168.0.0/16"), netip.MustParsePrefix("fd00::/8")}}
+	private := candidateFilter{deny: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("192.168.0.0/16")}}
+
+	tests := []struct {
+		name    string
+		payload json.RawMessage
+		lan     bool
+		private bool
+	}{
+		{"LAN host", candidatePayload("candidate:1 1 udp 2122260223 192.168.1.20 54321 typ host"), true, false},
+		{"public srflx", candidatePayload("candidate:2 1 udp 1686052607 203.0.113.5 61000 typ srflx raddr 192.168.1.20 rport 54321"), false, true},
+		{"IPv6 ULA", candidatePayload("candidate:3 1 udp 2122262783 fd12:3456::1 54322 typ host"), true, true},
+		{"sdp attribute form", candidatePayload("a=candidate:4 1 tcp 1518280447 10.1.2.3 9 typ host tcptype active"), false, false},
+		{"IPv4-mapped IPv6", candidatePayload("candidate:5 1 udp 2122260223 ::ffff:192.168.1.9 54323 typ host"), true, false},
+		// Not filterable by address, so relayed as they are
+		{"mDNS hostname", candidatePayload("candidate:6 1 udp 2122260223 0b1c2d3e.local 54324 typ host"), true, true},
+		{"end of candidates", candidatePayload(""), true, true},
+		{"truncated line", candidatePayload("candidate:7 1 udp"), true, true},
+		{"no candidate field", json.RawMessage(`{"sdpMid":"0"}`), true, true},
+		{"not an object", json.RawMessage(`"candidate"`), true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := lan.allows(tt.payload); got != tt.lan {
+				t.Errorf("LAN-only filter: allows = %v, want %v", got, tt.lan)
+			}
+			if got := private.allows(tt.payload); got != tt.private {
+				t.Errorf("Private-deny filter: allows = %v, want %v", got, tt.private)
+			}
+		})
+	}
+
+	var none candidateFilter
+	if !none.allows(candidatePayload("candidate:1 1 udp 2122260223 10.0.0.1 54321 typ host")) {
+		t.Error("Empty filter should allow every candidate")
+	}
+}
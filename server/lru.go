@@ -0,0 +1,80 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// roomTombstones is a bounded LRU of recently deleted room IDs and why they
+// were deleted. Entries lapse after ttl, so an ID is only held back briefly
+// before it can name a new room. It is safe for concurrent use: a shard
+// records tombstones on whichever shard owns the ID, not just its own.
+type roomTombstones struct {
+	mu       sync.Mutex
+	capacity int
+	ttl      time.Duration
+	order    *list.List // Front is most recently added
+	entries  map[string]*list.Element
+}
+
+type tombstone struct {
+	roomID    string
+	reason    string
+	deletedAt time.Time
+}
+
+func newRoomTombstones(capacity int, ttl time.Duration) *roomTombstones {
+	return &roomTombstones{
+		capacity: capacity,
+		ttl:      ttl,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// add records a room deleted at now, evicting the oldest entry when full
+func (t *roomTombstones) add(roomID, reason string, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if el, ok := t.entries[roomID]; ok {
+		el.Value.(*tombstone).reason = reason
+		el.Value.(*tombstone).deletedAt = now
+		t.order.MoveToFront(el)
+		return
+	}
+	t.entries[roomID] = t.order.PushFront(&tombstone{roomID: roomID, reason: reason, deletedAt: now})
+	if t.order.Len() > t.capacity {
+		t.removeElement(t.order.Back())
+	}
+}
+
+// reason returns why a room was deleted, if that was within ttl of now
+func (t *roomTombstones) reason(roomID string, now time.Time) (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	el, ok := t.entries[roomID]
+	if !ok {
+		return "", false
+	}
+	tomb := el.Value.(*tombstone)
+	if now.Sub(tomb.deletedAt) > t.ttl {
+		t.removeElement(el)
+		return "", false
+	}
+	return tomb.reason, true
+}
+
+// remove forgets a room ID, once a new room has been created with it
+func (t *roomTombstones) remove(roomID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if el, ok := t.entries[roomID]; ok {
+		t.removeElement(el)
+	}
+}
+
+func (t *roomTombstones) removeElement(el *list.Element) {
+	t.order.Remove(el)
+	delete(t.entries, el.Value.(*tombstone).roomID)
+}
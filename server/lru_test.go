@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRoomTombstones_EvictsOldest(t *testing.T) {
+	now := time.Now()
+	tombs := newRoomTombstones(2, time.Minute)
+	tombs.add("room-1", "expired", now)
+	tombs.add("room-2", "stuck", now)
+	tombs.add("room-1", "expired", now) // Refreshes room-1
+	tombs.add("room-3", "expired", now)
+
+	if _, ok := tombs.reason("room-2", now); ok {
+		t.Error("Least recently added room should have been evicted")
+	}
+	if reason, ok := tombs.reason("room-1", now); !ok || reason != "expired" {
+		t.Errorf("room-1 = %q, %v; want expired", reason, ok)
+	}
+	if _, ok := tombs.reason("room-3", now); !ok {
+		t.Error("Newest room should be remembered")
+	}
+}
+
+func TestRoomTombstones_Lapse(t *testing.T) {
+	now := time.Now()
+	tombs := newRoomTombstones(8, time.Minute)
+	tombs.add("room-1", "expired", now)
+	tombs.add("room-2", "expired", now)
+
+	if _, ok := tombs.reason("room-1", now.Add(59*time.Second)); !ok {
+		t.Error("Tombstone should hold within its TTL")
+	}
+	if _, ok := tombs.reason("room-1", now.Add(61*time.Second)); ok {
+		t.Error("Tombstone should lapse after its TTL")
+	}
+	if _, ok := tombs.entries["room-1"]; ok {
+		t.Error("Lapsed tombstone should be dropped")
+	}
+
+	tombs.remove("room-2")
+	if _, ok := tombs.reason("room-2", now); ok {
+		t.Error("Removed tombstone still refuses the ID")
+	}
+}
@@ -2,12 +2,18 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
 	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
 	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -17,20 +23,60 @@ import (
 	"github.com/gorilla/websocket"
 )
 
-// RateLimiter limits connections per IP using Go 1.21+ slices package
+// ConnLimiter decides whether an IP may open another connection
+type ConnLimiter interface {
+	Allow(ip string) bool
+	Stop()
+}
+
+// Rate limiting strategies selectable with RATE_LIMIT_STRATEGY
+const (
+	RateLimitWindow = "window" // RateLimiter's sliding window
+	RateLimitBucket = "bucket" // TokenBucketLimiter
+)
+
+// RateLimiter limits connections per IP using a fixed-size ring buffer per IP
 type RateLimiter struct {
 	mu       sync.Mutex
-	attempts map[string][]time.Time
+	attempts map[string]*attemptRing
 	limit    int
+	warmup   int // Extra attempts granted to an IP the limiter isn't tracking
 	window   time.Duration
+	now      func() time.Time
 	stopCh   chan struct{}
 }
 
+// attemptRing holds the most recent attempt timestamps for a single IP.
+// Its backing array is allocated once with capacity == limit, so memory per
+// IP stays constant no matter how long the IP keeps connecting.
+type attemptRing struct {
+	times  []time.Time
+	head   int // index of the oldest attempt
+	count  int
+	warmup int // remaining warm-up attempts beyond the limit
+}
+
+// evictBefore drops attempts older than cutoff from the front of the ring
+func (r *attemptRing) evictBefore(cutoff time.Time) {
+	for r.count > 0 && r.times[r.head].Before(cutoff) {
+		r.times[r.head] = time.Time{}
+		r.head = (r.head + 1) % len(r.times)
+		r.count--
+	}
+}
+
+// push records an attempt; callers must ensure the ring is not full
+func (r *attemptRing) push(t time.Time) {
+	r.times[(r.head+r.count)%len(r.times)] = t
+	r.count++
+}
+
 func NewRateLimiter(limit int, window time.Duration) *RateLimiter {
 	rl := &RateLimiter{
-		attempts: make(map[string][]time.Time),
+		attempts: make(map[string]*attemptRing),
 		limit:    limit,
 		window:   window,
+		now:      time.Now,
 		stopCh:   make(chan struct{}),
 	}
 	// Cleanup old entries periodically
@@ -49,34 +95,45 @@ func NewRateLimiter(limit int, window time.Duration) *RateLimiter {
 	return rl
 }
 
+// WithWarmup grants each new IP n attempts beyond the steady-state limit,
+// so clients that retry a few times on startup (e.g. ws then wss) aren't
+// blocked. An IP is new again once cleanup forgets it.
+func (rl *RateLimiter) WithWarmup(n int) *RateLimiter {
+	rl.warmup = n
+	return rl
+}
+
 func (rl *RateLimiter) Stop() {
 	close(rl.stopCh)
 }
 
-// Allow checks if IP is within rate limit using binary search (Go 1.21+)
+// Allow checks if IP is within rate limit. Attempts older than the window
+// are evicted from the IP's ring before the limit is checked.
 func (rl *RateLimiter) Allow(ip string) bool {
 	rl.mu.Lock()
 	defer rl.mu.Unlock()
 
-	now := time.Now()
+	now := rl.now()
 	cutoff := now.Add(-rl.window)
 
-	attempts := rl.attempts[ip]
-
-	// Binary search for cutoff point using slices package (Go 1.21+)
-	idx, _ := slices.BinarySearchFunc(attempts, cutoff, func(t, cutoff time.Time) int {
-		return t.Compare(cutoff)
-	})
+	ring, ok := rl.attempts[ip]
+	if !ok {
+		ring = &attemptRing{times: make([]time.Time, rl.limit), warmup: rl.warmup}
+		rl.attempts[ip] = ring
+	}
 
 	// Keep only recent attempts
-	recent := attempts[idx:]
+	ring.evictBefore(cutoff)
 
-	if len(recent) >= rl.limit {
-		rl.attempts[ip] = recent
+	if ring.count >= rl.limit {
+		if ring.warmup > 0 {
+			ring.warmup--
+			return true
+		}
 		return false
 	}
 
-	rl.attempts[ip] = append(recent, now)
+	ring.push(now)
 	return true
 }
 
@@ -84,16 +141,11 @@ func (rl *RateLimiter) cleanup() {
 	rl.mu.Lock()
 	defer rl.mu.Unlock()
 
-	cutoff := time.Now().Add(-rl.window)
-	for ip, times := range rl.attempts {
-		// Use slices.DeleteFunc for efficient cleanup (Go 1.21+)
-		recent := slices.DeleteFunc(times, func(t time.Time) bool {
-			return t.Before(cutoff)
-		})
-		if len(recent) == 0 {
+	cutoff := rl.now().Add(-rl.window)
+	for ip, ring := range rl.attempts {
+		ring.evictBefore(cutoff)
+		if ring.count == 0 {
 			delete(rl.attempts, ip)
-		} else {
-			rl.attempts[ip] = recent
 		}
 	}
 }
@@ -102,31 +154,213 @@ func (rl *RateLimiter) cleanup() {
 type ServerMetrics struct {
 	StartTime        time.Time
 	TotalConnections atomic.Int64
+	Messages         typeCounter    // Received messages by type
+	Broadcasts       typeCounter    // Messages relayed to peers by type
+	Errors           labeledCounter // Errors sent to clients by code
+	Clients          highWater      // Registered clients across all shards
+	Rooms            peakGauge      // Live rooms across all shards
+	PingsSent        atomic.Int64   // Keepalive pings written to clients
+	PongLagWarnings  atomic.Int64   // Clients flagged for leaving a ping unanswered
+	RateLimited      atomic.Int64   // Upgrades refused by the per-IP rate limiter
+}
+
+// labeledCounter counts events per label. Callers bound the label set.
+type labeledCounter struct {
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+func (c *labeledCounter) Inc(label string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.counts == nil {
+		c.counts = make(map[string]int64)
+	}
+	c.counts[label]++
+}
+
+func (c *labeledCounter) Get(label string) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.counts[label]
+}
+
+// typeCounter counts messages per type without locking, so the read pumps
+// and hub loops counting them don't contend. The map is filled once with
+// every known type and never written after; only the counters change.
+type typeCounter map[MessageType]*atomic.Int64
+
+func newTypeCounter() typeCounter {
+	c := make(typeCounter, len(knownMessageTypes)+1)
+	for _, t := range append(knownMessageTypes, "unknown") {
+		c[t] = new(atomic.Int64)
+	}
+	return c
+}
+
+// Inc counts a message. Types outside the known set share the "unknown"
+// label so clients can't inflate label cardinality.
+func (c typeCounter) Inc(t MessageType) {
+	n, ok := c[t]
+	if !ok {
+		n = c["unknown"]
+	}
+	n.Add(1)
+}
+
+func (c typeCounter) Get(t MessageType) int64 {
+	if n, ok := c[t]; ok {
+		return n.Load()
+	}
+	return 0
+}
+
+// snapshot returns the current count of every type
+func (c typeCounter) snapshot() map[MessageType]int64 {
+	counts := make(map[MessageType]int64, len(c))
+	for t, n := range c {
+		counts[t] = n.Load()
+	}
+	return counts
+}
+
+// highWater is a peakGauge that warns once when it climbs to the alert
+// threshold. It re-arms only after falling below 90% of the threshold, so a
+// count hovering at the threshold doesn't flood the logs.
+type highWater struct {
+	peakGauge
+	threshold atomic.Int64 // 0 disables the alert
+	mu        sync.Mutex   // Guards alerted
+	alerted   bool
+}
+
+// SetThreshold sets the level that triggers the alert
+func (w *highWater) SetThreshold(n int) {
+	w.threshold.Store(int64(n))
+}
+
+// Add moves the gauge by delta, logging any threshold crossing
+func (w *highWater) Add(delta int64) {
+	n := w.peakGauge.Add(delta)
+	threshold := w.threshold.Load()
+	if threshold <= 0 {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.alerted && n >= threshold {
+		w.alerted = true
+		slog.Warn("Active clients reached alert threshold",
+			slog.Int64("clients", n),
+			slog.Int64("threshold", threshold))
+	} else if w.alerted && n < threshold*9/10 {
+		w.alerted = false
+		slog.Info("Active clients recovered below alert threshold",
+			slog.Int64("clients", n),
+			slog.Int64("threshold", threshold))
+	}
+}
+
+// peakGauge tracks a gauge and the highest value it has reached, lock-free
+type peakGauge struct {
+	current atomic.Int64
+	peak    atomic.Int64
+}
+
+// Add moves the gauge by delta, raising the peak if it climbs past it, and
+// returns the new value
+func (g *peakGauge) Add(delta int64) int64 {
+	n := g.current.Add(delta)
+	for {
+		peak := g.peak.Load()
+		if n <= peak || g.peak.CompareAndSwap(peak, n) {
+			return n
+		}
+	}
+}
+
+// Peak returns the highest value the gauge has reached
+func (g *peakGauge) Peak() int64 {
+	return g.peak.Load()
 }
 
 var metrics = &ServerMetrics{
-	StartTime: time.Now(),
+	StartTime:  time.Now(),
+	Messages:   newTypeCounter(),
+	Broadcasts: newTypeCounter(),
 }
 
 func (m *ServerMetrics) IncrementConnections() {
 	m.TotalConnections.Add(1)
 }
 
-func (m *ServerMetrics) GetMetrics(hub *Hub) map[string]any {
-	hub.mu.RLock()
-	activeRooms := len(hub.rooms)
-	activeClients := len(hub.clients)
-	hub.mu.RUnlock()
+// CountMessage records a received message
+func (m *ServerMetrics) CountMessage(t MessageType) {
+	m.Messages.Inc(t)
+}
+
+// CountBroadcast records a message admitted for relay to peers
+func (m *ServerMetrics) CountBroadcast(t MessageType) {
+	m.Broadcasts.Inc(t)
+}
+
+// CountError records an error sent to a client
+func (m *ServerMetrics) CountError(code string) {
+	m.Errors.Inc(code)
+}
+
+// GetMetrics reports server statistics summed over the given hub shards
+func (m *ServerMetrics) GetMetrics(hubs ...*Hub) map[string]any {
+	activeRooms, activeClients, clientsInRooms, compressedClients := 0, 0, 0, 0
+	byVersion := map[string]int{}
+	for _, hub := range hubs {
+		hub.mu.RLock()
+		activeRooms += len(hub.rooms)
+		for _, client := range hub.clients {
+			// Skip connections that are closed but not yet unregistered
+			if client.closed.Load() {
+				continue
+			}
+			activeClients++
+			if client.RoomID != "" {
+				clientsInRooms++
+			}
+			if client.Compressed {
+				compressedClients++
+			}
+			version := client.Version
+			if version == "" {
+				version = "unknown"
+			}
+			byVersion[version]++
+		}
+		hub.mu.RUnlock()
+	}
 
 	return map[string]any{
-		"status":            "healthy",
-		"service":           "warp-lan-signaling",
-		"uptime_seconds":    int(time.Since(m.StartTime).Seconds()),
-		"total_connections": m.TotalConnections.Load(),
-		"active_rooms":      activeRooms,
-		"active_clients":    activeClients,
-		"version":           "1.0.0",
-		"timestamp":         time.Now().UTC().Format(time.RFC3339),
+		"status":               "healthy",
+		"service":              "warp-lan-signaling",
+		"uptime_seconds":       int(time.Since(m.StartTime).Seconds()),
+		"total_connections":    m.TotalConnections.Load(),
+		"active_rooms":         activeRooms,
+		"active_clients":       activeClients,
+		"clients_in_rooms":     clientsInRooms,
+		"idle_clients":         activeClients - clientsInRooms,
+		"compressed_clients":   compressedClients,
+		"uncompressed_clients": activeClients - compressedClients,
+		"peak_active_clients":  m.Clients.Peak(),
+		"peak_active_rooms":    m.Rooms.Peak(),
+		"pings_sent":           m.PingsSent.Load(),
+		"pong_lag_warnings":    m.PongLagWarnings.Load(),
+		"rate_limited":         m.RateLimited.Load(),
+		"message_counts": map[string]any{
+			"received": m.Messages.snapshot(),
+			"relayed":  m.Broadcasts.snapshot(),
+		},
+		"clients_by_version": byVersion,
+		"version":            "1.0.0",
+		"timestamp":          time.Now().UTC().Format(time.RFC3339),
 	}
 }
 
@@ -145,6 +379,60 @@ func getClientIP(r *http.Request) string {
 	return strings.Split(r.RemoteAddr, ":")[0]
 }
 
+// maxClientVersionLength bounds the advertised version kept per client
+const maxClientVersionLength = 32
+
+// clientVersion returns the app version a client advertised in the
+// ?version= query param (browsers can't set WebSocket headers) or the
+// X-Client-Version header. Anything that doesn't look like a version is
+// ignored, so clients can't fill the metrics with arbitrary strings.
+func clientVersion(r *http.Request) string {
+	v := r.URL.Query().Get("version")
+	if v == "" {
+		v = r.Header.Get("X-Client-Version")
+	}
+	if len(v) > maxClientVersionLength {
+		return ""
+	}
+	for _, c := range v {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || strings.ContainsRune(".-+_", c)) {
+			return ""
+		}
+	}
+	return v
+}
+
+// IPHasher replaces client IPs with a salted hash before they are logged,
+// so operators can correlate requests without storing PII. The salt is
+// random per process run, keeping hashes stable only until restart.
+type IPHasher struct {
+	enabled bool
+	salt    []byte
+}
+
+func NewIPHasher(enabled bool) *IPHasher {
+	h := &IPHasher{enabled: enabled}
+	if enabled {
+		h.salt = make([]byte, 16)
+		if _, err := rand.Read(h.salt); err != nil {
+			panic("failed to generate IP hash salt: " + err.Error())
+		}
+	}
+	return h
+}
+
+// Redact returns the IP unchanged, or its salted hash when hashing is enabled
+func (h *IPHasher) Redact(ip string) string {
+	if !h.enabled {
+		return ip
+	}
+	sum := sha256.Sum256(append(append([]byte{}, h.salt...), ip...))
+	return "ip-" + hex.EncodeToString(sum[:8])
+}
+
+// Global IP hasher, enabled with HASH_CLIENT_IPS=true
+var ipHasher = NewIPHasher(envBool("HASH_CLIENT_IPS", false))
+
 // Security headers middleware
 func setSecurityHeaders(w http.ResponseWriter) {
 	w.Header().Set("Content-Security-Policy",
@@ -163,20 +451,24 @@ func setSecurityHeaders(w http.ResponseWriter) {
 	w.Header().Set("Permissions-Policy", "geolocation=(), microphone=(), camera=()")
 }
 
+// originAllowed reports whether origin is on the ALLOWED_ORIGINS whitelist.
+// Empty entries from stray commas are skipped and a missing origin never
+// matches, so a malformed list can't admit requests without an Origin
+// header. Every origin is allowed when the variable is unset.
+func originAllowed(origin string) bool {
+	if os.Getenv("ALLOWED_ORIGINS") == "" {
+		return true
+	}
+	return origin != "" && slices.Contains(envList("ALLOWED_ORIGINS"), origin)
+}
+
 func setCORSHeaders(w http.ResponseWriter, r *http.Request) {
 	origin := r.Header.Get("Origin")
-	allowedOrigins := os.Getenv("ALLOWED_ORIGINS")
 
-	if allowedOrigins == "" {
+	if os.Getenv("ALLOWED_ORIGINS") == "" {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-	} else {
-		origins := strings.Split(allowedOrigins, ",")
-		for _, allowed := range origins {
-			if strings.TrimSpace(allowed) == origin {
-				w.Header().Set("Access-Control-Allow-Origin", origin)
-				break
-			}
-		}
+	} else if originAllowed(origin) {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
 	}
 
 	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
@@ -186,28 +478,58 @@ func setCORSHeaders(w http.ResponseWriter, r *http.Request) {
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
+	Subprotocols:    supportedSubprotocols(),
+	// Negotiate permessage-deflate; WritePump decides per frame
+	EnableCompression: true,
+	Error:             upgradeError,
 	CheckOrigin: func(r *http.Request) bool {
-		origin := r.Header.Get("Origin")
-		allowedOrigins := os.Getenv("ALLOWED_ORIGINS")
-
-		// Development mode: allow all if not set
-		if allowedOrigins == "" {
-			return true
-		}
-
-		// Production: check against whitelist
-		origins := strings.Split(allowedOrigins, ",")
-		for _, allowed := range origins {
-			if strings.TrimSpace(allowed) == origin {
-				return true
-			}
-		}
-		return false
+		// Development mode allows all when ALLOWED_ORIGINS is unset
+		return originAllowed(r.Header.Get("Origin"))
 	},
 }
 
 // Global rate limiter: 5 connections per minute per IP (security audit recommendation)
-var rateLimiter = NewRateLimiter(5, time.Minute)
+var rateLimiter = newConnLimiter(os.Getenv("RATE_LIMIT_STRATEGY"))
+
+// newConnLimiter returns the connection limiter for strategy. The sliding
+// window grants a warm-up burst of 3 to IPs seen for the first time; the
+// token bucket refills at the same 5 a minute, bursting to RATE_LIMIT_BURST.
+func newConnLimiter(strategy string) ConnLimiter {
+	switch strategy {
+	case RateLimitBucket:
+		return NewTokenBucketLimiter(5.0/60, envInt("RATE_LIMIT_BURST", 5))
+	case "", RateLimitWindow:
+	default:
+		slog.Warn("Invalid RATE_LIMIT_STRATEGY, using the sliding window",
+			slog.String("value", strategy))
+	}
+	return NewRateLimiter(5, time.Minute).WithWarmup(3)
+}
+
+// Global cap on open connections per origin, set with
+// MAX_CONNECTIONS_PER_ORIGIN (0 disables)
+var originLimiter = NewOriginLimiter(envInt("MAX_CONNECTIONS_PER_ORIGIN", 0))
+
+// Global cap on reconnects per authenticated identity, set with
+// MAX_RECONNECTS_PER_MINUTE; nil when unlimited
+var reconnectLimiter = newReconnectLimiter(envInt("MAX_RECONNECTS_PER_MINUTE", 0))
+
+// newReconnectLimiter returns a limiter allowing perMinute connections per
+// identity, or nil if perMinute is not positive. An identity over the limit
+// is blocked until its oldest attempt ages out of the minute.
+func newReconnectLimiter(perMinute int) *RateLimiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	return NewRateLimiter(perMinute, time.Minute)
+}
+
+// Headers every /ws request must carry, such as one injected by a gateway
+// in front of the server, set with REQUIRED_UPGRADE_HEADERS
+var requiredHeaders = envList("REQUIRED_UPGRADE_HEADERS")
+
+// Global User-Agent filter, set with USER_AGENT_ALLOW and USER_AGENT_DENY
+var userAgentFilter = NewUserAgentFilter(envList("USER_AGENT_ALLOW"), envList("USER_AGENT_DENY"))
 
 func main() {
 	// Setup structured logging with slog (Go 1.21+)
@@ -220,28 +542,32 @@ func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	hub := NewHub()
-	go hub.Run(ctx)
+	shards := NewShardedHub(envInt("HUB_SHARDS", 1))
+	shards.configureFromEnv()
+	metrics.Clients.SetThreshold(envInt("CLIENT_ALERT_THRESHOLD", 0))
+	shards.Run(ctx)
+	hub := shards.Entry()
 
 	// WebSocket endpoint with rate limiting
-	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
-		clientIP := getClientIP(r)
-		if !rateLimiter.Allow(clientIP) {
-			slog.Warn("Rate limited client",
-				slog.String("ip", clientIP))
-			http.Error(w, "Too many requests", http.StatusTooManyRequests)
-			return
-		}
-		serveWs(hub, w, r)
-	})
+	http.HandleFunc("/ws", allowMethods(wsHandler(hub), http.MethodGet, http.MethodOptions))
 
 	// Health check endpoint with metrics
-	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		setSecurityHeaders(w)
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(metrics.GetMetrics(hub))
-	})
+	http.HandleFunc("/health", allowMethods(healthHandler(shards.shards...), http.MethodGet))
+
+	// Prometheus metrics
+	http.HandleFunc("/metrics", allowMethods(prometheusHandler(shards.shards...), http.MethodGet))
+
+	// Directory of rooms created as public
+	http.HandleFunc("/rooms/public", allowMethods(publicRoomsHandler(shards.shards...), http.MethodGet))
+
+	// Every live room with its client count, for ops dashboards; needs ADMIN_TOKEN
+	http.HandleFunc("/rooms", allowMethods(roomsHandler(shards.shards...), http.MethodGet))
+
+	// Admin diagnostics, enabled by ADMIN_TOKEN
+	http.HandleFunc("/admin/clients", allowMethods(adminClientsHandler(shards.shards...), http.MethodGet))
+	http.HandleFunc("/admin/events", allowMethods(adminEventsHandler(hub.events), http.MethodGet))
+	http.HandleFunc("/admin/rooms/migrate", allowMethods(adminMigrateHandler(shards), http.MethodPost))
+	http.HandleFunc("/admin/rooms/", allowMethods(adminRoomHandler(shards), http.MethodGet))
 
 	// CORS middleware for preflight
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -266,12 +592,29 @@ func main() {
 		IdleTimeout:  60 * time.Second,
 	}
 
+	// Serve TLS directly when given a certificate, rather than behind a
+	// terminating proxy
+	certFile, keyFile := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+	useTLS := certFile != "" && keyFile != ""
+	if useTLS {
+		server.TLSConfig = &tls.Config{
+			MinVersion: envTLSVersion("TLS_MIN_VERSION", tls.VersionTLS12),
+		}
+	}
+
 	// Start server in goroutine
 	go func() {
 		slog.Info("Starting Warp-LAN Signaling Server",
 			slog.String("port", port),
+			slog.Bool("tls", useTLS),
 			slog.String("version", "1.0.0"))
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		var err error
+		if useTLS {
+			err = server.ListenAndServeTLS(certFile, keyFile)
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			slog.Error("Server error",
 				slog.String("error", err.Error()))
 			os.Exit(1)
@@ -303,23 +646,216 @@ func main() {
 	slog.Info("Server stopped")
 }
 
+// checkConnectKey validates the deployment-wide pre-shared key, given via
+// the ?key= query param or the X-Connect-Key header. When CONNECT_KEY is
+// unset every client is allowed.
+func checkConnectKey(r *http.Request) bool {
+	expected := os.Getenv("CONNECT_KEY")
+	if expected == "" {
+		return true
+	}
+
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		key = r.Header.Get("X-Connect-Key")
+	}
+	return subtle.ConstantTimeCompare([]byte(key), []byte(expected)) == 1
+}
+
+// allowMethods rejects requests using a method other than those listed with
+// 405 and an Allow header naming the permitted ones
+func allowMethods(next http.HandlerFunc, methods ...string) http.HandlerFunc {
+	allow := strings.Join(methods, ", ")
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !slices.Contains(methods, r.Method) {
+			w.Header().Set("Allow", allow)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// healthHandler reports service health with metrics across the given hubs
+func healthHandler(hubs ...*Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		setSecurityHeaders(w)
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(metrics.GetMetrics(hubs...))
+	}
+}
+
+// wsHandler wraps serveWs with an upgrade pre-check, per-IP rate limiting
+// and the connect key check
+func wsHandler(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Upgrades aren't preflighted, but some browsers and proxies send
+		// OPTIONS anyway; answer it without attempting an upgrade
+		if r.Method == http.MethodOptions {
+			setCORSHeaders(w, r)
+			setSecurityHeaders(w)
+			w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-Connect-Key")
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		// Reject plain HTTP before it costs the client a rate-limit token
+		if !websocket.IsWebSocketUpgrade(r) {
+			w.Header().Set("Upgrade", "websocket")
+			writeUpgradeFailure(w, http.StatusUpgradeRequired,
+				UpgradeReasonNotWebSocket, "WebSocket upgrade required")
+			return
+		}
+
+		clientIP := getClientIP(r)
+		if !rateLimiter.Allow(clientIP) {
+			metrics.RateLimited.Add(1)
+			slog.Warn("Rate limited client",
+				slog.String("ip", ipHasher.Redact(clientIP)))
+			writeUpgradeFailure(w, http.StatusTooManyRequests,
+				UpgradeReasonRateLimited, "Too many connection attempts, retry later")
+			return
+		}
+		if !checkConnectKey(r) {
+			slog.Warn("Rejected client with invalid connect key",
+				slog.String("ip", ipHasher.Redact(clientIP)))
+			writeUpgradeFailure(w, http.StatusUnauthorized,
+				UpgradeReasonConnectKey, "Missing or invalid connect key")
+			return
+		}
+		serveWs(hub, w, r)
+	}
+}
+
 func serveWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
 	setCORSHeaders(w, r)
 	setSecurityHeaders(w)
 
+	// During shutdown the hub loop is gone and would never register us
+	if hub.stopped() {
+		writeUpgradeFailure(w, http.StatusServiceUnavailable,
+			UpgradeReasonShuttingDown, "Server shutting down: "+hub.shutdownReason)
+		return
+	}
+
+	if !userAgentFilter.Allowed(r.UserAgent()) {
+		slog.Warn("Rejected disallowed User-Agent",
+			slog.String("userAgent", r.UserAgent()),
+			slog.String("ip", ipHasher.Redact(getClientIP(r))))
+		writeUpgradeFailure(w, http.StatusForbidden,
+			UpgradeReasonUserAgent, "User-Agent not allowed")
+		return
+	}
+
+	if name := missingHeader(r, requiredHeaders); name != "" {
+		slog.Warn("Rejected upgrade missing a required header",
+			slog.String("header", name),
+			slog.String("ip", ipHasher.Redact(getClientIP(r))))
+		writeUpgradeFailure(w, http.StatusForbidden,
+			UpgradeReasonMissingHeader, "Missing required header "+name)
+		return
+	}
+
+	identity, err := authenticate(r)
+	if err != nil {
+		slog.Warn("Rejected unauthenticated client",
+			slog.String("error", err.Error()),
+			slog.String("ip", ipHasher.Redact(getClientIP(r))))
+		writeUpgradeFailure(w, http.StatusUnauthorized,
+			UpgradeReasonUnauthorized, "Authentication failed")
+		return
+	}
+	// Without an authenticated identity a client may bring its own stable
+	// ID, so reconnecting takes over its old session
+	if identity == "" {
+		identity = r.URL.Query().Get("clientId")
+		if identity != "" && !validClientID(identity) {
+			writeUpgradeFailure(w, http.StatusBadRequest,
+				UpgradeReasonClientID, "Invalid clientId")
+			return
+		}
+	}
+	// Reconnecting dozens of times a minute points to a client bug or abuse
+	if identity != "" && reconnectLimiter != nil && !reconnectLimiter.Allow(identity) {
+		slog.Warn("Throttled reconnecting identity",
+			slog.String("identity", identity))
+		writeUpgradeFailure(w, http.StatusTooManyRequests,
+			UpgradeReasonReconnectChurn, "Reconnecting too often, retry later")
+		return
+	}
+
+	origin, limiter := r.Header.Get("Origin"), originLimiter
+	if !limiter.Acquire(origin) {
+		slog.Warn("Origin connection limit reached",
+			slog.String("origin", origin))
+		writeUpgradeFailure(w, http.StatusTooManyRequests,
+			UpgradeReasonOriginLimit, "Too many connections from origin")
+		return
+	}
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		slog.Error("WebSocket upgrade failed",
 			slog.String("error", err.Error()))
+		limiter.Release(origin)
+		return
+	}
+
+	// Outdated clients get a close frame they can act on rather than a
+	// failed handshake
+	if v := protocolVersion(conn.Subprotocol()); v < hub.minProtocolVersion {
+		slog.Info("Rejected client with outdated protocol",
+			slog.Int("version", v),
+			slog.Int("minVersion", hub.minProtocolVersion),
+			slog.String("ip", ipHasher.Redact(getClientIP(r))))
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.ClosePolicyViolation, CloseReasonUpgradeRequired),
+			time.Now().Add(writeWait))
+		conn.Close()
+		limiter.Release(origin)
 		return
 	}
 
 	metrics.IncrementConnections()
 
+	// Spread clients over shards until they join a room
 	client := NewClient(conn, hub)
-	hub.register <- client
+	if identity != "" {
+		client.ID = identity
+		client.reclaim = true
+		client.resumeWith = r.URL.Query().Get("resumeToken")
+	}
+	client.IP = getClientIP(r)
+	client.Version = clientVersion(r)
+	// Clients behind aggressive NATs may ask to be pinged more often, in
+	// seconds; setPingInterval holds them to MIN_PING_INTERVAL
+	if secs, err := strconv.Atoi(r.URL.Query().Get("pingInterval")); err == nil && secs > 0 {
+		client.setPingInterval(time.Duration(secs) * time.Second)
+	}
+	client.Compressed = negotiatedDeflate(&upgrader, r)
+	client.Subprotocol = conn.Subprotocol()
+	client.Hub = hub.shardFor(client.ID)
+	if client.reclaim {
+		client.Hub = hub.sessionShard(client.ID)
+	}
+	select {
+	case client.Hub.register <- client:
+	case <-client.Hub.done:
+		// Shut down since the check above
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseServiceRestart, hub.shutdownReason),
+			time.Now().Add(writeWait))
+		conn.Close()
+		limiter.Release(origin)
+		return
+	}
 
 	// Start client goroutines
 	go client.WritePump()
-	go client.ReadPump()
+	go func() {
+		client.ReadPump()
+		limiter.Release(origin)
+	}()
 }
@@ -1,12 +1,22 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/gorilla/websocket"
 )
 
 func TestRateLimiter_Allow(t *testing.T) {
@@ -106,6 +116,131 @@ func TestRateLimiter_Concurrent(t *testing.T) {
 	}
 }
 
+func TestRateLimiter_WindowBoundary(t *testing.T) {
+	rl := NewRateLimiter(2, time.Minute)
+	defer rl.Stop()
+
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := base
+	rl.now = func() time.Time { return now }
+
+	ip := "192.168.1.1"
+
+	if !rl.Allow(ip) || !rl.Allow(ip) {
+		t.Fatal("First two requests should be allowed")
+	}
+	if rl.Allow(ip) {
+		t.Error("Third request inside the window should be blocked")
+	}
+
+	// An attempt exactly at the cutoff is still inside the window
+	now = base.Add(time.Minute)
+	if rl.Allow(ip) {
+		t.Error("Request exactly at window boundary should be blocked")
+	}
+
+	// Just past the boundary both slots free up, and the ring wraps around
+	now = base.Add(time.Minute + time.Nanosecond)
+	if !rl.Allow(ip) {
+		t.Error("Request after window boundary should be allowed")
+	}
+	if !rl.Allow(ip) {
+		t.Error("Second request after window boundary should be allowed")
+	}
+	if rl.Allow(ip) {
+		t.Error("Third request after wrap-around should be blocked")
+	}
+
+	// Denied attempts must not be recorded
+	now = base.Add(2*time.Minute + 2*time.Nanosecond)
+	if !rl.Allow(ip) {
+		t.Error("Request after second window should be allowed")
+	}
+
+	if got := len(rl.attempts[ip].times); got != 2 {
+		t.Errorf("Ring size = %d, want 2", got)
+	}
+}
+
+func TestRateLimiter_CleanupRemovesIdleIPs(t *testing.T) {
+	rl := NewRateLimiter(2, time.Minute)
+	defer rl.Stop()
+
+	base := time.Now()
+	now := base
+	rl.now = func() time.Time { return now }
+
+	rl.Allow("10.0.0.1")
+	now = base.Add(2 * time.Minute)
+	rl.Allow("10.0.0.2")
+
+	rl.cleanup()
+
+	if _, ok := rl.attempts["10.0.0.1"]; ok {
+		t.Error("Idle IP should be removed by cleanup")
+	}
+	if _, ok := rl.attempts["10.0.0.2"]; !ok {
+		t.Error("Active IP should survive cleanup")
+	}
+}
+
+func TestRateLimiter_Warmup(t *testing.T) {
+	rl := NewRateLimiter(2, time.Minute).WithWarmup(2)
+	defer rl.Stop()
+
+	base := time.Now()
+	now := base
+	rl.now = func() time.Time { return now }
+
+	ip := "192.168.1.1"
+
+	// Fresh IP: limit plus warm-up burst
+	for i := 0; i < 4; i++ {
+		if !rl.Allow(ip) {
+			t.Errorf("Request %d should be allowed during warm-up", i+1)
+		}
+	}
+	if rl.Allow(ip) {
+		t.Error("Request after warm-up burst should be blocked")
+	}
+
+	// Next window: the IP is known, so only the steady-state limit applies
+	now = base.Add(time.Minute + time.Second)
+	if !rl.Allow(ip) || !rl.Allow(ip) {
+		t.Error("Steady-state requests should be allowed")
+	}
+	if rl.Allow(ip) {
+		t.Error("Warm-up should not be granted again to a known IP")
+	}
+
+	// Once cleanup forgets the idle IP it is fresh again
+	now = base.Add(3 * time.Minute)
+	rl.cleanup()
+	for i := 0; i < 4; i++ {
+		if !rl.Allow(ip) {
+			t.Errorf("Request %d should be allowed after IP was forgotten", i+1)
+		}
+	}
+}
+
+func BenchmarkRateLimiter_Allow(b *testing.B) {
+	rl := NewRateLimiter(5, time.Minute)
+	defer rl.Stop()
+
+	// Advance the clock so every call slides the window and records an attempt
+	now := time.Now()
+	rl.now = func() time.Time {
+		now = now.Add(13 * time.Second)
+		return now
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rl.Allow("192.168.1.1")
+	}
+}
+
 func TestGetClientIP(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -155,15 +290,213 @@ func TestGetClientIP(t *testing.T) {
 	}
 }
 
-func TestHealthEndpoint(t *testing.T) {
+func TestIPHasher(t *testing.T) {
+	disabled := NewIPHasher(false)
+	if got := disabled.Redact("203.0.113.1"); got != "203.0.113.1" {
+		t.Errorf("Disabled hasher changed IP to %v", got)
+	}
+
+	h := NewIPHasher(true)
+	first := h.Redact("203.0.113.1")
+	if first == "203.0.113.1" || strings.Contains(first, "203.0.113") {
+		t.Errorf("Enabled hasher leaked raw IP: %v", first)
+	}
+	if again := h.Redact("203.0.113.1"); again != first {
+		t.Errorf("Hash not stable within a run: %v != %v", first, again)
+	}
+	if other := h.Redact("203.0.113.2"); other == first {
+		t.Error("Different IPs should hash differently")
+	}
+	if NewIPHasher(true).Redact("203.0.113.1") == first {
+		t.Error("Salt should differ between hashers")
+	}
+}
+
+func TestWSHandler_LogsHashedIP(t *testing.T) {
+	var buf bytes.Buffer
+	prevLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+	defer slog.SetDefault(prevLogger)
+
+	prevHasher, prevLimiter := ipHasher, rateLimiter
+	ipHasher = NewIPHasher(true)
+	rateLimiter = NewRateLimiter(0, time.Minute) // reject everything
+	defer func() {
+		rateLimiter.Stop()
+		ipHasher, rateLimiter = prevHasher, prevLimiter
+	}()
+
+	req := httptest.NewRequest("GET", "/ws", nil)
+	req.RemoteAddr = "198.51.100.7:4242"
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	rec := httptest.NewRecorder()
+
+	wsHandler(NewHub()).ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected status 429, got %d", rec.Code)
+	}
+	logs := buf.String()
+	if strings.Contains(logs, "198.51.100.7") {
+		t.Errorf("Logs contain raw IP: %s", logs)
+	}
+	if !strings.Contains(logs, ipHasher.Redact("198.51.100.7")) {
+		t.Errorf("Logs missing hashed IP: %s", logs)
+	}
+}
+
+func TestWSHandler_RejectsPlainHTTP(t *testing.T) {
+	prevLimiter := rateLimiter
+	rl := NewRateLimiter(5, time.Minute)
+	rateLimiter = rl
+	defer func() {
+		rateLimiter.Stop()
+		rateLimiter = prevLimiter
+	}()
+
+	req := httptest.NewRequest("GET", "/ws", nil)
+	req.RemoteAddr = "198.51.100.7:4242"
+	rec := httptest.NewRecorder()
+
+	wsHandler(NewHub()).ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusUpgradeRequired {
+		t.Fatalf("Expected status 426, got %d", rec.Code)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %v, want application/json", got)
+	}
+	var body map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Failed to parse JSON: %v", err)
+	}
+	if body["error"] == "" {
+		t.Error("Expected an error message in the body")
+	}
+
+	if _, tracked := rl.attempts["198.51.100.7"]; tracked {
+		t.Error("Plain HTTP request should not consume a rate-limit token")
+	}
+}
+
+func TestWSHandler_ConnectKey(t *testing.T) {
+	prevLimiter := rateLimiter
+	rateLimiter = NewRateLimiter(100, time.Minute)
+	defer func() {
+		rateLimiter.Stop()
+		rateLimiter = prevLimiter
+	}()
+
 	hub := NewHub()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go hub.Run(ctx)
+
+	server := httptest.NewServer(wsHandler(hub))
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	t.Run("no key required by default", func(t *testing.T) {
+		t.Setenv("CONNECT_KEY", "")
+		ws, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+		if err != nil {
+			t.Fatalf("Failed to connect without key: %v", err)
+		}
+		ws.Close()
+	})
+
+	t.Run("correct key in query", func(t *testing.T) {
+		t.Setenv("CONNECT_KEY", "s3cret")
+		ws, _, err := websocket.DefaultDialer.Dial(wsURL+"?key=s3cret", nil)
+		if err != nil {
+			t.Fatalf("Failed to connect with correct key: %v", err)
+		}
+		ws.Close()
+	})
+
+	t.Run("correct key in header", func(t *testing.T) {
+		t.Setenv("CONNECT_KEY", "s3cret")
+		header := http.Header{"X-Connect-Key": []string{"s3cret"}}
+		ws, _, err := websocket.DefaultDialer.Dial(wsURL, header)
+		if err != nil {
+			t.Fatalf("Failed to connect with correct header key: %v", err)
+		}
+		ws.Close()
+	})
+
+	t.Run("wrong key", func(t *testing.T) {
+		t.Setenv("CONNECT_KEY", "s3cret")
+		_, resp, err := websocket.DefaultDialer.Dial(wsURL+"?key=guess", nil)
+		if err == nil {
+			t.Fatal("Expected connection with wrong key to fail")
+		}
+		if resp == nil || resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("Expected status 401, got %v", resp)
+		}
+	})
 
-	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		setSecurityHeaders(w)
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(metrics.GetMetrics(hub))
+	t.Run("missing key", func(t *testing.T) {
+		t.Setenv("CONNECT_KEY", "s3cret")
+		_, resp, err := websocket.DefaultDialer.Dial(wsURL, nil)
+		if err == nil {
+			t.Fatal("Expected connection without key to fail")
+		}
+		if resp == nil || resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("Expected status 401, got %v", resp)
+		}
 	})
+}
+
+func TestServeWs_MinProtocolVersion(t *testing.T) {
+	hub := NewHub()
+	hub.minProtocolVersion = 2
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go hub.Run(ctx)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveWs(hub, w, r)
+	}))
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	dial := func(subprotocols ...string) *websocket.Conn {
+		dialer := websocket.Dialer{Subprotocols: subprotocols}
+		ws, _, err := dialer.Dial(wsURL, nil)
+		if err != nil {
+			t.Fatalf("Failed to connect with %v: %v", subprotocols, err)
+		}
+		return ws
+	}
+
+	for _, offered := range [][]string{{"warp.v1"}, nil} {
+		ws := dial(offered...)
+		ws.SetReadDeadline(time.Now().Add(time.Second))
+		_, _, err := ws.ReadMessage()
+		var closeErr *websocket.CloseError
+		if !errors.As(err, &closeErr) || closeErr.Code != websocket.ClosePolicyViolation ||
+			closeErr.Text != CloseReasonUpgradeRequired {
+			t.Errorf("Offering %v: expected upgrade-required close, got %v", offered, err)
+		}
+		ws.Close()
+	}
+
+	// Current clients are accepted, preferring the newest version offered
+	ws := dial("warp.v1", "warp.v2")
+	defer ws.Close()
+	if got := ws.Subprotocol(); got != "warp.v2" {
+		t.Errorf("Negotiated %q, want warp.v2", got)
+	}
+	var msg SignalingMessage
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	if err := ws.ReadJSON(&msg); err != nil || msg.Type != MsgTypeConnected {
+		t.Errorf("Expected connected, got %v (%v)", msg.Type, err)
+	}
+}
+
+func TestHealthEndpoint(t *testing.T) {
+	handler := healthHandler(NewHub())
 
 	req := httptest.NewRequest("GET", "/health", nil)
 	rec := httptest.NewRecorder()
@@ -187,6 +520,38 @@ func TestHealthEndpoint(t *testing.T) {
 	}
 }
 
+func TestAllowMethods(t *testing.T) {
+	handler := allowMethods(healthHandler(NewHub()), http.MethodGet)
+
+	for _, method := range []string{"POST", "DELETE"} {
+		req := httptest.NewRequest(method, "/health", nil)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusMethodNotAllowed {
+			t.Errorf("%s /health: expected status 405, got %d", method, rec.Code)
+		}
+		if got := rec.Header().Get("Allow"); got != "GET" {
+			t.Errorf("%s /health: Allow = %q, want GET", method, got)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/health", nil)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("GET /health: expected status 200, got %d", rec.Code)
+	}
+
+	// A POST to /ws is refused before the upgrade pre-check
+	req = httptest.NewRequest("POST", "/ws", nil)
+	rec = httptest.NewRecorder()
+	allowMethods(wsHandler(NewHub()), http.MethodGet).ServeHTTP(rec, req)
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST /ws: expected status 405, got %d", rec.Code)
+	}
+}
+
 func TestSecurityHeaders(t *testing.T) {
 	rec := httptest.NewRecorder()
 	setSecurityHeaders(rec)
@@ -224,6 +589,43 @@ func TestCORSHeaders(t *testing.T) {
 	}
 }
 
+func TestOriginAllowed_MalformedConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed string
+		origin  string
+		want    bool
+	}{
+		{"unset allows all", "", "https://any.example", true},
+		{"listed origin", "https://a.example, ,https://b.example", "https://b.example", true},
+		{"stray whitespace trimmed", " https://a.example ,", "https://a.example", true},
+		{"unlisted origin", "https://a.example", "https://evil.example", false},
+		{"empty entry vs no origin", "https://a.example, ,https://b.example", "", false},
+		{"trailing comma vs no origin", "https://a.example,", "", false},
+		{"only separators", " , ,", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("ALLOWED_ORIGINS", tt.allowed)
+
+			req := httptest.NewRequest("GET", "/ws", nil)
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			if got := upgrader.CheckOrigin(req); got != tt.want {
+				t.Errorf("CheckOrigin = %v, want %v", got, tt.want)
+			}
+
+			rec := httptest.NewRecorder()
+			setCORSHeaders(rec, req)
+			got := rec.Header().Get("Access-Control-Allow-Origin")
+			if tt.allowed != "" && (got != "") != tt.want {
+				t.Errorf("Access-Control-Allow-Origin = %q, want set=%v", got, tt.want)
+			}
+		})
+	}
+}
+
 func TestServerMetrics(t *testing.T) {
 	hub := NewHub()
 
@@ -240,3 +642,281 @@ func TestServerMetrics(t *testing.T) {
 		t.Errorf("Expected 0 active rooms, got %v", result["active_rooms"])
 	}
 }
+
+func TestServerMetrics_CompressedClients(t *testing.T) {
+	hub := NewHub()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go hub.Run(ctx)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveWs(hub, w, r)
+	}))
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	compressing := &websocket.Dialer{EnableCompression: true}
+	for _, dialer := range []*websocket.Dialer{compressing, compressing, websocket.DefaultDialer} {
+		ws, _, err := dialer.Dial(wsURL, nil)
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		defer ws.Close()
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	result := (&ServerMetrics{StartTime: time.Now()}).GetMetrics(hub)
+	if result["compressed_clients"].(int) != 2 {
+		t.Errorf("Expected 2 compressed clients, got %v", result["compressed_clients"])
+	}
+	if result["uncompressed_clients"].(int) != 1 {
+		t.Errorf("Expected 1 uncompressed client, got %v", result["uncompressed_clients"])
+	}
+}
+
+func TestServerMetrics_ClientsByVersion(t *testing.T) {
+	hub := NewHub()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go hub.Run(ctx)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveWs(hub, w, r)
+	}))
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	dials := []struct {
+		query  string
+		header http.Header
+	}{
+		{"?version=1.2.0", nil},
+		{"?version=1.2.0", nil},
+		{"", http.Header{"X-Client-Version": []string{"1.3.0-beta+7"}}},
+		{"", nil},
+		{"?version=%3Cscript%3E", nil}, // Not a version
+	}
+	for _, d := range dials {
+		ws, _, err := websocket.DefaultDialer.Dial(wsURL+d.query, d.header)
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		defer ws.Close()
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	result := (&ServerMetrics{StartTime: time.Now()}).GetMetrics(hub)
+	got := result["clients_by_version"].(map[string]int)
+	want := map[string]int{"1.2.0": 2, "1.3.0-beta+7": 1, "unknown": 2}
+	if !maps.Equal(got, want) {
+		t.Errorf("clients_by_version = %v, want %v", got, want)
+	}
+}
+
+func TestHighWater_AlertsOnce(t *testing.T) {
+	var buf bytes.Buffer
+	prevLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+	defer slog.SetDefault(prevLogger)
+
+	var w highWater
+	w.SetThreshold(10)
+	moveTo := func(n int64) {
+		for w.current.Load() < n {
+			w.Add(1)
+		}
+		for w.current.Load() > n {
+			w.Add(-1)
+		}
+	}
+	count := func(msg string) int {
+		return strings.Count(buf.String(), `"msg":"`+msg+`"`)
+	}
+
+	moveTo(12)
+	moveTo(9) // Below the threshold but not the recovery level
+	moveTo(11)
+	if n := count("Active clients reached alert threshold"); n != 1 {
+		t.Errorf("Expected one alert while hovering at the threshold, got %d", n)
+	}
+	if n := count("Active clients recovered below alert threshold"); n != 0 {
+		t.Errorf("Recovered too early: %d", n)
+	}
+
+	moveTo(8)
+	if n := count("Active clients recovered below alert threshold"); n != 1 {
+		t.Errorf("Expected one recovery, got %d", n)
+	}
+	moveTo(10)
+	if n := count("Active clients reached alert threshold"); n != 2 {
+		t.Errorf("Expected the alert to re-arm after recovery, got %d alerts", n)
+	}
+	if w.Peak() != 12 {
+		t.Errorf("Peak = %d, want 12", w.Peak())
+	}
+}
+
+func TestPeakGauge(t *testing.T) {
+	var g peakGauge
+	for _, delta := range []int64{1, 1, 1, -1, -1, 1, -1, -1} {
+		g.Add(delta)
+	}
+	if g.Peak() != 3 || g.current.Load() != 0 {
+		t.Errorf("Peak %d, current %d, want 3 and 0", g.Peak(), g.current.Load())
+	}
+
+	// Concurrent climbs still record the true maximum
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			g.Add(1)
+		}()
+	}
+	wg.Wait()
+	g.Add(-50)
+	if g.Peak() != 50 {
+		t.Errorf("Peak after concurrent adds = %d, want 50", g.Peak())
+	}
+}
+
+func TestServerMetrics_PeakRooms(t *testing.T) {
+	hub := NewHub()
+	start := metrics.Rooms.current.Load()
+	clients := make([]*Client, 3)
+	for i := range clients {
+		clients[i] = &Client{ID: fmt.Sprintf("client-%d", i), Hub: hub, Send: make(chan []byte, 256)}
+		hub.clients[clients[i].ID] = clients[i]
+		hub.JoinRoom(clients[i], fmt.Sprintf("room-%d", i))
+	}
+	for _, c := range clients {
+		hub.LeaveRoom(c, c.RoomID)
+	}
+
+	stats := metrics.GetMetrics(hub)
+	if stats["active_rooms"] != 0 {
+		t.Errorf("active_rooms = %v, want 0", stats["active_rooms"])
+	}
+	if peak := stats["peak_active_rooms"].(int64); peak < start+3 {
+		t.Errorf("peak_active_rooms = %d, want at least %d", peak, start+3)
+	}
+	if _, ok := stats["peak_active_clients"]; !ok {
+		t.Error("peak_active_clients missing")
+	}
+	if _, ok := stats["peak_clients"]; ok {
+		t.Error("Client peak should be reported under one key")
+	}
+}
+
+func TestServerMetrics_MessageCounts(t *testing.T) {
+	hub := NewHub()
+	alice := &Client{ID: "alice", Hub: hub, Send: make(chan []byte, 256)}
+	bob := &Client{ID: "bob", Hub: hub, Send: make(chan []byte, 256)}
+	hub.clients[alice.ID] = alice
+	hub.clients[bob.ID] = bob
+	hub.JoinRoom(alice, "room-123")
+	hub.JoinRoom(bob, "room-123")
+
+	// Counters are process-wide, so assert on deltas
+	counts := func() (received, relayed map[MessageType]int64) {
+		c := metrics.GetMetrics(hub)["message_counts"].(map[string]any)
+		return c["received"].(map[MessageType]int64), c["relayed"].(map[MessageType]int64)
+	}
+	receivedBefore, relayedBefore := counts()
+
+	send := func(from *Client, t MessageType, n int) {
+		for i := 0; i < n; i++ {
+			data, _ := json.Marshal(SignalingMessage{Type: t, RoomID: "room-123"})
+			from.handleMessage(data)
+			hub.handleBroadcast(<-hub.priority)
+		}
+	}
+	send(alice, MsgTypeOffer, 3)
+	send(bob, MsgTypeAnswer, 2)
+
+	received, relayed := counts()
+	for _, tt := range []struct {
+		typ  MessageType
+		want int64
+	}{
+		{MsgTypeOffer, 3},
+		{MsgTypeAnswer, 2},
+		{MsgTypeICECandidate, 0},
+	} {
+		if got := received[tt.typ] - receivedBefore[tt.typ]; got != tt.want {
+			t.Errorf("received %s = %d, want %d", tt.typ, got, tt.want)
+		}
+		if got := relayed[tt.typ] - relayedBefore[tt.typ]; got != tt.want {
+			t.Errorf("relayed %s = %d, want %d", tt.typ, got, tt.want)
+		}
+	}
+
+	// The health endpoint reports them by type name
+	rec := httptest.NewRecorder()
+	healthHandler(hub).ServeHTTP(rec, httptest.NewRequest("GET", "/health", nil))
+	var body struct {
+		MessageCounts map[string]map[string]int64 `json:"message_counts"`
+	}
+	json.NewDecoder(rec.Body).Decode(&body)
+	if body.MessageCounts["received"]["offer"] < 3 || body.MessageCounts["relayed"]["answer"] < 2 {
+		t.Errorf("Unexpected message_counts in /health: %v", body.MessageCounts)
+	}
+}
+
+func TestServerMetrics_ClientsInRooms(t *testing.T) {
+	hub := NewHub()
+
+	idle := &Client{ID: "idle", Hub: hub, Send: make(chan []byte, 256)}
+	joined1 := &Client{ID: "joined-1", Hub: hub, Send: make(chan []byte, 256)}
+	joined2 := &Client{ID: "joined-2", Hub: hub, Send: make(chan []byte, 256)}
+	closing := &Client{ID: "closing", Hub: hub, Send: make(chan []byte, 256)}
+	closing.closed.Store(true)
+
+	for _, c := range []*Client{idle, joined1, joined2, closing} {
+		hub.clients[c.ID] = c
+	}
+	hub.JoinRoom(joined1, "room-123")
+	hub.JoinRoom(joined2, "room-123")
+
+	result := (&ServerMetrics{StartTime: time.Now()}).GetMetrics(hub)
+
+	if result["active_clients"].(int) != 3 {
+		t.Errorf("Expected 3 active clients, got %v", result["active_clients"])
+	}
+	if result["clients_in_rooms"].(int) != 2 {
+		t.Errorf("Expected 2 clients in rooms, got %v", result["clients_in_rooms"])
+	}
+	if result["idle_clients"].(int) != 1 {
+		t.Errorf("Expected 1 idle client, got %v", result["idle_clients"])
+	}
+}
+
+func TestTLSMinVersion(t *testing.T) {
+	t.Setenv("TLS_MIN_VERSION", "1.1")
+	if v := envTLSVersion("TLS_MIN_VERSION", tls.VersionTLS12); v != tls.VersionTLS12 {
+		t.Errorf("Invalid version should keep the default, got %s", tls.VersionName(v))
+	}
+
+	t.Setenv("TLS_MIN_VERSION", "1.3")
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = &tls.Config{MinVersion: envTLSVersion("TLS_MIN_VERSION", tls.VersionTLS12)}
+	server.StartTLS()
+	defer server.Close()
+
+	get := func(maxVersion uint16) error {
+		transport := server.Client().Transport.(*http.Transport).Clone()
+		transport.TLSClientConfig.MaxVersion = maxVersion
+		resp, err := (&http.Client{Transport: transport}).Get(server.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	if err := get(tls.VersionTLS12); err == nil {
+		t.Error("TLS 1.2 client accepted with a 1.3 minimum")
+	}
+	if err := get(tls.VersionTLS13); err != nil {
+		t.Errorf("TLS 1.3 client rejected: %v", err)
+	}
+}
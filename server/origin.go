@@ -0,0 +1,49 @@
+package main
+
+import "sync"
+
+// OriginLimiter caps concurrent connections per web origin, so one embedding
+// site can't take every slot on the server. Unlike RateLimiter it counts open
+// connections rather than attempts, so each Acquire needs a matching Release.
+type OriginLimiter struct {
+	mu     sync.Mutex
+	active map[string]int
+	limit  int // 0 disables the cap
+}
+
+func NewOriginLimiter(limit int) *OriginLimiter {
+	return &OriginLimiter{
+		active: make(map[string]int),
+		limit:  limit,
+	}
+}
+
+// Acquire takes a connection slot for origin, reporting false if the origin
+// is already at its limit. Requests without an Origin header (native
+// clients) share the "" slot pool.
+func (ol *OriginLimiter) Acquire(origin string) bool {
+	if ol.limit <= 0 {
+		return true
+	}
+	ol.mu.Lock()
+	defer ol.mu.Unlock()
+	if ol.active[origin] >= ol.limit {
+		return false
+	}
+	ol.active[origin]++
+	return true
+}
+
+// Release frees a slot taken by Acquire
+func (ol *OriginLimiter) Release(origin string) {
+	if ol.limit <= 0 {
+		return
+	}
+	ol.mu.Lock()
+	defer ol.mu.Unlock()
+	if ol.active[origin] <= 1 {
+		delete(ol.active, origin)
+		return
+	}
+	ol.active[origin]--
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestOriginLimiter_AcquireRelease(t *testing.T) {
+	ol := NewOriginLimiter(2)
+
+	if !ol.Acquire("https://a.example") || !ol.Acquire("https://a.example") {
+		t.Fatal("Expected slots up to the limit")
+	}
+	if ol.Acquire("https://a.example") {
+		t.Error("Expected origin over the limit to be refused")
+	}
+	if !ol.Acquire("https://b.example") {
+		t.Error("Other origins should have their own slots")
+	}
+
+	ol.Release("https://a.example")
+	if !ol.Acquire("https://a.example") {
+		t.Error("Released slot should be reusable")
+	}
+
+	ol.Release("https://b.example")
+	if _, tracked := ol.active["https://b.example"]; tracked {
+		t.Error("Origin with no connections should be forgotten")
+	}
+}
+
+func TestOriginLimiter_Disabled(t *testing.T) {
+	ol := NewOriginLimiter(0)
+	for i := 0; i < 100; i++ {
+		if !ol.Acquire("https://a.example") {
+			t.Fatal("Disabled limiter should allow every connection")
+		}
+	}
+}
+
+func TestServeWs_OriginConnectionLimit(t *testing.T) {
+	prevLimiter := originLimiter
+	originLimiter = NewOriginLimiter(2)
+	defer func() { originLimiter = prevLimiter }()
+
+	hub := NewHub()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go hub.Run(ctx)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveWs(hub, w, r)
+	}))
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+	header := http.Header{"Origin": []string{"https://embed.example"}}
+
+	var conns []*websocket.Conn
+	for i := 0; i < 2; i++ {
+		ws, _, err := websocket.DefaultDialer.Dial(wsURL, header)
+		if err != nil {
+			t.Fatalf("Connection %d refused: %v", i, err)
+		}
+		defer ws.Close()
+		conns = append(conns, ws)
+	}
+
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL, header)
+	if err == nil {
+		t.Fatal("Expected connection over the origin limit to be refused")
+	}
+	if resp == nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("Expected 429, got %v", resp)
+	}
+
+	ws, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Origin": []string{"https://other.example"}})
+	if err != nil {
+		t.Fatalf("Other origin should not be limited: %v", err)
+	}
+	ws.Close()
+
+	// A disconnect frees its slot
+	conns[0].Close()
+	deadline := time.Now().Add(time.Second)
+	for {
+		ws, _, err := websocket.DefaultDialer.Dial(wsURL, header)
+		if err == nil {
+			ws.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Slot not released after disconnect: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// prometheusHandler serves metrics in the Prometheus text exposition format
+func prometheusHandler(hubs ...*Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		setSecurityHeaders(w)
+		writePrometheus(w, metrics, hubs...)
+	}
+}
+
+func writePrometheus(w io.Writer, m *ServerMetrics, hubs ...*Hub) {
+	stats := m.GetMetrics(hubs...)
+
+	writeMetric(w, "warp_total_connections", "counter",
+		"WebSocket connections accepted since start.", stats["total_connections"])
+	// The same count under the conventional _total suffix
+	writeMetric(w, "warp_connections_total", "counter",
+		"WebSocket connections accepted since start.", stats["total_connections"])
+	writeMetric(w, "warp_active_rooms", "gauge",
+		"Rooms currently open.", stats["active_rooms"])
+	writeMetric(w, "warp_active_clients", "gauge",
+		"Clients currently connected.", stats["active_clients"])
+	writeMetric(w, "warp_peak_clients", "gauge",
+		"Most clients connected at once since start.", stats["peak_active_clients"])
+	writeMetric(w, "warp_peak_rooms", "gauge",
+		"Most rooms open at once since start.", stats["peak_active_rooms"])
+	writeMetric(w, "warp_pings_sent_total", "counter",
+		"Keepalive pings written to clients since start.", stats["pings_sent"])
+	writeMetric(w, "warp_pong_lag_warnings_total", "counter",
+		"Clients flagged for leaving a ping unanswered since start.", stats["pong_lag_warnings"])
+	writeMetric(w, "warp_rate_limited_total", "counter",
+		"Connection attempts refused by the per-IP rate limiter since start.", stats["rate_limited"])
+	fmt.Fprintln(w, "# HELP warp_active_clients_by_compression Clients currently connected, by negotiated compression.")
+	fmt.Fprintln(w, "# TYPE warp_active_clients_by_compression gauge")
+	fmt.Fprintf(w, "warp_active_clients_by_compression{compression=%q} %v\n", "permessage-deflate", stats["compressed_clients"])
+	fmt.Fprintf(w, "warp_active_clients_by_compression{compression=%q} %v\n", "none", stats["uncompressed_clients"])
+
+	// Every known label is written, even at zero, so series always exist
+	fmt.Fprintln(w, "# HELP warp_messages_total Signaling messages received, by type.")
+	fmt.Fprintln(w, "# TYPE warp_messages_total counter")
+	for _, t := range append(knownMessageTypes, "unknown") {
+		fmt.Fprintf(w, "warp_messages_total{type=%q} %d\n", t, m.Messages.Get(t))
+	}
+
+	fmt.Fprintln(w, "# HELP warp_broadcasts_total Signaling messages relayed to peers, by type.")
+	fmt.Fprintln(w, "# TYPE warp_broadcasts_total counter")
+	for _, t := range append(knownMessageTypes, "unknown") {
+		fmt.Fprintf(w, "warp_broadcasts_total{type=%q} %d\n", t, m.Broadcasts.Get(t))
+	}
+
+	fmt.Fprintln(w, "# HELP warp_errors_total Errors sent to clients, by code.")
+	fmt.Fprintln(w, "# TYPE warp_errors_total counter")
+	for _, code := range knownErrorCodes {
+		fmt.Fprintf(w, "warp_errors_total{code=%q} %d\n", code, m.Errors.Get(code))
+	}
+}
+
+func writeMetric(w io.Writer, name, kind, help string, value any) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+	fmt.Fprintf(w, "%s %v\n", name, value)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestPrometheus_LabeledCounters(t *testing.T) {
+	hub := NewHub()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go hub.Run(ctx)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveWs(hub, w, r)
+	}))
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	ws, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer ws.Close()
+
+	var msg SignalingMessage
+	ws.ReadJSON(&msg)
+
+	// Counters are process-wide, so assert on deltas
+	offers := metrics.Messages.Get(MsgTypeOffer)
+	unknown := metrics.Messages.Get("unknown")
+	unknownErrors := metrics.Errors.Get(ErrCodeUnknownType)
+
+	ws.WriteJSON(SignalingMessage{Type: MsgTypeHandshakeInit, RoomID: "test-room"})
+	ws.WriteJSON(SignalingMessage{Type: MsgTypeOffer})
+	ws.WriteJSON(SignalingMessage{Type: MsgTypeOffer})
+	ws.WriteJSON(SignalingMessage{Type: "made-up-type"})
+
+	// The unknown type is answered with an error, so it was processed last
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	ws.ReadJSON(&msg) // drain room-created
+	ws.ReadJSON(&msg) // drain joined
+	if err := ws.ReadJSON(&msg); err != nil || msg.Type != MsgTypeError {
+		t.Fatalf("Expected error reply, got %v (%v)", msg.Type, err)
+	}
+
+	rec := httptest.NewRecorder()
+	prometheusHandler(hub).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+
+	expected := []string{
+		fmt.Sprintf(`warp_messages_total{type="offer"} %d`, offers+2),
+		fmt.Sprintf(`warp_messages_total{type="unknown"} %d`, unknown+1),
+		fmt.Sprintf(`warp_errors_total{code="unknown_type"} %d`, unknownErrors+1),
+		"warp_active_rooms 1",
+		"warp_active_clients 1",
+		"# TYPE warp_messages_total counter",
+	}
+	for _, line := range expected {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Missing %q in:\n%s", line, body)
+		}
+	}
+
+	// Label values are bounded to the known enums
+	if strings.Contains(body, "made-up-type") {
+		t.Error("Unknown message type leaked into labels")
+	}
+	series := strings.Count(body, "warp_messages_total{")
+	if series != len(knownMessageTypes)+1 {
+		t.Errorf("Expected %d message series, got %d", len(knownMessageTypes)+1, series)
+	}
+}
+
+func TestPrometheus_Endpoint(t *testing.T) {
+	prevLimiter := rateLimiter
+	rateLimiter = NewRateLimiter(0, time.Minute) // reject everything
+	defer func() {
+		rateLimiter.Stop()
+		rateLimiter = prevLimiter
+	}()
+
+	hub := NewHub()
+	alice := &Client{ID: "alice", Hub: hub, Send: make(chan []byte, 256)}
+	bob := &Client{ID: "bob", Hub: hub, Send: make(chan []byte, 256)}
+	hub.clients[alice.ID] = alice
+	hub.clients[bob.ID] = bob
+	hub.JoinRoom(alice, "room-123")
+	hub.JoinRoom(bob, "room-123")
+
+	// Counters are process-wide, so assert on deltas
+	limited := metrics.RateLimited.Load()
+	offers := metrics.Broadcasts.Get(MsgTypeOffer)
+	answers := metrics.Broadcasts.Get(MsgTypeAnswer)
+
+	req := httptest.NewRequest("GET", "/ws", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	rec := httptest.NewRecorder()
+	wsHandler(hub).ServeHTTP(rec, req)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected 429, got %d", rec.Code)
+	}
+
+	hub.handleBroadcast(&SignalingMessage{Type: MsgTypeOffer, From: alice.ID, RoomID: "room-123"})
+	hub.handleBroadcast(&SignalingMessage{Type: MsgTypeOffer, From: alice.ID, To: bob.ID, RoomID: "room-123"})
+	hub.handleBroadcast(&SignalingMessage{Type: MsgTypeAnswer, From: bob.ID, RoomID: "room-123"})
+
+	rec = httptest.NewRecorder()
+	prometheusHandler(hub).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Unexpected content type %q", ct)
+	}
+	body := rec.Body.String()
+
+	expected := []string{
+		"# TYPE warp_total_connections counter",
+		fmt.Sprintf("warp_total_connections %d", metrics.TotalConnections.Load()),
+		fmt.Sprintf("warp_connections_total %d", metrics.TotalConnections.Load()),
+		"# TYPE warp_active_rooms gauge",
+		"warp_active_rooms 1",
+		"warp_active_clients 2",
+		fmt.Sprintf("warp_rate_limited_total %d", limited+1),
+		fmt.Sprintf(`warp_broadcasts_total{type="offer"} %d`, offers+2),
+		fmt.Sprintf(`warp_broadcasts_total{type="answer"} %d`, answers+1),
+	}
+	for _, line := range expected {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Missing %q in:\n%s", line, body)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Clients announce the signaling protocol version they speak through the
+// WebSocket subprotocol "warp.v<N>". Clients that offer none predate
+// versioning and count as version 1.
+const (
+	subprotocolPrefix      = "warp.v"
+	currentProtocolVersion = 2 // v2 added feature negotiation in handshake-init
+	legacyProtocolVersion  = 1
+)
+
+// CloseReasonUpgradeRequired tells a client its protocol version is no
+// longer accepted and it must update
+const CloseReasonUpgradeRequired = "PROTOCOL_UPGRADE_REQUIRED"
+
+// supportedSubprotocols lists every version the server can negotiate,
+// newest first so the upgrader prefers it
+func supportedSubprotocols() []string {
+	protocols := make([]string, 0, currentProtocolVersion)
+	for v := currentProtocolVersion; v >= legacyProtocolVersion; v-- {
+		protocols = append(protocols, fmt.Sprintf("%s%d", subprotocolPrefix, v))
+	}
+	return protocols
+}
+
+// protocolVersion returns the version of a negotiated subprotocol
+func protocolVersion(subprotocol string) int {
+	v, err := strconv.Atoi(strings.TrimPrefix(subprotocol, subprotocolPrefix))
+	if err != nil || !strings.HasPrefix(subprotocol, subprotocolPrefix) {
+		return legacyProtocolVersion
+	}
+	return v
+}
+
+// negotiatedDeflate reports whether upgrading r with u enables
+// permessage-deflate. gorilla/websocket doesn't expose the extensions it
+// agreed to, but accepts deflate whenever it is enabled and the client
+// offers it, so the offer decides.
+func negotiatedDeflate(u *websocket.Upgrader, r *http.Request) bool {
+	if !u.EnableCompression {
+		return false
+	}
+	for _, header := range r.Header.Values("Sec-WebSocket-Extensions") {
+		for _, ext := range strings.Split(header, ",") {
+			name, _, _ := strings.Cut(ext, ";")
+			if strings.TrimSpace(name) == "permessage-deflate" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// DeprecationWarningPayload is the payload of a deprecation-warning, sent to
+// clients whose protocol version will soon no longer be accepted
+type DeprecationWarningPayload struct {
+	MinVersion int `json:"min_version"`
+	// Deadline is when older clients will be refused, omitted if not yet set
+	Deadline *time.Time `json:"deadline,omitempty"`
+}
+
+// deprecated reports whether the client speaks a version below the upcoming
+// minimum
+func (h *Hub) deprecated(client *Client) bool {
+	return h.upcomingMinVersion > 0 && protocolVersion(client.Subprotocol) < h.upcomingMinVersion
+}
+
+func (h *Hub) deprecationWarning() []byte {
+	payload := DeprecationWarningPayload{MinVersion: h.upcomingMinVersion}
+	if !h.deprecationDeadline.IsZero() {
+		deadline := h.deprecationDeadline.UTC()
+		payload.Deadline = &deadline
+	}
+	msg := SignalingMessage{Type: MsgTypeDeprecation}
+	msg.Payload, _ = json.Marshal(payload)
+	data, _ := json.Marshal(msg)
+	return data
+}
+
+// warnDeprecatedClients periodically reminds connected clients below the
+// upcoming minimum version to update before the cutoff. They are warned on
+// connect too, and stay connected until minProtocolVersion is raised.
+func (h *Hub) warnDeprecatedClients(ctx context.Context) {
+	ticker := time.NewTicker(h.deprecationEvery)
+	defer ticker.Stop()
+
+	data := h.deprecationWarning()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			h.mu.RLock()
+			for _, client := range h.clients {
+				if h.deprecated(client) {
+					client.enqueue(data)
+				}
+			}
+			h.mu.RUnlock()
+		}
+	}
+}
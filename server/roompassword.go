@@ -0,0 +1,66 @@
+package main
+
+import (
+	"log/slog"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// roomPasswordCost is the bcrypt work factor for room passwords
+var roomPasswordCost = bcrypt.DefaultCost
+
+// roomPassword is the bcrypt hash of the password a room was created with
+type roomPassword struct {
+	hash []byte
+}
+
+func hashRoomPassword(password string) (*roomPassword, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), roomPasswordCost)
+	if err != nil {
+		return nil, err
+	}
+	return &roomPassword{hash: hash}, nil
+}
+
+// matches reports whether password is the one the room was created with
+func (p *roomPassword) matches(password string) bool {
+	return bcrypt.CompareHashAndPassword(p.hash, []byte(password)) == nil
+}
+
+// checkRoomPassword does the slow bcrypt work of a join before joinRoom
+// takes h.mu, so wrong guesses don't stall the shard. It checks password
+// against the existing room's, returning that room as the one checked, or
+// hashes it for the room the join will create.
+func (h *Hub) checkRoomPassword(client *Client, roomID, password string) (*Room, *roomPassword, error) {
+	room, err := h.verifyRoomPassword(client, roomID, password)
+	if err != nil || room != nil || password == "" {
+		return room, nil, err
+	}
+	hashed, err := hashRoomPassword(password)
+	if err != nil {
+		slog.Warn("Failed to hash room password",
+			slog.String("roomId", roomID),
+			slog.String("error", err.Error()))
+		return nil, nil, errRoomPassword
+	}
+	return nil, hashed, nil
+}
+
+// verifyRoomPassword checks password against the room's, if the room
+// exists, returning the room checked. Members need no password. It takes
+// no lock while comparing, and membership is read from the room, so it can
+// run on a shard the client is not on.
+func (h *Hub) verifyRoomPassword(client *Client, roomID, password string) (*Room, error) {
+	h.mu.RLock()
+	room, ok := h.rooms[roomID]
+	h.mu.RUnlock()
+	if !ok {
+		return nil, nil
+	}
+
+	// A room's password is fixed at creation, so needs no lock
+	if room.password != nil && !room.has(client) && !room.password.matches(password) {
+		return nil, errRoomPassword
+	}
+	return room, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// logSampler lets through one in every n events, for debug lines that
+// would otherwise flood the logs under load. It is safe for concurrent use.
+type logSampler struct {
+	n     int64
+	count atomic.Int64
+}
+
+// newLogSampler samples one in n events; n <= 1 lets every event through
+func newLogSampler(n int) *logSampler {
+	return &logSampler{n: int64(max(n, 1))}
+}
+
+// sample reports whether this event should be logged. The first event
+// always is.
+func (s *logSampler) sample() bool {
+	return (s.count.Add(1)-1)%s.n == 0
+}
+
+// burstLog collapses a storm of lifecycle log lines into a summary. The
+// first limit events in each window are logged as usual; the rest are only
+// counted, and flush reports them in one line once the window has passed.
+// It is safe for concurrent use.
+type burstLog struct {
+	mu         sync.Mutex
+	summary    string // Message of the summary line
+	limit      int    // Events per window logged individually, 0 for all
+	window     time.Duration
+	start      time.Time
+	count      int // Events in the current window
+	suppressed int // Events in the current window that weren't logged
+}
+
+// newBurstLog logs up to limit events individually per window, summarising
+// the rest under the given message
+func newBurstLog(summary string, limit int, window time.Duration) *burstLog {
+	return &burstLog{summary: summary, limit: limit, window: window}
+}
+
+// allow counts an event at now and reports whether to log it individually
+func (b *burstLog) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if now.Sub(b.start) >= b.window {
+		b.rollover(now)
+	}
+	b.count++
+	if b.limit <= 0 || b.count <= b.limit {
+		return true
+	}
+	b.suppressed++
+	return false
+}
+
+// flush writes the summary for a finished window that suppressed events.
+// Call it periodically so a storm is reported even once it has stopped.
+func (b *burstLog) flush(now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if now.Sub(b.start) >= b.window {
+		b.rollover(now)
+	}
+}
+
+// rollover summarises the current window and starts a new one at now.
+// Caller must hold b.mu.
+func (b *burstLog) rollover(now time.Time) {
+	if b.suppressed > 0 {
+		slog.Info(b.summary,
+			slog.Int("count", b.count),
+			slog.Int("unlogged", b.suppressed),
+			slog.Duration("window", b.window))
+	}
+	b.start, b.count, b.suppressed = now, 0, 0
+}
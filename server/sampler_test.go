@@ -0,0 +1,71 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLogSampler_Fraction(t *testing.T) {
+	s := newLogSampler(10)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	sampled := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if s.sample() {
+					mu.Lock()
+					sampled++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if sampled != 100 {
+		t.Errorf("Sampled %d of 1000 events, want 100", sampled)
+	}
+}
+
+func TestLogSampler_Disabled(t *testing.T) {
+	for _, n := range []int{0, 1} {
+		s := newLogSampler(n)
+		for i := 0; i < 5; i++ {
+			if !s.sample() {
+				t.Fatalf("n=%d: event %d was dropped", n, i)
+			}
+		}
+	}
+}
+
+func TestBurstLog_Window(t *testing.T) {
+	b := newBurstLog("Events", 2, time.Second)
+	start := time.Now()
+
+	allowed := 0
+	for i := 0; i < 10; i++ {
+		if b.allow(start) {
+			allowed++
+		}
+	}
+	if allowed != 2 {
+		t.Errorf("Allowed %d events in one window, want 2", allowed)
+	}
+
+	// A new window logs individually again
+	if !b.allow(start.Add(time.Second)) {
+		t.Error("First event of a new window should be logged")
+	}
+
+	unlimited := newBurstLog("Events", 0, time.Second)
+	for i := 0; i < 100; i++ {
+		if !unlimited.allow(start) {
+			t.Fatalf("Event %d dropped with no limit", i)
+		}
+	}
+}
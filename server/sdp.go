@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+var (
+	errSDPMissing      = errors.New("payload has no sdp")
+	errSDPVersionFirst = errors.New("sdp must start with a v= line")
+	errSDPMalformed    = errors.New("sdp line is not <type>=<value>")
+	errSDPNoOrigin     = errors.New("sdp session has no o= line")
+	errSDPNoName       = errors.New("sdp session has no s= line")
+	errSDPNoMedia      = errors.New("sdp has no m= line")
+)
+
+// validateSessionDescription checks the SDP in an offer or answer payload
+// (an RTCSessionDescriptionInit) for the structure every session
+// description needs. It is a sanity check to catch broken clients early,
+// not a full RFC 8866 parser: attribute values are never inspected.
+func validateSessionDescription(payload json.RawMessage) error {
+	var desc struct {
+		SDP string `json:"sdp"`
+	}
+	if json.Unmarshal(payload, &desc) != nil || desc.SDP == "" {
+		return errSDPMissing
+	}
+	return validateSDP(desc.SDP)
+}
+
+// validateSDP requires a leading v= line, o= and s= lines in the session
+// section and at least one m= section. Lines may end in CRLF or LF.
+func validateSDP(sdp string) error {
+	var origin, name, media bool
+	for i, line := range strings.Split(strings.TrimRight(sdp, "\r\n"), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if len(line) < 2 || line[1] != '=' || line[0] < 'a' || line[0] > 'z' {
+			return errSDPMalformed
+		}
+		if i == 0 && line[0] != 'v' {
+			return errSDPVersionFirst
+		}
+		switch line[0] {
+		case 'o':
+			origin = origin || !media
+		case 's':
+			name = name || !media
+		case 'm':
+			if !origin {
+				return errSDPNoOrigin
+			}
+			if !name {
+				return errSDPNoName
+			}
+			media = true
+		}
+	}
+	switch {
+	case !origin:
+		return errSDPNoOrigin
+	case !name:
+		return errSDPNoName
+	case !media:
+		return errSDPNoMedia
+	}
+	return nil
+}
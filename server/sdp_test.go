@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+const testSDP = "v=0\r\n" +
+	"o=- 4611731400430051336 2 IN IP4 127.0.0.1\r\n" +
+	"s=-\r\n" +
+	"t=0 0\r\n" +
+	"a=group:BUNDLE 0\r\n" +
+	"m=application 9 UDP/DTLS/SCTP webrtc-datachannel\r\n" +
+	"c=IN IP4 0.0.0.0\r\n" +
+	"a=mid:0\r\n" +
+	"a=sctp-port:5000\r\n"
+
+func TestValidateSDP(t *testing.T) {
+	tests := []struct {
+		name string
+		sdp  string
+		want error
+	}{
+		{"valid", testSDP, nil},
+		{"LF line endings", strings.ReplaceAll(testSDP, "\r\n", "\n"), nil},
+		{"missing version", strings.Replace(testSDP, "v=0\r\n", "", 1), errSDPVersionFirst},
+		{"missing origin", strings.Replace(testSDP, "o=- 4611731400430051336 2 IN IP4 127.0.0.1\r\n", "", 1), errSDPNoOrigin},
+		{"missing session name", strings.Replace(testSDP, "s=-\r\n", "", 1), errSDPNoName},
+		{"no media", "v=0\r\no=- 1 2 IN IP4 127.0.0.1\r\ns=-\r\nt=0 0\r\n", errSDPNoMedia},
+		{"origin only in media section", "v=0\r\ns=-\r\nm=audio 9 RTP/AVP 0\r\no=- 1 2 IN IP4 127.0.0.1\r\n", errSDPNoOrigin},
+		{"garbage line", testSDP + "not sdp\r\n", errSDPMalformed},
+		{"blank line", strings.Replace(testSDP, "s=-\r\n", "s=-\r\n\r\n", 1), errSDPMalformed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := validateSDP(tt.sdp); got != tt.want {
+				t.Errorf("validateSDP() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateSessionDescription(t *testing.T) {
+	valid, _ := json.Marshal(map[string]string{"type": "offer", "sdp": testSDP})
+	if err := validateSessionDescription(valid); err != nil {
+		t.Errorf("Valid offer rejected: %v", err)
+	}
+	for _, payload := range []string{``, `{}`, `{"type":"offer"}`, `{"sdp":42}`, `"v=0"`} {
+		if err := validateSessionDescription(json.RawMessage(payload)); err != errSDPMissing {
+			t.Errorf("Payload %q: got %v, want %v", payload, err, errSDPMissing)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"log/slog"
+	"slices"
+	"sync"
+)
+
+// ShardedHub spreads rooms over independent hubs, each running its own
+// event loop, so a busy instance can use more than one core. A room always
+// lives on the shard its ID hashes to; clients start on a shard picked by
+// their ID and move to the room's shard when they join.
+//
+// Operators can migrate a room to another shard, which pins it there in
+// place of its hashed shard until it is deleted.
+type ShardedHub struct {
+	shards []*Hub
+
+	// moveMu is held for writing while a room migrates, and for reading by
+	// a client's ReadPump while it acts on c.Hub
+	moveMu sync.RWMutex
+	pinMu  sync.RWMutex
+	pinned map[string]*Hub // Migrated room ID -> shard holding it
+
+	// Clients move between shards, so ID uniqueness is enforced here
+	idMu sync.Mutex
+	ids  map[string]*Client
+}
+
+var (
+	errShardOutOfRange = errors.New("shard out of range")
+	errRoomNotFound    = errors.New("room not found")
+	errRoomShared      = errors.New("room member is also in other rooms")
+	errRoomOtherShard  = errors.New("room is on another shard than the client's rooms")
+)
+
+// NewShardedHub creates n shards (at least one)
+func NewShardedHub(n int) *ShardedHub {
+	if n < 1 {
+		n = 1
+	}
+	s := &ShardedHub{
+		shards: make([]*Hub, n),
+		pinned: make(map[string]*Hub),
+		ids:    make(map[string]*Client),
+	}
+	events, handshakes := newEventBus(), &handshakeGauge{}
+	for i := range s.shards {
+		hub := NewHub()
+		hub.router = s
+		hub.events = events
+		hub.handshakes = handshakes
+		s.shards[i] = hub
+	}
+	return s
+}
+
+// Run starts every shard's event loop
+func (s *ShardedHub) Run(ctx context.Context) {
+	for _, hub := range s.shards {
+		go hub.Run(ctx)
+	}
+}
+
+// Entry returns a shard that can accept new connections. serveWs routes
+// each client to its own shard from there.
+func (s *ShardedHub) Entry() *Hub {
+	return s.shards[0]
+}
+
+// shardFor returns the shard owning the given room or client ID
+func (s *ShardedHub) shardFor(key string) *Hub {
+	s.pinMu.RLock()
+	hub, ok := s.pinned[key]
+	s.pinMu.RUnlock()
+	if ok {
+		return hub
+	}
+
+	f := fnv.New32a()
+	f.Write([]byte(key))
+	return s.shards[f.Sum32()%uint32(len(s.shards))]
+}
+
+// sessionShard returns the shard holding the live session with the given
+// client ID, which has moved off its hashed shard if it joined a room on
+// another, or the hashed shard if there is no such session
+func (s *ShardedHub) sessionShard(id string) *Hub {
+	s.idMu.Lock()
+	_, held := s.ids[id]
+	s.idMu.Unlock()
+	if held {
+		for _, hub := range s.shards {
+			hub.mu.RLock()
+			_, ok := hub.clients[id]
+			hub.mu.RUnlock()
+			if ok {
+				return hub
+			}
+		}
+	}
+	return s.shardFor(id)
+}
+
+// configureFromEnv applies environment overrides to every shard
+func (s *ShardedHub) configureFromEnv() {
+	for _, hub := range s.shards {
+		hub.configureFromEnv()
+	}
+}
+
+// shardFor returns the hub owning key, which is h itself when unsharded
+func (h *Hub) shardFor(key string) *Hub {
+	if h.router == nil {
+		return h
+	}
+	return h.router.shardFor(key)
+}
+
+// sessionShard returns the shard a client reconnecting with a stable ID
+// registers on, so it can take over its old session there; h itself when
+// unsharded
+func (h *Hub) sessionShard(id string) *Hub {
+	if h.router == nil {
+		return h
+	}
+	return h.router.sessionShard(id)
+}
+
+// moveTo hands a registered client over to another shard. A single-room
+// client leaves its room, switching rooms as it would unsharded; a client
+// that may be in several can't move while it is in any, since it would
+// drop out of all of them. It must run on the client's ReadPump goroutine,
+// the only reader of client.Hub, while it holds the hub (see holdHub).
+func (h *Hub) moveTo(client *Client, target *Hub) error {
+	h.mu.Lock()
+	if h.maxRoomsPerClient > 1 && len(client.Rooms) > 0 {
+		h.mu.Unlock()
+		return errRoomOtherShard
+	}
+	h.leaveAllRooms(client, false)
+	delete(h.clients, client.ID)
+	h.mu.Unlock()
+
+	target.mu.Lock()
+	target.clients[client.ID] = client
+	target.mu.Unlock()
+
+	client.Hub = target
+	slog.Debug("Client moved shard",
+		slog.String("clientId", client.ID))
+	return nil
+}
+
+// join adds the client to a room on the shard that owns it
+func (c *Client) join(roomID string, opts JoinOptions) (RoomCreatedPayload, error) {
+	if err := checkRoomID(roomID); err != nil {
+		return RoomCreatedPayload{}, err // Before moving shard
+	}
+	if owner := c.Hub.shardFor(roomID); owner != c.Hub {
+		// Vet the join before leaving this shard's rooms for it. A room
+		// filling up in between can still refuse it after the move.
+		if err := owner.checkJoin(c, roomID, opts); err != nil {
+			return RoomCreatedPayload{}, err
+		}
+		if err := c.Hub.moveTo(c, owner); err != nil {
+			return RoomCreatedPayload{}, err
+		}
+	}
+	return c.Hub.joinRoom(c, roomID, opts)
+}
+
+// MigrateRoom moves a room and its members to shard index to, pinning the
+// room there. Both shards are locked for the move, so messages for the room
+// pause briefly; any already queued on the old shard are forwarded after.
+// Rooms whose members are in other rooms too can't be moved, since a client
+// lives on a single shard.
+func (s *ShardedHub) MigrateRoom(roomID string, to int) error {
+	if to < 0 || to >= len(s.shards) {
+		return errShardOutOfRange
+	}
+
+	s.moveMu.Lock()
+	defer s.moveMu.Unlock()
+
+	src, dst := s.shardFor(roomID), s.shards[to]
+	if src == dst {
+		return nil
+	}
+
+	// Lock in shard order so concurrent migrations can't deadlock
+	first, second := src, dst
+	if slices.Index(s.shards, src) > to {
+		first, second = dst, src
+	}
+	first.mu.Lock()
+	defer first.mu.Unlock()
+	second.mu.Lock()
+	defer second.mu.Unlock()
+
+	room, ok := src.rooms[roomID]
+	if !ok {
+		return errRoomNotFound
+	}
+	room.mu.RLock()
+	defer room.mu.RUnlock()
+	for _, client := range room.Clients {
+		if len(client.Rooms) > 1 {
+			return errRoomShared
+		}
+	}
+
+	delete(src.rooms, roomID)
+	dst.rooms[roomID] = room
+	for id, client := range room.Clients {
+		delete(src.clients, id)
+		dst.clients[id] = client
+		client.Hub = dst
+	}
+
+	s.pinMu.Lock()
+	s.pinned[roomID] = dst
+	s.pinMu.Unlock()
+
+	slog.Info("Room migrated",
+		slog.String("roomId", roomID),
+		slog.Int("from", slices.Index(s.shards, src)),
+		slog.Int("to", to),
+		slog.Int("clients", len(room.Clients)))
+	return nil
+}
+
+// claimID reserves a client ID, reporting false if another client holds it
+func (s *ShardedHub) claimID(client *Client) bool {
+	s.idMu.Lock()
+	defer s.idMu.Unlock()
+	if existing, ok := s.ids[client.ID]; ok && existing != client {
+		return false
+	}
+	s.ids[client.ID] = client
+	return true
+}
+
+// releaseID frees a client's ID if it still holds it
+func (s *ShardedHub) releaseID(client *Client) {
+	s.idMu.Lock()
+	defer s.idMu.Unlock()
+	if s.ids[client.ID] == client {
+		delete(s.ids, client.ID)
+	}
+}
+
+// releaseRoom forgets where a deleted room was pinned, so a new room with
+// the same ID goes back to its hashed shard. Caller must hold h.mu.
+func (h *Hub) releaseRoom(roomID string) {
+	if h.router == nil {
+		return
+	}
+	h.router.pinMu.Lock()
+	delete(h.router.pinned, roomID)
+	h.router.pinMu.Unlock()
+}
+
+// forward hands a message to the shard that now owns its room. It must not
+// block: the other shard may be forwarding to this one at the same time.
+func (h *Hub) forward(owner *Hub, message *SignalingMessage) {
+	queue := owner.queueFor(message.Type)
+	select {
+	case queue <- message:
+	default:
+		go func() { queue <- message }()
+	}
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestShardedHub_RoomsStayOnOwningShard(t *testing.T) {
+	shards := NewShardedHub(4)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	shards.Run(ctx)
+
+	// Find two rooms owned by different shards
+	roomA := "room-a"
+	var roomB string
+	for i := 0; ; i++ {
+		roomB = fmt.Sprintf("room-b-%d", i)
+		if shards.shardFor(roomB) != shards.shardFor(roomA) {
+			break
+		}
+	}
+	shardA, shardB := shards.shardFor(roomA), shards.shardFor(roomB)
+
+	entry := shards.Entry()
+	newClient := func(id string) *Client {
+		c := &Client{ID: id, Hub: entry, Send: make(chan []byte, 256)}
+		entry.register <- c
+		time.Sleep(10 * time.Millisecond)
+		<-c.Send // drain connected
+		return c
+	}
+
+	a1, a2 := newClient("a-1"), newClient("a-2")
+	b1, b2 := newClient("b-1"), newClient("b-2")
+
+	a1.join(roomA, JoinOptions{})
+	a2.join(roomA, JoinOptions{})
+	b1.join(roomB, JoinOptions{})
+	b2.join(roomB, JoinOptions{})
+	<-a1.Send // drain peer-joined
+	<-b1.Send
+
+	for _, c := range []*Client{a1, a2} {
+		if c.Hub != shardA {
+			t.Errorf("%s on wrong shard", c.ID)
+		}
+	}
+	for _, c := range []*Client{b1, b2} {
+		if c.Hub != shardB {
+			t.Errorf("%s on wrong shard", c.ID)
+		}
+	}
+
+	shardA.mu.RLock()
+	_, aHasA := shardA.rooms[roomA]
+	_, aHasB := shardA.rooms[roomB]
+	_, aHasB1 := shardA.clients["b-1"]
+	shardA.mu.RUnlock()
+	if !aHasA || aHasB || aHasB1 {
+		t.Errorf("Shard A state wrong: roomA=%v roomB=%v b-1=%v", aHasA, aHasB, aHasB1)
+	}
+
+	shardB.mu.RLock()
+	_, bHasB := shardB.rooms[roomB]
+	_, bHasA := shardB.rooms[roomA]
+	shardB.mu.RUnlock()
+	if !bHasB || bHasA {
+		t.Errorf("Shard B state wrong: roomB=%v roomA=%v", bHasB, bHasA)
+	}
+
+	// Messages stay within their shard's room
+	shardA.broadcast <- &SignalingMessage{Type: MsgTypeOffer, From: a1.ID, RoomID: roomA}
+	shardB.broadcast <- &SignalingMessage{Type: MsgTypeOffer, From: b1.ID, RoomID: roomB}
+
+	for _, c := range []*Client{a2, b2} {
+		select {
+		case msg := <-c.Send:
+			var sm SignalingMessage
+			json.Unmarshal(msg, &sm)
+			if sm.Type != MsgTypeOffer {
+				t.Errorf("%s: expected offer, got %v", c.ID, sm.Type)
+			}
+		case <-time.After(100 * time.Millisecond):
+			t.Errorf("%s: offer not received", c.ID)
+		}
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	for _, c := range []*Client{a1, a2, b1, b2} {
+		if n := len(c.Send); n != 0 {
+			t.Errorf("%s: unexpected %d extra messages", c.ID, n)
+		}
+	}
+
+	result := metrics.GetMetrics(shards.shards...)
+	if result["active_rooms"].(int) != 2 || result["active_clients"].(int) != 4 {
+		t.Errorf("Unexpected aggregate metrics: %v", result)
+	}
+}
+
+func TestShardedHub_SingleShard(t *testing.T) {
+	shards := NewShardedHub(0)
+	if len(shards.shards) != 1 {
+		t.Fatalf("Expected 1 shard, got %d", len(shards.shards))
+	}
+	if shards.shardFor("any-room") != shards.Entry() {
+		t.Error("Single shard should own every room")
+	}
+}
+
+func TestShardedHub_MigrateRoom(t *testing.T) {
+	shards := NewShardedHub(2)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	shards.Run(ctx)
+
+	entry := shards.Entry()
+	newClient := func(id string) *Client {
+		c := &Client{ID: id, Hub: entry, Send: make(chan []byte, 256), router: shards}
+		entry.register <- c
+		time.Sleep(10 * time.Millisecond)
+		<-c.Send // drain connected
+		return c
+	}
+
+	c1, c2 := newClient("c-1"), newClient("c-2")
+	c1.join("room-123", JoinOptions{})
+	c2.join("room-123", JoinOptions{})
+	<-c1.Send // drain peer-joined
+
+	src := shards.shardFor("room-123")
+	to := 1 - slices.Index(shards.shards, src)
+	dst := shards.shards[to]
+
+	if err := shards.MigrateRoom("room-123", to); err != nil {
+		t.Fatalf("Migration failed: %v", err)
+	}
+	if shards.shardFor("room-123") != dst {
+		t.Fatal("Room should be pinned to the destination shard")
+	}
+	for _, c := range []*Client{c1, c2} {
+		if c.Hub != dst || !dst.inRoom(c, "room-123") {
+			t.Errorf("%s not moved with the room", c.ID)
+		}
+	}
+
+	// Peers keep talking, including through a message that was queued on
+	// the old shard
+	src.broadcast <- &SignalingMessage{Type: MsgTypeOffer, From: c1.ID, RoomID: "room-123"}
+	c2.Hub.broadcast <- &SignalingMessage{Type: MsgTypeAnswer, From: c2.ID, RoomID: "room-123"}
+	for _, want := range []struct {
+		c   *Client
+		typ MessageType
+	}{{c2, MsgTypeOffer}, {c1, MsgTypeAnswer}} {
+		select {
+		case data := <-want.c.Send:
+			var sm SignalingMessage
+			json.Unmarshal(data, &sm)
+			if sm.Type != want.typ {
+				t.Errorf("%s: expected %v, got %v", want.c.ID, want.typ, sm.Type)
+			}
+		case <-time.After(100 * time.Millisecond):
+			t.Errorf("%s: %v not received after migration", want.c.ID, want.typ)
+		}
+	}
+
+	// Newcomers join the room where it now lives
+	c3 := newClient("c-3")
+	c3.join("room-123", JoinOptions{})
+	if c3.Hub != dst {
+		t.Error("Newcomer should join the migrated room's shard")
+	}
+
+	if err := shards.MigrateRoom("missing", to); err != errRoomNotFound {
+		t.Errorf("Expected room not found, got %v", err)
+	}
+	if err := shards.MigrateRoom("room-123", 5); err != errShardOutOfRange {
+		t.Errorf("Expected shard out of range, got %v", err)
+	}
+}
+
+func TestShardedHub_RejoinMigratedExpiredRoom(t *testing.T) {
+	shards := NewShardedHub(2)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	shards.Run(ctx)
+
+	entry := shards.Entry()
+	c := &Client{ID: "c-1", Hub: entry, Send: make(chan []byte, 256), router: shards}
+	entry.register <- c
+	time.Sleep(10 * time.Millisecond)
+	<-c.Send // drain connected
+
+	c.join("room-123", JoinOptions{})
+	home := shards.shardFor("room-123")
+	to := 1 - slices.Index(shards.shards, home)
+	if err := shards.MigrateRoom("room-123", to); err != nil {
+		t.Fatalf("Migration failed: %v", err)
+	}
+
+	// The room expires away from the shard its ID hashes to
+	dst := shards.shards[to]
+	dst.expireRooms(time.Now().Add(roomExpiryDuration + time.Second))
+	<-c.Send // drain room-expired
+
+	_, err := c.join("room-123", JoinOptions{})
+	var expired *roomExpiredError
+	if !errors.As(err, &expired) {
+		t.Fatalf("Expected expired error on rejoin, got %v", err)
+	}
+
+	// Once the tombstone lapses the ID can name a new room, which clears it
+	home.tombstones.add("room-123", "expired", time.Now().Add(-roomTombstoneTTL-time.Second))
+	if _, err := c.join("room-123", JoinOptions{}); err != nil {
+		t.Fatalf("Lapsed tombstone still refused the room: %v", err)
+	}
+	if _, ok := home.tombstones.reason("room-123", time.Now()); ok {
+		t.Error("Creating the room should clear its tombstone")
+	}
+}
+
+func TestShardedHub_ReconnectTakesOverSession(t *testing.T) {
+	shards := NewShardedHub(4)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	shards.Run(ctx)
+
+	// A room away from the client's hashed shard, so joining moves it
+	var roomID string
+	for i := 0; ; i++ {
+		roomID = fmt.Sprintf("room-%d", i)
+		if shards.shardFor(roomID) != shards.shardFor("mobile-1") {
+			break
+		}
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveWs(shards.Entry(), w, r)
+	}))
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+	dial := func(query string) (*websocket.Conn, SignalingMessage, ConnectedPayload) {
+		ws, _, err := websocket.DefaultDialer.Dial(wsURL+query, nil)
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		var msg SignalingMessage
+		ws.SetReadDeadline(time.Now().Add(time.Second))
+		ws.ReadJSON(&msg)
+		var info ConnectedPayload
+		json.Unmarshal(msg.Payload, &info)
+		return ws, msg, info
+	}
+
+	first, _, issued := dial("?clientId=mobile-1")
+	defer first.Close()
+	first.WriteJSON(SignalingMessage{Type: MsgTypeHandshakeInit, RoomID: roomID})
+	peer, _, _ := dial("")
+	defer peer.Close()
+	peer.WriteJSON(SignalingMessage{Type: MsgTypeHandshakeInit, RoomID: roomID})
+	time.Sleep(50 * time.Millisecond)
+
+	again, msg, info := dial("?clientId=mobile-1&resumeToken=" + issued.ResumeToken)
+	defer again.Close()
+	if msg.Type != MsgTypeConnected || !slices.Equal(info.Rooms, []string{roomID}) {
+		t.Fatalf("Expected mobile-1 resuming %s, got %v in %v", roomID, msg.Type, info.Rooms)
+	}
+
+	// The new connection relays in the room from the room's shard
+	again.WriteJSON(SignalingMessage{Type: MsgTypeOffer, RoomID: roomID, Payload: json.RawMessage(`{}`)})
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		var sm SignalingMessage
+		if err := peer.ReadJSON(&sm); err != nil {
+			t.Fatalf("Peer did not get the offer from the reconnected client: %v", err)
+		}
+		if sm.Type == MsgTypePeerLeft {
+			t.Errorf("Peer saw %s during the takeover", sm.Type)
+		}
+		if sm.Type == MsgTypeOffer && sm.From == "mobile-1" {
+			break
+		}
+	}
+}
+
+func TestShardedHub_MultiRoomClientStaysOnShard(t *testing.T) {
+	shards := NewShardedHub(4)
+	for _, hub := range shards.shards {
+		hub.maxRoomsPerClient = 2
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	shards.Run(ctx)
+
+	// Rooms on the same shard and on another one
+	roomA := "room-a"
+	var sameShard, otherShard string
+	for i := 0; sameShard == "" || otherShard == ""; i++ {
+		id := fmt.Sprintf("room-%d", i)
+		if shards.shardFor(id) == shards.shardFor(roomA) {
+			sameShard = id
+		} else {
+			otherShard = id
+		}
+	}
+
+	entry := shards.Entry()
+	newClient := func(id string) *Client {
+		c := &Client{ID: id, Hub: entry, Send: make(chan []byte, 256)}
+		entry.register <- c
+		time.Sleep(10 * time.Millisecond)
+		<-c.Send // drain connected
+		return c
+	}
+	multi, peer := newClient("multi"), newClient("peer")
+	multi.join(roomA, JoinOptions{})
+	peer.join(roomA, JoinOptions{})
+	for len(multi.Send) > 0 {
+		<-multi.Send
+	}
+	for len(peer.Send) > 0 {
+		<-peer.Send
+	}
+
+	if _, err := multi.join(otherShard, JoinOptions{}); err != errRoomOtherShard {
+		t.Fatalf("Expected cross-shard join to be refused, got %v", err)
+	}
+	if !multi.Hub.inRoom(multi, roomA) {
+		t.Error("Refused join took the client out of its room")
+	}
+	if len(peer.Send) != 0 {
+		t.Errorf("Peer got %d messages from a refused join", len(peer.Send))
+	}
+
+	if _, err := multi.join(sameShard, JoinOptions{}); err != nil {
+		t.Fatalf("Joining a second room on the same shard failed: %v", err)
+	}
+	if !multi.Hub.inRoom(multi, roomA) || !multi.Hub.inRoom(multi, sameShard) {
+		t.Error("Client should be in both rooms on its shard")
+	}
+
+	// Once out of its rooms the client can follow one to another shard
+	multi.Hub.LeaveRoom(multi, roomA)
+	multi.Hub.LeaveRoom(multi, sameShard)
+	if _, err := multi.join(otherShard, JoinOptions{}); err != nil {
+		t.Errorf("Join after leaving every room failed: %v", err)
+	}
+}
+
+func TestShardedHub_RefusedJoinKeepsClientInRoom(t *testing.T) {
+	prevCost := roomPasswordCost
+	roomPasswordCost = bcrypt.MinCost
+	defer func() { roomPasswordCost = prevCost }()
+
+	shards := NewShardedHub(4)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	shards.Run(ctx)
+
+	// Rooms on shards other than the home room's
+	home := "room-home"
+	var others []string
+	for i := 0; len(others) < 2; i++ {
+		id := fmt.Sprintf("room-%d", i)
+		if shards.shardFor(id) != shards.shardFor(home) {
+			others = append(others, id)
+		}
+	}
+	full, locked := others[0], others[1]
+
+	entry := shards.Entry()
+	newClient := func(id string) *Client {
+		c := &Client{ID: id, Hub: entry, Send: make(chan []byte, 256)}
+		entry.register <- c
+		time.Sleep(10 * time.Millisecond)
+		<-c.Send // drain connected
+		return c
+	}
+	mover, peer := newClient("mover"), newClient("peer")
+	mover.join(home, JoinOptions{})
+	peer.join(home, JoinOptions{})
+	a, b, owner := newClient("a"), newClient("b"), newClient("owner")
+	a.join(full, JoinOptions{})
+	b.join(full, JoinOptions{})
+	owner.join(locked, JoinOptions{Password: "hunter2"})
+	for len(peer.Send) > 0 {
+		<-peer.Send
+	}
+	homeShard := mover.Hub
+
+	for _, tt := range []struct {
+		roomID string
+		opts   JoinOptions
+		want   error
+	}{
+		{full, JoinOptions{}, errRoomFull},
+		{locked, JoinOptions{Password: "wrong"}, errRoomPassword},
+	} {
+		if _, err := mover.join(tt.roomID, tt.opts); err != tt.want {
+			t.Errorf("Join of %s: got %v, want %v", tt.roomID, err, tt.want)
+		}
+		if mover.Hub != homeShard || !homeShard.inRoom(mover, home) {
+			t.Errorf("Refused join of %s took the client out of its room", tt.roomID)
+		}
+	}
+	if len(peer.Send) != 0 {
+		t.Errorf("Peer got %d messages from refused joins", len(peer.Send))
+	}
+}
+
+func TestShardedHub_HandshakeTimeoutAfterMove(t *testing.T) {
+	shards := NewShardedHub(2)
+	for _, hub := range shards.shards {
+		hub.handshakeTimeout = 50 * time.Millisecond
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	shards.Run(ctx)
+
+	from, to := shards.shards[0], shards.shards[1]
+	conn := newMemConn()
+	defer conn.Close()
+	client := NewClient(conn, from)
+	from.register <- client
+	<-client.Send // connected, so registration is done
+
+	// Moved to another shard, e.g. by a join that then failed, without
+	// ever joining a room
+	from.moveTo(client, to)
+
+	select {
+	case <-conn.done:
+	case <-time.After(time.Second):
+		t.Fatal("Client that moved shard was never timed out")
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// defaultTranscriptLimit is how many messages a room transcript keeps
+const defaultTranscriptLimit = 500
+
+// TranscriptEntry is one relayed message in a room's signaling transcript
+type TranscriptEntry struct {
+	Type MessageType `json:"type"`
+	From string      `json:"from"`
+	To   string      `json:"to,omitempty"`
+	At   time.Time   `json:"at"`
+	Size int         `json:"size"` // Payload bytes
+	// Payload is only kept when TRANSCRIPT_PAYLOADS is set
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// transcript records the messages relayed in a room for debugging, keeping
+// the most recent limit of them. Guarded by the room's mu.
+type transcript struct {
+	entries  []TranscriptEntry
+	limit    int
+	payloads bool
+	dropped  int // Older entries evicted to stay within limit
+}
+
+func newTranscript(limit int, payloads bool) *transcript {
+	if limit < 1 {
+		limit = defaultTranscriptLimit
+	}
+	return &transcript{limit: limit, payloads: payloads}
+}
+
+// record appends a relayed message. A nil transcript records nothing.
+func (t *transcript) record(msg *SignalingMessage, now time.Time) {
+	if t == nil {
+		return
+	}
+	entry := TranscriptEntry{
+		Type: msg.Type,
+		From: msg.From,
+		To:   msg.To,
+		At:   now.UTC(),
+		Size: len(msg.Payload),
+	}
+	if t.payloads {
+		entry.Payload = msg.Payload
+	}
+	if len(t.entries) == t.limit {
+		copy(t.entries, t.entries[1:])
+		t.entries = t.entries[:len(t.entries)-1]
+		t.dropped++
+	}
+	t.entries = append(t.entries, entry)
+}
+
+// snapshot copies the recorded entries, oldest first
+func (t *transcript) snapshot() []TranscriptEntry {
+	return append([]TranscriptEntry{}, t.entries...)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestTranscript_KeepsMostRecent(t *testing.T) {
+	tr := newTranscript(3, true)
+	start := time.Now()
+	for i, typ := range []MessageType{MsgTypeOffer, MsgTypeAnswer, MsgTypeICECandidate, MsgTypeICECandidate, MsgTypeCancelOffer} {
+		tr.record(&SignalingMessage{Type: typ, From: "peer", Payload: json.RawMessage(`{}`)}, start.Add(time.Duration(i)))
+	}
+
+	entries := tr.snapshot()
+	if len(entries) != 3 || tr.dropped != 2 {
+		t.Fatalf("Kept %d entries, dropped %d; want 3 and 2", len(entries), tr.dropped)
+	}
+	if entries[0].Type != MsgTypeICECandidate || entries[2].Type != MsgTypeCancelOffer {
+		t.Errorf("Unexpected entries kept: %+v", entries)
+	}
+	if string(entries[2].Payload) != `{}` {
+		t.Errorf("Payload not kept with payloads enabled: %s", entries[2].Payload)
+	}
+
+	// Recording into a room without a transcript is a no-op
+	var none *transcript
+	none.record(&SignalingMessage{Type: MsgTypeOffer}, start)
+}
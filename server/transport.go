@@ -0,0 +1,21 @@
+package main
+
+import (
+	"io"
+	"time"
+)
+
+// WSConn is the part of *websocket.Conn a Client uses. Keeping Client on
+// this interface lets tests drive the hub through an in-memory transport
+// instead of real sockets.
+type WSConn interface {
+	NextReader() (messageType int, r io.Reader, err error)
+	WriteMessage(messageType int, data []byte) error
+	WriteControl(messageType int, data []byte, deadline time.Time) error
+	SetReadLimit(limit int64)
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+	SetPongHandler(h func(appData string) error)
+	EnableWriteCompression(enable bool)
+	Close() error
+}
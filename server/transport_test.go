@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// memConn is an in-memory WSConn. Tests play the remote client: send hands
+// the server a message and expect waits for what the server wrote, so hub
+// interactions are synchronised on the messages themselves, not on sleeps.
+type memConn struct {
+	in   chan []byte // To the server
+	out  chan []byte // From the server
+	done chan struct{}
+	once sync.Once
+
+	mu   sync.Mutex
+	pong func(string) error // Installed by ReadPump
+}
+
+func newMemConn() *memConn {
+	return &memConn{
+		in:   make(chan []byte),
+		out:  make(chan []byte, 256),
+		done: make(chan struct{}),
+	}
+}
+
+func (m *memConn) NextReader() (int, io.Reader, error) {
+	select {
+	case data := <-m.in:
+		return websocket.TextMessage, bytes.NewReader(data), nil
+	case <-m.done:
+		return 0, nil, &websocket.CloseError{Code: websocket.CloseGoingAway}
+	}
+}
+
+func (m *memConn) WriteMessage(messageType int, data []byte) error {
+	if messageType == websocket.CloseMessage {
+		return m.Close()
+	}
+	select {
+	case <-m.done:
+		return net.ErrClosed
+	default:
+	}
+	select {
+	case m.out <- data:
+		return nil
+	case <-m.done:
+		return net.ErrClosed
+	}
+}
+
+func (m *memConn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	if messageType == websocket.CloseMessage {
+		return m.Close()
+	}
+	return nil
+}
+
+func (m *memConn) SetReadLimit(int64)               {}
+func (m *memConn) SetReadDeadline(time.Time) error  { return nil }
+func (m *memConn) SetWriteDeadline(time.Time) error { return nil }
+func (m *memConn) EnableWriteCompression(bool)      {}
+
+func (m *memConn) SetPongHandler(h func(string) error) {
+	m.mu.Lock()
+	m.pong = h
+	m.mu.Unlock()
+}
+
+// answerPing plays the remote client's pong
+func (m *memConn) answerPing() {
+	m.mu.Lock()
+	h := m.pong
+	m.mu.Unlock()
+	if h != nil {
+		h("")
+	}
+}
+
+func (m *memConn) Close() error {
+	m.once.Do(func() { close(m.done) })
+	return nil
+}
+
+// send delivers a message from the remote client to the server
+func (m *memConn) send(t *testing.T, msg SignalingMessage) {
+	t.Helper()
+	data, _ := json.Marshal(msg)
+	select {
+	case m.in <- data:
+	case <-time.After(time.Second):
+		t.Fatalf("Server not reading: %s", data)
+	}
+}
+
+// expect skips server messages until one of the given type arrives
+func (m *memConn) expect(t *testing.T, typ MessageType) SignalingMessage {
+	t.Helper()
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case data := <-m.out:
+			var msg SignalingMessage
+			json.Unmarshal(data, &msg)
+			if msg.Type == typ {
+				return msg
+			}
+		case <-timeout:
+			t.Fatalf("No %s message from server", typ)
+		}
+	}
+}
+
+// connectMem attaches an in-memory client to the hub as serveWs would
+func connectMem(t *testing.T, hub *Hub) (*Client, *memConn) {
+	t.Helper()
+	conn := newMemConn()
+	t.Cleanup(func() { conn.Close() })
+
+	client := NewClient(conn, hub)
+	hub.register <- client
+	go client.WritePump()
+	go client.ReadPump()
+	conn.expect(t, MsgTypeConnected)
+	return client, conn
+}
+
+func TestMemConn_SignalingRoundTrip(t *testing.T) {
+	hub := NewHub()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go hub.Run(ctx)
+
+	alice, aliceConn := connectMem(t, hub)
+	bob, bobConn := connectMem(t, hub)
+
+	aliceConn.send(t, SignalingMessage{Type: MsgTypeHandshakeInit, RoomID: "mem-room"})
+	aliceConn.expect(t, MsgTypeJoined)
+	bobConn.send(t, SignalingMessage{Type: MsgTypeHandshakeInit, RoomID: "mem-room"})
+	bobConn.expect(t, MsgTypeJoined)
+	if joined := aliceConn.expect(t, MsgTypePeerJoined); joined.ClientID != bob.ID {
+		t.Errorf("peer-joined for %q, want %q", joined.ClientID, bob.ID)
+	}
+
+	aliceConn.send(t, SignalingMessage{Type: MsgTypeOffer, Payload: json.RawMessage(`{"sdp":"offer"}`)})
+	if offer := bobConn.expect(t, MsgTypeOffer); offer.From != alice.ID || string(offer.Payload) != `{"sdp":"offer"}` {
+		t.Errorf("Unexpected offer: %+v", offer)
+	}
+	bobConn.send(t, SignalingMessage{Type: MsgTypeAnswer, To: alice.ID, Payload: json.RawMessage(`{"sdp":"answer"}`)})
+	if answer := aliceConn.expect(t, MsgTypeAnswer); answer.From != bob.ID {
+		t.Errorf("Answer from %q, want %q", answer.From, bob.ID)
+	}
+
+	aliceConn.send(t, SignalingMessage{Type: MsgTypeDisconnect, Payload: json.RawMessage(`{"reason":"done"}`)})
+	if left := bobConn.expect(t, MsgTypePeerLeft); left.ClientID != alice.ID {
+		t.Errorf("peer-left for %q, want %q", left.ClientID, alice.ID)
+	}
+}
+
+func TestMemConn_ErrorReply(t *testing.T) {
+	hub := NewHub()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go hub.Run(ctx)
+
+	client, conn := connectMem(t, hub)
+	conn.send(t, SignalingMessage{Type: "made-up-type"})
+	conn.expect(t, MsgTypeError)
+	if got := client.lastError.Load(); got == nil || got.Code != ErrCodeUnknownType {
+		t.Errorf("Expected %s, got %+v", ErrCodeUnknownType, got)
+	}
+}
+
+// pingFailConn is a memConn whose pings fail, as on a half-dead socket
+type pingFailConn struct{ *memConn }
+
+func (p pingFailConn) WriteMessage(messageType int, data []byte) error {
+	if messageType == websocket.PingMessage {
+		return net.ErrClosed
+	}
+	return p.memConn.WriteMessage(messageType, data)
+}
+
+func TestWritePump_PingFailureUnregisters(t *testing.T) {
+	hub := NewHub()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go hub.Run(ctx)
+
+	events := hub.events.subscribe()
+	defer hub.events.unsubscribe(events)
+
+	conn := newMemConn()
+	defer conn.Close()
+	hub.minPingInterval = 10 * time.Millisecond
+	client := NewClient(pingFailConn{conn}, hub)
+	client.setPingInterval(hub.minPingInterval)
+	hub.register <- client
+	go client.WritePump()
+	go client.ReadPump()
+	conn.expect(t, MsgTypeConnected)
+
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case ev := <-events:
+			if ev.Type != EventDisconnect || ev.ClientID != client.ID {
+				continue
+			}
+			hub.mu.RLock()
+			_, ok := hub.clients[client.ID]
+			hub.mu.RUnlock()
+			if ok {
+				t.Error("Client still registered after failed ping")
+			}
+			return
+		case <-timeout:
+			t.Fatal("Client not unregistered after failed ping")
+		}
+	}
+}
+
+func TestWritePump_CountsPings(t *testing.T) {
+	hub := NewHub()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go hub.Run(ctx)
+
+	hub.minPingInterval = 5 * time.Millisecond
+	hub.pongLagThreshold = 0
+	conn := newMemConn()
+	defer conn.Close()
+	client := NewClient(conn, hub)
+	client.setPingInterval(0)
+	before := metrics.PingsSent.Load()
+	go client.WritePump()
+
+	deadline := time.Now().Add(time.Second)
+	for metrics.PingsSent.Load()-before < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Only %d pings counted", metrics.PingsSent.Load()-before)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// frameCountConn is a memConn that counts the text frames written to it
+type frameCountConn struct {
+	*memConn
+	writes atomic.Int32
+}
+
+func (c *frameCountConn) WriteMessage(messageType int, data []byte) error {
+	if messageType == websocket.TextMessage {
+		c.writes.Add(1)
+	}
+	return c.memConn.WriteMessage(messageType, data)
+}
+
+func TestWritePump_Coalescing(t *testing.T) {
+	for _, batching := range []bool{false, true} {
+		hub := NewHub()
+		hub.writeCoalesce = 50 * time.Millisecond
+		conn := &frameCountConn{memConn: newMemConn()}
+		defer conn.Close()
+		client := NewClient(conn, hub)
+		client.batching.Store(batching)
+		go client.WritePump()
+
+		for i := 0; i < 5; i++ {
+			client.enqueue([]byte(fmt.Sprintf(`{"type":"offer","roomId":"room-%d"}`, i)))
+		}
+
+		got := 0
+		timeout := time.After(time.Second)
+		for got < 5 {
+			select {
+			case frame := <-conn.out:
+				got += len(bytes.Split(frame, []byte("\n")))
+			case <-timeout:
+				t.Fatalf("batching=%v: only %d of 5 messages arrived", batching, got)
+			}
+		}
+
+		writes := conn.writes.Load()
+		if batching && writes >= 5 {
+			t.Errorf("Coalescing sent %d frames for 5 messages", writes)
+		}
+		if !batching && writes != 5 {
+			t.Errorf("Client without batching got %d frames, want 5", writes)
+		}
+		if n := client.stats.messagesOut.Load(); n != 5 {
+			t.Errorf("batching=%v: counted %d messages out, want 5", batching, n)
+		}
+	}
+}
+
+func TestClient_PongLagDetected(t *testing.T) {
+	hub := NewHub()
+	hub.minPingInterval = 10 * time.Millisecond
+	hub.pongLagThreshold = 30 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go hub.Run(ctx)
+
+	conn := newMemConn()
+	defer conn.Close()
+	client := NewClient(conn, hub)
+	client.setPingInterval(0)
+	before := metrics.PongLagWarnings.Load()
+	hub.register <- client
+	go client.WritePump()
+	go client.ReadPump()
+	conn.expect(t, MsgTypeConnected)
+
+	// The remote end never pongs
+	deadline := time.Now().Add(time.Second)
+	for !client.pongLagging.Load() {
+		if time.Now().After(deadline) {
+			t.Fatal("Pong lag not detected")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := metrics.PongLagWarnings.Load() - before; n != 1 {
+		t.Errorf("Counted %d lag warnings, want 1 per episode", n)
+	}
+	if client.closed.Load() {
+		t.Error("Lag should be flagged before the client is disconnected")
+	}
+
+	conn.answerPing()
+	if client.pongLagging.Load() {
+		t.Error("A pong should clear the lag flag")
+	}
+}
+
+func TestClient_DisconnectAfterInvalidMessages(t *testing.T) {
+	hub := NewHub()
+	hub.maxInvalidMessages = 3
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go hub.Run(ctx)
+
+	client, conn := connectMem(t, hub)
+	send := func() {
+		t.Helper()
+		select {
+		case conn.in <- []byte("{not json"):
+		case <-time.After(time.Second):
+			t.Fatal("Server not reading")
+		}
+	}
+	garbage := func() {
+		t.Helper()
+		send()
+		conn.expect(t, MsgTypeError)
+	}
+
+	// A valid message breaks the run
+	garbage()
+	garbage()
+	conn.send(t, SignalingMessage{Type: MsgTypeServerTime})
+	conn.expect(t, MsgTypeServerTime)
+	garbage()
+	garbage()
+	if client.closed.Load() {
+		t.Fatal("Disconnected before the threshold")
+	}
+
+	send()
+	select {
+	case <-conn.done:
+	case <-time.After(time.Second):
+		t.Fatal("Client not disconnected after repeated invalid messages")
+	}
+}
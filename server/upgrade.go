@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Reasons a /ws request is refused before the upgrade. They are stable so
+// client libraries can match on them and show a useful message.
+const (
+	UpgradeReasonNotWebSocket     = "not_websocket"
+	UpgradeReasonRateLimited      = "rate_limited"
+	UpgradeReasonConnectKey       = "invalid_connect_key"
+	UpgradeReasonUnauthorized     = "unauthorized"
+	UpgradeReasonReconnectChurn   = "reconnect_rate_limited"
+	UpgradeReasonClientID         = "invalid_client_id"
+	UpgradeReasonMissingHeader    = "missing_required_header"
+	UpgradeReasonShuttingDown     = "shutting_down"
+	UpgradeReasonUserAgent        = "user_agent_denied"
+	UpgradeReasonOriginLimit      = "origin_connection_limit"
+	UpgradeReasonOriginNotAllowed = "origin_not_allowed"
+	UpgradeReasonBadHandshake     = "bad_handshake"
+)
+
+// UpgradeFailure is the JSON body of a refused /ws request
+type UpgradeFailure struct {
+	Reason string `json:"reason"` // One of the UpgradeReason constants
+	Error  string `json:"error"`  // Human-readable detail
+}
+
+func writeUpgradeFailure(w http.ResponseWriter, status int, reason, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(UpgradeFailure{Reason: reason, Error: message})
+}
+
+// missingHeader returns the first of names that r lacks or has empty, or ""
+// if it carries them all
+func missingHeader(r *http.Request, names []string) string {
+	for _, name := range names {
+		if r.Header.Get(name) == "" {
+			return name
+		}
+	}
+	return ""
+}
+
+// upgradeError reports a handshake the upgrader itself refused, such as a
+// disallowed origin or missing WebSocket headers
+func upgradeError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	reason := UpgradeReasonBadHandshake
+	if status == http.StatusForbidden {
+		reason = UpgradeReasonOriginNotAllowed
+	}
+	writeUpgradeFailure(w, status, reason, err.Error())
+}
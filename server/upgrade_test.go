@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWsHandler_UpgradeFailureReasons(t *testing.T) {
+	wsHeaders := func(req *http.Request) {
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "websocket")
+		req.Header.Set("Sec-WebSocket-Version", "13")
+		req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	}
+
+	tests := []struct {
+		name   string
+		setup  func(t *testing.T, req *http.Request)
+		status int
+		reason string
+	}{
+		{"plain HTTP", func(t *testing.T, req *http.Request) {
+			req.Header.Del("Upgrade")
+		}, http.StatusUpgradeRequired, UpgradeReasonNotWebSocket},
+		{"rate limited", func(t *testing.T, req *http.Request) {
+			prev := rateLimiter
+			rateLimiter = NewRateLimiter(0, time.Minute)
+			t.Cleanup(func() {
+				rateLimiter.Stop()
+				rateLimiter = prev
+			})
+		}, http.StatusTooManyRequests, UpgradeReasonRateLimited},
+		{"connect key", func(t *testing.T, req *http.Request) {
+			t.Setenv("CONNECT_KEY", "s3cret")
+		}, http.StatusUnauthorized, UpgradeReasonConnectKey},
+		{"user agent", func(t *testing.T, req *http.Request) {
+			prev := userAgentFilter
+			userAgentFilter = NewUserAgentFilter(nil, []string{"badbot"})
+			t.Cleanup(func() { userAgentFilter = prev })
+			req.Header.Set("User-Agent", "badbot/1.0")
+		}, http.StatusForbidden, UpgradeReasonUserAgent},
+		{"origin limit", func(t *testing.T, req *http.Request) {
+			prev := originLimiter
+			originLimiter = NewOriginLimiter(1)
+			originLimiter.Acquire("https://busy.example")
+			t.Cleanup(func() { originLimiter = prev })
+			req.Header.Set("Origin", "https://busy.example")
+		}, http.StatusTooManyRequests, UpgradeReasonOriginLimit},
+		{"origin not allowed", func(t *testing.T, req *http.Request) {
+			t.Setenv("ALLOWED_ORIGINS", "https://app.example")
+			req.Header.Set("Origin", "https://evil.example")
+		}, http.StatusForbidden, UpgradeReasonOriginNotAllowed},
+		{"missing required header", func(t *testing.T, req *http.Request) {
+			prev := requiredHeaders
+			requiredHeaders = []string{"X-Auth-Verified"}
+			t.Cleanup(func() { requiredHeaders = prev })
+		}, http.StatusForbidden, UpgradeReasonMissingHeader},
+		{"missing key", func(t *testing.T, req *http.Request) {
+			req.Header.Del("Sec-WebSocket-Key")
+		}, http.StatusBadRequest, UpgradeReasonBadHandshake},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prev := rateLimiter
+			rateLimiter = NewRateLimiter(100, time.Minute)
+			t.Cleanup(func() {
+				rateLimiter.Stop()
+				rateLimiter = prev
+			})
+
+			req := httptest.NewRequest("GET", "/ws", nil)
+			wsHeaders(req)
+			tt.setup(t, req)
+			rec := httptest.NewRecorder()
+			wsHandler(NewHub()).ServeHTTP(rec, req)
+
+			if rec.Code != tt.status {
+				t.Errorf("Status = %d, want %d", rec.Code, tt.status)
+			}
+			if got := rec.Header().Get("Content-Type"); got != "application/json" {
+				t.Errorf("Content-Type = %q, want application/json", got)
+			}
+			var body UpgradeFailure
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatalf("Failed to parse %q: %v", rec.Body, err)
+			}
+			if body.Reason != tt.reason || body.Error == "" {
+				t.Errorf("Body = %+v, want reason %q with a message", body, tt.reason)
+			}
+		})
+	}
+}
+
+func TestServeWs_RequiredHeaders(t *testing.T) {
+	prev := requiredHeaders
+	requiredHeaders = []string{"X-Auth-Verified"}
+	defer func() { requiredHeaders = prev }()
+
+	hub := NewHub()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go hub.Run(ctx)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveWs(hub, w, r)
+	}))
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected 403 without the required header, got %v", resp)
+	}
+
+	ws, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"X-Auth-Verified": {"1"}})
+	if err != nil {
+		t.Fatalf("Upgrade with the required header failed: %v", err)
+	}
+	ws.Close()
+}
+
+func TestWsHandler_Preflight(t *testing.T) {
+	t.Setenv("ALLOWED_ORIGINS", "https://app.example")
+	prev := rateLimiter
+	rl := NewRateLimiter(5, time.Minute)
+	rateLimiter = rl
+	defer func() {
+		rl.Stop()
+		rateLimiter = prev
+	}()
+
+	req := httptest.NewRequest(http.MethodOptions, "/ws", nil)
+	req.RemoteAddr = "198.51.100.7:4242"
+	req.Header.Set("Origin", "https://app.example")
+	req.Header.Set("Access-Control-Request-Method", "GET")
+	rec := httptest.NewRecorder()
+	allowMethods(wsHandler(NewHub()), http.MethodGet, http.MethodOptions).ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Status = %d, want 200", rec.Code)
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "https://app.example" {
+		t.Errorf("Access-Control-Allow-Origin = %q, want the allowed origin", got)
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Methods"); !strings.Contains(got, "GET") {
+		t.Errorf("Access-Control-Allow-Methods = %q, want GET allowed", got)
+	}
+	if rec.Body.Len() != 0 {
+		t.Errorf("Preflight should have no body, got %q", rec.Body)
+	}
+	if _, tracked := rl.attempts["198.51.100.7"]; tracked {
+		t.Error("Preflight should not consume a rate-limit token")
+	}
+}
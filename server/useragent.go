@@ -0,0 +1,56 @@
+package main
+
+import (
+	"log/slog"
+	"regexp"
+)
+
+// UserAgentFilter admits WebSocket upgrades by User-Agent. A request is
+// rejected if its agent matches any deny pattern, or if allow patterns are
+// set and it matches none of them. With no patterns every agent is admitted.
+type UserAgentFilter struct {
+	allow []*regexp.Regexp
+	deny  []*regexp.Regexp
+}
+
+// NewUserAgentFilter compiles the given regular expressions, skipping (and
+// warning about) any that don't compile
+func NewUserAgentFilter(allow, deny []string) *UserAgentFilter {
+	return &UserAgentFilter{
+		allow: compilePatterns(allow),
+		deny:  compilePatterns(deny),
+	}
+}
+
+func compilePatterns(patterns []string) []*regexp.Regexp {
+	var compiled []*regexp.Regexp
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			slog.Warn("Invalid User-Agent pattern",
+				slog.String("pattern", p),
+				slog.String("error", err.Error()))
+			continue
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled
+}
+
+// Allowed reports whether a client with the given User-Agent may connect
+func (f *UserAgentFilter) Allowed(userAgent string) bool {
+	for _, re := range f.deny {
+		if re.MatchString(userAgent) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, re := range f.allow {
+		if re.MatchString(userAgent) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestUserAgentFilter(t *testing.T) {
+	f := NewUserAgentFilter([]string{`^WarpLAN/`, `(`}, []string{`(?i)scrapy|curl`})
+	tests := []struct {
+		agent string
+		want  bool
+	}{
+		{"WarpLAN/2.1 (Android)", true},
+		{"Mozilla/5.0", false},      // Matches no allow pattern
+		{"WarpLAN/2.1 curl", false}, // Deny wins
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := f.Allowed(tt.agent); got != tt.want {
+			t.Errorf("Allowed(%q) = %v, want %v", tt.agent, got, tt.want)
+		}
+	}
+	if len(f.allow) != 1 {
+		t.Errorf("Invalid pattern should be skipped, got %d allow patterns", len(f.allow))
+	}
+
+	open := NewUserAgentFilter(nil, nil)
+	if !open.Allowed("anything") || !open.Allowed("") {
+		t.Error("Filter without patterns should allow every agent")
+	}
+}
+
+func TestServeWs_UserAgentDenied(t *testing.T) {
+	prevFilter := userAgentFilter
+	userAgentFilter = NewUserAgentFilter(nil, []string{`(?i)badbot`})
+	defer func() { userAgentFilter = prevFilter }()
+
+	hub := NewHub()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go hub.Run(ctx)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveWs(hub, w, r)
+	}))
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"User-Agent": []string{"BadBot/1.0"}})
+	if err == nil {
+		t.Fatal("Expected denied User-Agent to be refused")
+	}
+	if resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected 403, got %v", resp)
+	}
+
+	ws, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"User-Agent": []string{"WarpLAN/2.1"}})
+	if err != nil {
+		t.Fatalf("Allowed User-Agent refused: %v", err)
+	}
+	ws.Close()
+}